@@ -0,0 +1,204 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Request is one request a client makes. A Form makes it a POST.
+type Request struct {
+	Path string // with any query string
+	Form url.Values
+}
+
+// Scenario is a kind of traffic to measure.
+type Scenario struct {
+	Name string
+	// Login returns the session cookie the given client logs in with. If it
+	// is nil, clients browse as guests.
+	Login func(client int) (*http.Cookie, error)
+	// Next returns the request a client makes next.
+	Next func(rng *rand.Rand) Request
+}
+
+// Result is what a run of a scenario measured.
+type Result struct {
+	Scenario string
+	Requests int
+	Errors   int
+	// FirstError describes the first failed request, if any did.
+	FirstError string
+	Elapsed    time.Duration
+	latencies  []time.Duration // sorted
+}
+
+// Throughput returns the requests completed per second.
+func (r Result) Throughput() float64 {
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency that p percent of requests beat.
+func (r Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[i]
+}
+
+// Run has clients concurrent clients make requests of s against the server
+// at baseURL, each as soon as the last is answered, for the given duration.
+// Responses other than 2xx and 3xx count as errors; redirects are not
+// followed. Each client keeps its own cookies, as a browser would.
+func Run(ctx context.Context, baseURL string, s Scenario, clients int, duration time.Duration) (Result, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return Result{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	transport := &http.Transport{MaxIdleConnsPerHost: clients}
+	defer transport.CloseIdleConnections()
+
+	var (
+		mu     sync.Mutex
+		result = Result{Scenario: s.Name}
+		wg     sync.WaitGroup
+	)
+	record := func(latencies []time.Duration, errors int, firstError string) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.latencies = append(result.latencies, latencies...)
+		result.Errors += errors
+		if result.FirstError == "" {
+			result.FirstError = firstError
+		}
+	}
+
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		jar, _ := cookiejar.New(nil)
+		if s.Login != nil {
+			cookie, err := s.Login(i)
+			if err != nil {
+				cancel()
+				wg.Wait()
+				return Result{}, err
+			}
+			jar.SetCookies(base, []*http.Cookie{cookie})
+		}
+		client := &http.Client{
+			Transport: transport,
+			Jar:       jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			var latencies []time.Duration
+			var errors int
+			var firstError string
+			for ctx.Err() == nil {
+				took, err := do(ctx, client, base, s.Next(rng))
+				if ctx.Err() != nil {
+					break // cut off by the end of the run
+				}
+				latencies = append(latencies, took)
+				if err != nil {
+					errors++
+					if firstError == "" {
+						firstError = err.Error()
+					}
+				}
+			}
+			record(latencies, errors, firstError)
+		}(rand.New(rand.NewSource(int64(i))))
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.Requests = len(result.latencies)
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result, nil
+}
+
+// do makes one request and reads the whole response, returning how long
+// that took.
+func do(ctx context.Context, client *http.Client, base *url.URL, r Request) (time.Duration, error) {
+	method, body := http.MethodGet, io.Reader(nil)
+	if r.Form != nil {
+		method, body = http.MethodPost, strings.NewReader(r.Form.Encode())
+	}
+	ref, err := url.Parse(r.Path)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base.ResolveReference(ref).String(), body)
+	if err != nil {
+		return 0, err
+	}
+	if r.Form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Since(start), err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	took := time.Since(start)
+	if err != nil {
+		return took, err
+	}
+	if resp.StatusCode >= 400 {
+		return took, fmt.Errorf("%s %s: %s", method, r.Path, resp.Status)
+	}
+	return took, nil
+}
+
+// WriteTable writes results as an aligned table, with the first error of
+// any scenario that had errors after it.
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "scenario\trequests\treq/s\tp50\tp95\tp99\tmax\terrors\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%s\t%s\t%s\t%s\t%d\t\n", r.Scenario, r.Requests, r.Throughput(),
+			round(r.Percentile(50)), round(r.Percentile(95)), round(r.Percentile(99)), round(r.Percentile(100)), r.Errors)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.FirstError != "" {
+			fmt.Fprintf(w, "%s: first error: %s\n", r.Scenario, r.FirstError)
+		}
+	}
+	return nil
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
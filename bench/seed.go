@@ -0,0 +1,124 @@
+// Package bench measures how the forum holds up under concurrent load: it
+// fills a database with users, posts and comments, then has many clients
+// request pages at once and reports throughput and latency.
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Size is how much data Seed creates.
+type Size struct {
+	Users           int
+	Posts           int
+	CommentsPerPost int
+	Tags            int
+}
+
+// Dataset holds the IDs of what Seed created.
+type Dataset struct {
+	UserIDs []int64
+	PostIDs []int64
+}
+
+// sqliteTime matches the format of SQLite's CURRENT_TIMESTAMP.
+const sqliteTime = "2006-01-02 15:04:05"
+
+// Seed fills a migrated database with generated content, spread over the
+// past year so the feed's ordering has work to do. It runs in a single
+// transaction.
+func Seed(ctx context.Context, db *sql.DB, size Size) (Dataset, error) {
+	var data Dataset
+	rng := rand.New(rand.NewSource(1))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return data, err
+	}
+	defer tx.Rollback()
+
+	insert := func(query string, args ...interface{}) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+
+	for i := 0; i < size.Users; i++ {
+		id, err := insert("INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)",
+			fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.edu", i), "!")
+		if err != nil {
+			return data, fmt.Errorf("seeding users: %w", err)
+		}
+		data.UserIDs = append(data.UserIDs, id)
+	}
+
+	var tagIDs []int64
+	for i := 0; i < size.Tags; i++ {
+		id, err := insert("INSERT INTO tags (name) VALUES (?)", fmt.Sprintf("topic-%d", i))
+		if err != nil {
+			return data, fmt.Errorf("seeding tags: %w", err)
+		}
+		tagIDs = append(tagIDs, id)
+	}
+
+	now := time.Now().UTC()
+	year := int64(365 * 24 * time.Hour)
+	for i := 0; i < size.Posts; i++ {
+		created := now.Add(-time.Duration(rng.Int63n(year)))
+		id, err := insert("INSERT INTO posts (title, content, author_id, created_at) VALUES (?, ?, ?, ?)",
+			fmt.Sprintf("Question %d about the course", i), paragraph(rng), pick(rng, data.UserIDs),
+			created.Format(sqliteTime))
+		if err != nil {
+			return data, fmt.Errorf("seeding posts: %w", err)
+		}
+		data.PostIDs = append(data.PostIDs, id)
+
+		for j := 0; j < 2 && len(tagIDs) > 0; j++ {
+			_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO post_tags (post_id, tag_id) VALUES (?, ?)",
+				id, pick(rng, tagIDs))
+			if err != nil {
+				return data, fmt.Errorf("seeding tags: %w", err)
+			}
+		}
+
+		for j := 0; j < size.CommentsPerPost; j++ {
+			commented := created.Add(time.Duration(j+1) * time.Minute)
+			_, err := tx.ExecContext(ctx, "INSERT INTO comments (content, post_id, author_id, created_at) VALUES (?, ?, ?, ?)",
+				paragraph(rng), id, pick(rng, data.UserIDs), commented.Format(sqliteTime))
+			if err != nil {
+				return data, fmt.Errorf("seeding comments: %w", err)
+			}
+		}
+	}
+
+	return data, tx.Commit()
+}
+
+var words = []string{
+	"lecture", "assignment", "deadline", "exam", "lab", "notes", "question",
+	"problem", "solution", "reading", "chapter", "office", "hours", "grade",
+	"project", "group", "slides", "tutorial", "week", "submission",
+}
+
+// paragraph returns a few sentences of filler text.
+func paragraph(rng *rand.Rand) string {
+	n := 20 + rng.Intn(60)
+	b := make([]byte, 0, n*8)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, words[rng.Intn(len(words))]...)
+	}
+	return string(append(b, '.'))
+}
+
+func pick(rng *rand.Rand, ids []int64) int64 {
+	return ids[rng.Intn(len(ids))]
+}
@@ -0,0 +1,139 @@
+// Package cache is a small in-process LRU cache whose entries also expire
+// after a fixed time.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache holds up to a fixed number of values, evicting the least recently
+// used when full. Values are returned as stored, so callers must not modify
+// them. It is safe for concurrent use.
+type Cache[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // most recently used first
+	items    map[string]*list.Element
+	// generation changes on every removal, so that a value loaded from data
+	// that has since changed is not stored.
+	generation uint64
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// New returns a cache holding up to capacity values for at most ttl each. A
+// capacity of zero or less disables caching.
+func New[V any](capacity int, ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key, if it is there and hasn't expired.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*entry[V])
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// Load returns the value stored under key, or calls load and stores what it
+// returns. If the cache is invalidated while load runs, its result is
+// returned but not stored, since it may predate the change. Concurrent
+// misses on the same key each call load.
+func (c *Cache[V]) Load(key string, load func() (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.set(key, v)
+	}
+	return v, nil
+}
+
+// Set stores v under key, evicting the least recently used value if the
+// cache is full.
+func (c *Cache[V]) Set(key string, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, v)
+}
+
+func (c *Cache[V]) set(key string, v V) {
+	if c.capacity <= 0 {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[V])
+		e.value, e.expires = v, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry[V]{key: key, value: v, expires: expires})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// RemoveFunc removes every value whose key matches.
+func (c *Cache[V]) RemoveFunc(match func(key string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, el := range c.items {
+		if match(key) {
+			c.remove(el)
+		}
+	}
+}
+
+// Clear removes every value.
+func (c *Cache[V]) Clear() {
+	c.RemoveFunc(func(string) bool { return true })
+}
+
+// Len returns the number of values stored, including any that have expired
+// but not yet been removed.
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *Cache[V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry[V]).key)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetSet(t *testing.T) {
+	c := New[int](2, time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("empty cache returned a value")
+	}
+	c.Set("a", 1)
+	c.Set("a", 2)
+	if v, ok := c.Get("a"); !ok || v != 2 {
+		t.Fatalf("Get(a) = %d, %v; want 2, true", v, ok)
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[int](2, time.Minute)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // b is now the least recently used
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was kept; want it evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestExpires(t *testing.T) {
+	c := New[int](2, time.Millisecond)
+	c.Set("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired value was returned")
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len = %d after expiry, want 0", n)
+	}
+}
+
+func TestZeroCapacityDisablesCaching(t *testing.T) {
+	c := New[int](0, time.Minute)
+	c.Set("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Error("cache with no capacity stored a value")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c := New[int](2, time.Minute)
+	calls := 0
+	load := func() (int, error) {
+		calls++
+		return 7, nil
+	}
+	for i := 0; i < 2; i++ {
+		if v, err := c.Load("a", load); err != nil || v != 7 {
+			t.Fatalf("Load = %d, %v; want 7, nil", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("load called %d times, want 1", calls)
+	}
+
+	fail := errors.New("fail")
+	if _, err := c.Load("b", func() (int, error) { return 0, fail }); err != fail {
+		t.Errorf("Load error = %v, want %v", err, fail)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("failed load was stored")
+	}
+}
+
+func TestLoadDuringInvalidationIsNotStored(t *testing.T) {
+	c := New[int](2, time.Minute)
+	v, err := c.Load("a", func() (int, error) {
+		c.Clear() // the data changes while it is being loaded
+		return 1, nil
+	})
+	if err != nil || v != 1 {
+		t.Fatalf("Load = %d, %v; want 1, nil", v, err)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("value loaded before an invalidation was stored")
+	}
+}
+
+func TestRemoveFunc(t *testing.T) {
+	c := New[int](4, time.Minute)
+	c.Set("1/student", 1)
+	c.Set("1/admin", 2)
+	c.Set("2/student", 3)
+	c.RemoveFunc(func(key string) bool { return strings.HasPrefix(key, "1/") })
+
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+	if _, ok := c.Get("2/student"); !ok {
+		t.Error("unmatched key was removed")
+	}
+	c.Clear()
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len = %d after Clear, want 0", n)
+	}
+}
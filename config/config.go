@@ -0,0 +1,221 @@
+// Package config loads the forum's settings from defaults, a YAML or TOML
+// file, environment variables and command-line flags, each overriding the
+// one before.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"university-forum/server"
+)
+
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// DefaultSessionKey signs session cookies when no key is configured. It is
+// public, so anyone could forge a session with it; production refuses it.
+const DefaultSessionKey = "super-secret-key"
+
+// minSessionKeyLength is the shortest session key production accepts.
+const minSessionKeyLength = 32
+
+// Config holds every setting. Each leaf field is tagged with its key in the
+// config file, its environment variable and, for settings commonly changed
+// per run, its flag. Secrets have no flag, since command lines can be read
+// by other users of the machine, and are redacted when printed.
+type Config struct {
+	Env        string `yaml:"env" toml:"env" env:"FORUM_ENV" flag:"env" usage:"environment: development or production"`
+	Addr       string `yaml:"addr" toml:"addr" env:"FORUM_ADDR" flag:"addr" usage:"address to listen on"`
+	BaseURL    string `yaml:"base_url" toml:"base_url" env:"FORUM_BASE_URL" flag:"base-url" usage:"public URL of the site, used for links in emails"`
+	Database   string `yaml:"database" toml:"database" env:"FORUM_DATABASE" flag:"database" usage:"path to the SQLite database"`
+	SessionKey string `yaml:"session_key" toml:"session_key" env:"FORUM_SESSION_KEY" secret:"true"`
+	WordList   string `yaml:"word_list" toml:"word_list" env:"FORUM_WORD_LIST" flag:"word-list" usage:"file of words the content filter blocks"`
+
+	Log       Log       `yaml:"log" toml:"log"`
+	Server    Server    `yaml:"server" toml:"server"`
+	Telemetry Telemetry `yaml:"telemetry" toml:"telemetry"`
+	Storage   Storage   `yaml:"storage" toml:"storage"`
+	Mail      Mail      `yaml:"mail" toml:"mail"`
+	Cache     Cache     `yaml:"cache" toml:"cache"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level" env:"FORUM_LOG_LEVEL" flag:"log-level" usage:"minimum level to log: debug, info, warn or error"`
+	Format string `yaml:"format" toml:"format" env:"FORUM_LOG_FORMAT" flag:"log-format" usage:"log output format: text or json"`
+}
+
+type Server struct {
+	TLSCert         string        `yaml:"tls_cert" toml:"tls_cert" env:"FORUM_TLS_CERT" flag:"tls-cert" usage:"serve HTTPS with this certificate file, reloaded when it changes (needs -tls-key)"`
+	TLSKey          string        `yaml:"tls_key" toml:"tls_key" env:"FORUM_TLS_KEY" flag:"tls-key" usage:"private key file for -tls-cert"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"FORUM_READ_TIMEOUT" flag:"read-timeout" usage:"maximum time to read a request, including its body"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"FORUM_WRITE_TIMEOUT" flag:"write-timeout" usage:"maximum time to write a response"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"FORUM_IDLE_TIMEOUT" flag:"idle-timeout" usage:"how long to keep idle keep-alive connections open"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"FORUM_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long to let in-flight requests finish on shutdown"`
+}
+
+type Telemetry struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint" toml:"otlp_endpoint" env:"FORUM_OTLP_ENDPOINT" flag:"otlp-endpoint" usage:"send traces over OTLP/HTTP to the collector at this host:port, such as localhost:4318"`
+	MetricsAllow string `yaml:"metrics_allow" toml:"metrics_allow" env:"FORUM_METRICS_ALLOW" flag:"metrics-allow" usage:"comma-separated addresses and CIDR blocks allowed to read /metrics; behind a reverse proxy every request comes from the proxy's address"`
+	MetricsToken string `yaml:"metrics_token" toml:"metrics_token" env:"FORUM_METRICS_TOKEN" secret:"true"`
+}
+
+// Storage chooses where attachments are kept: "local" keeps them under Dir,
+// "s3" in a bucket on an S3-compatible service.
+type Storage struct {
+	Driver      string `yaml:"driver" toml:"driver" env:"FORUM_STORAGE_DRIVER"`
+	Dir         string `yaml:"dir" toml:"dir" env:"FORUM_STORAGE_DIR"`
+	S3Endpoint  string `yaml:"s3_endpoint" toml:"s3_endpoint" env:"FORUM_S3_ENDPOINT"`
+	S3Bucket    string `yaml:"s3_bucket" toml:"s3_bucket" env:"FORUM_S3_BUCKET"`
+	S3Region    string `yaml:"s3_region" toml:"s3_region" env:"FORUM_S3_REGION"`
+	S3AccessKey string `yaml:"s3_access_key" toml:"s3_access_key" env:"FORUM_S3_ACCESS_KEY"`
+	S3SecretKey string `yaml:"s3_secret_key" toml:"s3_secret_key" env:"FORUM_S3_SECRET_KEY" secret:"true"`
+}
+
+// Mail chooses how notification emails are sent: "file" writes them under
+// Dir for development, "smtp" sends them through SMTPAddr.
+type Mail struct {
+	Driver        string `yaml:"driver" toml:"driver" env:"FORUM_MAIL_DRIVER"`
+	Dir           string `yaml:"dir" toml:"dir" env:"FORUM_MAIL_DIR"`
+	From          string `yaml:"from" toml:"from" env:"FORUM_MAIL_FROM"`
+	SMTPAddr      string `yaml:"smtp_addr" toml:"smtp_addr" env:"FORUM_SMTP_ADDR"`
+	SMTPUsername  string `yaml:"smtp_username" toml:"smtp_username" env:"FORUM_SMTP_USERNAME"`
+	SMTPPassword  string `yaml:"smtp_password" toml:"smtp_password" env:"FORUM_SMTP_PASSWORD" secret:"true"`
+	ReplyDomain   string `yaml:"reply_domain" toml:"reply_domain" env:"FORUM_REPLY_DOMAIN"`
+	InboundSecret string `yaml:"inbound_secret" toml:"inbound_secret" env:"FORUM_INBOUND_SECRET" secret:"true"`
+}
+
+// Cache sizes the in-memory cache of feed pages and post views. Entries of
+// zero turns it off.
+type Cache struct {
+	Entries int           `yaml:"entries" toml:"entries" env:"FORUM_CACHE_ENTRIES"`
+	TTL     time.Duration `yaml:"ttl" toml:"ttl" env:"FORUM_CACHE_TTL"`
+}
+
+// Default returns the settings used when nothing overrides them, which suit
+// running from a checkout in development.
+func Default() *Config {
+	return &Config{
+		Env:        Development,
+		Addr:       ":7000",
+		BaseURL:    "http://localhost:7000",
+		Database:   "./forum.db",
+		SessionKey: DefaultSessionKey,
+		WordList:   "./wordlist.txt",
+		Log:        Log{Level: "info", Format: "text"},
+		Server: Server{
+			ReadTimeout:     server.DefaultReadTimeout,
+			WriteTimeout:    server.DefaultWriteTimeout,
+			IdleTimeout:     server.DefaultIdleTimeout,
+			ShutdownTimeout: server.DefaultShutdownTimeout,
+		},
+		Storage: Storage{Driver: "local", Dir: "./uploads"},
+		Mail:    Mail{Driver: "file", Dir: "./mail", From: "University Forum <forum@localhost>"},
+		Cache:   Cache{Entries: 1000, TTL: time.Minute},
+	}
+}
+
+// Validate reports every problem with the settings at once, so they can all
+// be fixed before the next start.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("config: %s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	required := func(key, value string) {
+		if strings.TrimSpace(value) == "" {
+			fail(key, "must be set")
+		}
+	}
+
+	switch c.Env {
+	case Development, Production:
+	default:
+		fail("env", "must be %q or %q, not %q", Development, Production, c.Env)
+	}
+	required("addr", c.Addr)
+	required("database", c.Database)
+	required("word_list", c.WordList)
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("base_url", "must be an absolute http or https URL, not %q", c.BaseURL)
+	}
+
+	if c.SessionKey == "" {
+		fail("session_key", "must be set")
+	} else if c.Env == Production {
+		if c.SessionKey == DefaultSessionKey {
+			fail("session_key", "the built-in default can't be used in production; set FORUM_SESSION_KEY to a random value")
+		} else if len(c.SessionKey) < minSessionKeyLength {
+			fail("session_key", "must be at least %d bytes in production", minSessionKeyLength)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		fail("log.level", "unknown level %q", c.Log.Level)
+	}
+	if f := strings.ToLower(c.Log.Format); f != "text" && f != "json" {
+		fail("log.format", "must be text or json, not %q", c.Log.Format)
+	}
+
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		fail("server", "tls_cert and tls_key must be set together")
+	}
+	for _, t := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		if t.d <= 0 {
+			fail(t.key, "must be positive")
+		}
+	}
+
+	switch c.Storage.Driver {
+	case "local":
+		required("storage.dir", c.Storage.Dir)
+	case "s3":
+		required("storage.s3_endpoint", c.Storage.S3Endpoint)
+		required("storage.s3_bucket", c.Storage.S3Bucket)
+		required("storage.s3_region", c.Storage.S3Region)
+		required("storage.s3_access_key", c.Storage.S3AccessKey)
+		required("storage.s3_secret_key", c.Storage.S3SecretKey)
+	default:
+		fail("storage.driver", "must be local or s3, not %q", c.Storage.Driver)
+	}
+
+	switch c.Mail.Driver {
+	case "file":
+		required("mail.dir", c.Mail.Dir)
+	case "smtp":
+		required("mail.smtp_addr", c.Mail.SMTPAddr)
+	default:
+		fail("mail.driver", "must be file or smtp, not %q", c.Mail.Driver)
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		fail("mail.from", "invalid address %q", c.Mail.From)
+	}
+	if c.Mail.ReplyDomain != "" && c.Mail.InboundSecret == "" {
+		fail("mail.inbound_secret", "must be set when reply_domain is, or anyone could post replies")
+	}
+
+	if c.Cache.Entries < 0 {
+		fail("cache.entries", "must not be negative")
+	}
+	if c.Cache.TTL <= 0 {
+		fail("cache.ttl", "must be positive")
+	}
+
+	return errors.Join(errs...)
+}
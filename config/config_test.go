@@ -0,0 +1,202 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every FORUM_ variable for the rest of the test, so the
+// environment the tests run in can't leak into them.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "FORUM_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("forum", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args)
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Env = "staging"
+	cfg.BaseURL = "forum.example.edu"
+	cfg.Log.Level = "loud"
+	cfg.Cache.TTL = 0
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config passed")
+	}
+	for _, key := range []string{"env", "base_url", "log.level", "cache.ttl"} {
+		if !strings.Contains(err.Error(), "config: "+key+":") {
+			t.Errorf("error doesn't mention %s:\n%v", key, err)
+		}
+	}
+}
+
+func TestValidateProductionSessionKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{DefaultSessionKey, false},
+		{"too-short", false},
+		{strings.Repeat("k", minSessionKeyLength), true},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.Env = Production
+		cfg.SessionKey = tt.key
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("session key %q: Validate() = %v, want ok = %v", tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateInboundMailNeedsSecret(t *testing.T) {
+	cfg := Default()
+	cfg.Mail.ReplyDomain = "reply.example.edu"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "mail.inbound_secret") {
+		t.Errorf("Validate() = %v, want an error about mail.inbound_secret", err)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "forum.yaml", `
+addr: ":8000"
+database: /var/forum/file.db
+log:
+  level: debug
+server:
+  read_timeout: 5s
+`)
+	t.Setenv("FORUM_CONFIG", path)
+	t.Setenv("FORUM_DATABASE", "/var/forum/env.db")
+	t.Setenv("FORUM_LOG_LEVEL", "warn")
+
+	cfg, err := load(t, "-log-level", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8000" {
+		t.Errorf("addr = %q, want the file's", cfg.Addr)
+	}
+	if cfg.Database != "/var/forum/env.db" {
+		t.Errorf("database = %q, want the environment's", cfg.Database)
+	}
+	if cfg.Log.Level != "error" {
+		t.Errorf("log.level = %q, want the flag's", cfg.Log.Level)
+	}
+	if cfg.Server.ReadTimeout != 5*time.Second {
+		t.Errorf("server.read_timeout = %s, want the file's", cfg.Server.ReadTimeout)
+	}
+	if cfg.BaseURL != Default().BaseURL {
+		t.Errorf("base_url = %q, want the default", cfg.BaseURL)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "forum.toml", `
+addr = ":9000"
+
+[cache]
+entries = 50
+ttl = "30s"
+`)
+	cfg, err := load(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9000" || cfg.Cache.Entries != 50 || cfg.Cache.TTL != 30*time.Second {
+		t.Errorf("loaded addr %q, cache %+v", cfg.Addr, cfg.Cache)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	clearEnv(t)
+	for name, data := range map[string]string{
+		"forum.yaml": "adress: \":8000\"\n",
+		"forum.toml": "adress = \":8000\"\n",
+	} {
+		if _, err := load(t, "-config", writeFile(t, name, data)); err == nil {
+			t.Errorf("%s: unknown key was accepted", name)
+		}
+	}
+}
+
+func TestLoadBadEnvironment(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("FORUM_CACHE_ENTRIES", "lots")
+	if _, err := load(t); err == nil || !strings.Contains(err.Error(), "FORUM_CACHE_ENTRIES") {
+		t.Errorf("Load() = %v, want an error naming FORUM_CACHE_ENTRIES", err)
+	}
+}
+
+func TestSecretsHaveNoFlag(t *testing.T) {
+	for _, f := range fieldsOf(Default()) {
+		if f.secret && f.flag != "" {
+			t.Errorf("secret %s can be set with -%s", f.key, f.flag)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	clearEnv(t)
+	cfg := Default()
+	cfg.SessionKey = "session-secret"
+	cfg.Mail.SMTPPassword = "smtp-secret"
+
+	var buf bytes.Buffer
+	if err := Print(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"session-secret", "smtp-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("printed config contains %q:\n%s", secret, out)
+		}
+	}
+	if cfg.SessionKey != "session-secret" {
+		t.Errorf("Print changed the config's session key to %q", cfg.SessionKey)
+	}
+
+	// Unset secrets stay empty, and the rest loads back unchanged.
+	loaded, err := load(t, "-config", writeFile(t, "forum.yaml", out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SessionKey != redacted || loaded.Mail.InboundSecret != "" || loaded.Addr != cfg.Addr {
+		t.Errorf("loaded session key %q, inbound secret %q, addr %q", loaded.SessionKey, loaded.Mail.InboundSecret, loaded.Addr)
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the configuration from, in increasing order of precedence:
+// the defaults, the file named by -config or $FORUM_CONFIG, environment
+// variables, and flags. It registers its flags on fs and parses args with
+// it, so callers add their own flags to fs first. The result is not
+// validated.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	fields := fieldsOf(cfg)
+
+	configFile := fs.String("config", os.Getenv("FORUM_CONFIG"), "YAML or TOML file to read settings from (default $FORUM_CONFIG)")
+	for _, f := range fields {
+		if f.flag != "" {
+			f.define(fs)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(cfg, *configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fields {
+		if v, ok := os.LookupEnv(f.env); ok {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("config: %s from $%s: %w", f.key, f.env, err)
+			}
+		}
+	}
+	// Only flags given on the command line override, so a flag's default
+	// doesn't mask the file and environment.
+	set := map[string]string{}
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = fl.Value.String() })
+	for _, f := range fields {
+		if v, ok := set[f.flag]; ok && f.flag != "" {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("config: %s from -%s: %w", f.key, f.flag, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// loadFile reads settings from a YAML or TOML file, chosen by its
+// extension. Unknown keys are an error, since they are usually typos.
+func loadFile(cfg *Config, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: %s: unknown key %q", name, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config: %s: unknown format; use .yaml, .yml or .toml", name)
+	}
+	return nil
+}
+
+// field is one leaf setting of a Config.
+type field struct {
+	key    string // dotted file key, e.g. "server.read_timeout"
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// fieldsOf lists the settings of cfg, in declaration order, addressing
+// cfg's own fields.
+func fieldsOf(cfg *Config) []field {
+	var fields []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			key := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			fields = append(fields, field{
+				key:    key,
+				env:    sf.Tag.Get("env"),
+				flag:   sf.Tag.Get("flag"),
+				usage:  sf.Tag.Get("usage"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return fields
+}
+
+// define registers the field's flag on fs, with its current value as the
+// default shown in the usage message.
+func (f field) define(fs *flag.FlagSet) {
+	usage := fmt.Sprintf("%s (env %s)", f.usage, f.env)
+	switch v := f.value.Interface().(type) {
+	case string:
+		fs.String(f.flag, v, usage)
+	case time.Duration:
+		fs.Duration(f.flag, v, usage)
+	case bool:
+		fs.Bool(f.flag, v, usage)
+	case int:
+		fs.Int(f.flag, v, usage)
+	}
+}
+
+// set parses s into the field.
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+// FromCommandLine loads the configuration with the program's own flags and
+// validates it, exiting with the problems if it can't be used. Any other
+// flags must be defined on flag.CommandLine before it is called.
+func FromCommandLine() *Config {
+	cfg, err := Load(flag.CommandLine, os.Args[1:])
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return cfg
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets that are set when printing a configuration.
+const redacted = "REDACTED"
+
+// Print writes cfg to w as a YAML config file, with secrets redacted. The
+// output can be loaded again once the secrets are filled back in.
+func Print(w io.Writer, cfg *Config) error {
+	c := *cfg
+	for _, f := range fieldsOf(&c) {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,64 @@
+// Package events is an in-process publish/subscribe hub used to push live
+// updates to connected browsers.
+package events
+
+import "sync"
+
+// subscriberBuffer is how many events may queue for a subscriber before new
+// ones are dropped.
+const subscriberBuffer = 16
+
+// Event is a message published on a topic. Data must be encodable as JSON.
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// Hub fans out events published on a topic to every subscriber of that topic.
+// Publishing never blocks: a subscriber that falls behind misses events
+// rather than holding up the publisher.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving the events published on topic from
+// now on, and a function that ends the subscription.
+func (h *Hub) Subscribe(topic string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subs[topic] == nil {
+		h.subs[topic] = make(map[chan Event]struct{})
+	}
+	h.subs[topic][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs[topic], ch)
+			if len(h.subs[topic]) == 0 {
+				delete(h.subs, topic)
+			}
+			h.mu.Unlock()
+		})
+	}
+}
+
+// Publish sends an event to the current subscribers of topic.
+func (h *Hub) Publish(topic string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[topic] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package events
+
+import "testing"
+
+func TestPublishReachesTopicSubscribers(t *testing.T) {
+	h := NewHub()
+	a, unsubA := h.Subscribe("post:1")
+	defer unsubA()
+	b, unsubB := h.Subscribe("post:2")
+	defer unsubB()
+
+	h.Publish("post:1", Event{Type: "comment", Data: 1})
+	select {
+	case e := <-a:
+		if e.Type != "comment" || e.Data != 1 {
+			t.Errorf("received %+v", e)
+		}
+	default:
+		t.Fatal("subscriber missed the event")
+	}
+	select {
+	case e := <-b:
+		t.Errorf("subscriber to another topic received %+v", e)
+	default:
+	}
+}
+
+func TestPublishDropsEventsForSlowSubscribers(t *testing.T) {
+	h := NewHub()
+	ch, unsubscribe := h.Subscribe("feed")
+	defer unsubscribe()
+
+	// Publishing more than the buffer holds must not block.
+	for i := 0; i < subscriberBuffer+5; i++ {
+		h.Publish("feed", Event{Type: "post", Data: i})
+	}
+	if n := len(ch); n != subscriberBuffer {
+		t.Errorf("%d events queued, want %d", n, subscriberBuffer)
+	}
+	if e := <-ch; e.Data != 0 {
+		t.Errorf("first event queued is %v, want the oldest", e.Data)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	h := NewHub()
+	ch, unsubscribe := h.Subscribe("feed")
+	unsubscribe()
+	unsubscribe() // a second call does nothing
+
+	h.Publish("feed", Event{Type: "post"})
+	if len(ch) != 0 {
+		t.Error("event delivered after unsubscribing")
+	}
+	if len(h.subs) != 0 {
+		t.Errorf("hub still tracks %d topics", len(h.subs))
+	}
+}
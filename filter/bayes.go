@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// maxClassifiedTokens caps how many distinct words of a document are used for
+// training and classification.
+const maxClassifiedTokens = 500
+
+// TokenCount is how many spam and ham documents a word has appeared in.
+type TokenCount struct {
+	Spam int
+	Ham  int
+}
+
+// TokenStore persists what the classifier has learned.
+type TokenStore interface {
+	// Documents returns how many spam and ham documents have been trained.
+	Documents(ctx context.Context) (spam, ham int, err error)
+	// Counts returns the counts for the given words. Unseen words may be
+	// left out.
+	Counts(ctx context.Context, tokens []string) (map[string]TokenCount, error)
+	// Add records one document made up of the given distinct words.
+	Add(ctx context.Context, tokens []string, spam bool) error
+}
+
+// Classifier is a naive Bayes spam classifier. Content whose spam
+// probability reaches HoldAt is held and content reaching RejectAt is
+// rejected. It allows everything until it has been trained on at least
+// MinDocuments of both spam and ham, as a guess from a handful of examples
+// would do more harm than good.
+type Classifier struct {
+	Store        TokenStore
+	HoldAt       float64
+	RejectAt     float64
+	MinDocuments int
+}
+
+// Train records text as spam or ham in store.
+func Train(ctx context.Context, store TokenStore, text string, spam bool) error {
+	return store.Add(ctx, distinctTokens(text), spam)
+}
+
+// SpamProbability returns how likely text is to be spam, between 0 and 1.
+// ok is false when the classifier has not been trained enough to say.
+func (cl Classifier) SpamProbability(ctx context.Context, text string) (p float64, ok bool, err error) {
+	spamDocs, hamDocs, err := cl.Store.Documents(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if spamDocs < cl.MinDocuments || hamDocs < cl.MinDocuments || spamDocs == 0 || hamDocs == 0 {
+		return 0, false, nil
+	}
+
+	tokens := distinctTokens(text)
+	counts, err := cl.Store.Counts(ctx, tokens)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Sum the log odds with add-one smoothing, skipping words never seen in
+	// training since they say nothing either way.
+	logOdds := math.Log(float64(spamDocs)) - math.Log(float64(hamDocs))
+	for _, token := range tokens {
+		count, seen := counts[token]
+		if !seen {
+			continue
+		}
+		pSpam := float64(count.Spam+1) / float64(spamDocs+2)
+		pHam := float64(count.Ham+1) / float64(hamDocs+2)
+		logOdds += math.Log(pSpam) - math.Log(pHam)
+	}
+	return 1 / (1 + math.Exp(-logOdds)), true, nil
+}
+
+func (cl Classifier) Check(ctx context.Context, c Content) (Decision, error) {
+	p, ok, err := cl.SpamProbability(ctx, c.Text())
+	if err != nil || !ok {
+		return Decision{}, err
+	}
+	reason := fmt.Sprintf("looks like spam (%.0f%% likely)", p*100)
+	switch {
+	case p >= cl.RejectAt:
+		return Decision{Reject, "spam", reason}, nil
+	case p >= cl.HoldAt:
+		return Decision{Hold, "spam", reason}, nil
+	}
+	return Decision{}, nil
+}
+
+func distinctTokens(text string) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	for _, token := range Tokens(text) {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+		if len(tokens) == maxClassifiedTokens {
+			break
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,34 @@
+package filter
+
+import (
+	"context"
+	"time"
+)
+
+// RecentFunc returns the bodies of the posts and comments an author has
+// written since a given time.
+type RecentFunc func(ctx context.Context, authorID int64, since time.Time) ([]string, error)
+
+// Duplicate rejects content whose body repeats something the same author
+// wrote within Window, ignoring case, spacing and punctuation.
+type Duplicate struct {
+	Recent RecentFunc
+	Window time.Duration
+}
+
+func (d Duplicate) Check(ctx context.Context, c Content) (Decision, error) {
+	body := Normalize(c.Body)
+	if body == "" {
+		return Decision{}, nil
+	}
+	recent, err := d.Recent(ctx, c.AuthorID, time.Now().Add(-d.Window))
+	if err != nil {
+		return Decision{}, err
+	}
+	for _, text := range recent {
+		if Normalize(text) == body {
+			return Decision{Reject, "duplicate", "repeats something you posted recently"}, nil
+		}
+	}
+	return Decision{}, nil
+}
@@ -0,0 +1,95 @@
+// Package filter checks user-submitted content before it is published. Each
+// Filter looks at one aspect of the content and a Chain combines them into a
+// single verdict.
+package filter
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Verdict is the outcome of checking a piece of content. Higher verdicts are
+// stricter.
+type Verdict int
+
+const (
+	Allow  Verdict = iota // publish the content
+	Hold                  // save it hidden until a moderator reviews it
+	Reject                // refuse it
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Hold:
+		return "hold"
+	case Reject:
+		return "reject"
+	}
+	return "allow"
+}
+
+// Content is a post or comment about to be saved. Title is empty for
+// comments.
+type Content struct {
+	AuthorID   int64
+	AccountAge time.Duration
+	Title      string
+	Body       string
+}
+
+// Text returns the title and body together.
+func (c Content) Text() string {
+	if c.Title == "" {
+		return c.Body
+	}
+	return c.Title + "\n" + c.Body
+}
+
+// Decision is a verdict along with the filter that reached it and a reason
+// that can be shown to the author or a moderator.
+type Decision struct {
+	Verdict Verdict
+	Filter  string
+	Reason  string
+}
+
+// Filter is implemented by the individual checks.
+type Filter interface {
+	Check(ctx context.Context, c Content) (Decision, error)
+}
+
+// Chain runs each filter in order and returns the strictest decision,
+// stopping at the first rejection.
+type Chain []Filter
+
+func (ch Chain) Check(ctx context.Context, c Content) (Decision, error) {
+	var result Decision
+	for _, f := range ch {
+		d, err := f.Check(ctx, c)
+		if err != nil {
+			return Decision{}, err
+		}
+		if d.Verdict > result.Verdict {
+			result = d
+		}
+		if result.Verdict == Reject {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Tokens splits text into lower-case words, dropping punctuation.
+func Tokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// Normalize reduces text to its words separated by single spaces, so that
+// changes in case, spacing or punctuation don't make it look different.
+func Normalize(text string) string {
+	return strings.Join(Tokens(text), " ")
+}
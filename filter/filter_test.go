@@ -0,0 +1,247 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fixed is a filter that always reaches the same decision.
+type fixed Decision
+
+func (f fixed) Check(ctx context.Context, c Content) (Decision, error) {
+	return Decision(f), nil
+}
+
+// failing is a filter that always fails.
+type failing struct{}
+
+func (failing) Check(ctx context.Context, c Content) (Decision, error) {
+	return Decision{}, errors.New("filter failed")
+}
+
+func TestChainReturnsStrictestDecision(t *testing.T) {
+	ch := Chain{
+		fixed{Hold, "first", "held"},
+		fixed{},
+		fixed{Hold, "second", "also held"},
+	}
+	d, err := ch.Check(context.Background(), Content{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Verdict != Hold || d.Filter != "first" {
+		t.Errorf("decision = %+v, want the first hold", d)
+	}
+}
+
+func TestChainStopsAtRejection(t *testing.T) {
+	ch := Chain{fixed{Reject, "words", "rejected"}, failing{}}
+	d, err := ch.Check(context.Background(), Content{})
+	if err != nil {
+		t.Fatalf("filter after a rejection was run: %v", err)
+	}
+	if d.Verdict != Reject {
+		t.Errorf("verdict = %s, want reject", d.Verdict)
+	}
+}
+
+func TestChainReturnsErrors(t *testing.T) {
+	ch := Chain{fixed{Hold, "first", "held"}, failing{}}
+	if _, err := ch.Check(context.Background(), Content{}); err == nil {
+		t.Error("Check succeeded despite a failing filter")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if got := Normalize("  Buy NOW!!  cheap,\tpills... "); got != "buy now cheap pills" {
+		t.Errorf("Normalize = %q", got)
+	}
+}
+
+func TestWordList(t *testing.T) {
+	list := WordList{Reject: []string{"ass"}, Hold: []string{"free money"}}
+	tests := []struct {
+		text string
+		want Verdict
+	}{
+		{"Welcome to the class", Allow},
+		{"Don't be an ASS.", Reject},
+		{"Get FREE... money here", Hold},
+		{"free, and money", Allow},
+	}
+	for _, tt := range tests {
+		d, err := list.Check(context.Background(), Content{Body: tt.text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Verdict != tt.want {
+			t.Errorf("%q: verdict = %s, want %s", tt.text, d.Verdict, tt.want)
+		}
+	}
+}
+
+func TestWordListChecksTitle(t *testing.T) {
+	list := WordList{Reject: []string{"spam"}}
+	d, err := list.Check(context.Background(), Content{Title: "Spam", Body: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Verdict != Reject {
+		t.Errorf("verdict = %s, want reject", d.Verdict)
+	}
+}
+
+func TestLoadWordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	data := "# comment\n\nreject: Very Bad\nhold:  dubious!\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadWordList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Reject) != 1 || list.Reject[0] != "very bad" {
+		t.Errorf("Reject = %q", list.Reject)
+	}
+	if len(list.Hold) != 1 || list.Hold[0] != "dubious" {
+		t.Errorf("Hold = %q", list.Hold)
+	}
+}
+
+func TestLoadWordListErrors(t *testing.T) {
+	dir := t.TempDir()
+	if list, err := LoadWordList(filepath.Join(dir, "missing.txt")); err != nil || len(list.Reject)+len(list.Hold) != 0 {
+		t.Errorf("missing file: %+v, %v; want an empty list", list, err)
+	}
+	for _, line := range []string{"block: word", "reject:", "just a word"} {
+		path := filepath.Join(dir, "words.txt")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadWordList(path); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestLinkLimit(t *testing.T) {
+	l := LinkLimit{NewAccountAge: 24 * time.Hour, MaxLinks: 1}
+	body := "See https://a.example and www.b.example"
+	tests := []struct {
+		age  time.Duration
+		body string
+		want Verdict
+	}{
+		{time.Hour, body, Hold},
+		{time.Hour, "See https://a.example", Allow},
+		{48 * time.Hour, body, Allow},
+	}
+	for _, tt := range tests {
+		d, err := l.Check(context.Background(), Content{AccountAge: tt.age, Body: tt.body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Verdict != tt.want {
+			t.Errorf("age %s, %q: verdict = %s, want %s", tt.age, tt.body, d.Verdict, tt.want)
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	var since time.Time
+	d := Duplicate{
+		Window: time.Hour,
+		Recent: func(ctx context.Context, authorID int64, s time.Time) ([]string, error) {
+			since = s
+			return []string{"Hello, world!"}, nil
+		},
+	}
+	dec, err := d.Check(context.Background(), Content{AuthorID: 1, Body: "hello   WORLD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Verdict != Reject {
+		t.Errorf("repeated body: verdict = %s, want reject", dec.Verdict)
+	}
+	if ago := time.Since(since); ago < time.Hour || ago > time.Hour+time.Minute {
+		t.Errorf("looked back %s, want the window of 1h", ago)
+	}
+
+	dec, err = d.Check(context.Background(), Content{AuthorID: 1, Body: "hello there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Verdict != Allow {
+		t.Errorf("new body: verdict = %s, want allow", dec.Verdict)
+	}
+}
+
+// memoryStore is a TokenStore kept in memory.
+type memoryStore struct {
+	spam, ham int
+	counts    map[string]TokenCount
+}
+
+func (s *memoryStore) Documents(ctx context.Context) (int, int, error) {
+	return s.spam, s.ham, nil
+}
+
+func (s *memoryStore) Counts(ctx context.Context, tokens []string) (map[string]TokenCount, error) {
+	return s.counts, nil
+}
+
+func (s *memoryStore) Add(ctx context.Context, tokens []string, spam bool) error {
+	if s.counts == nil {
+		s.counts = map[string]TokenCount{}
+	}
+	if spam {
+		s.spam++
+	} else {
+		s.ham++
+	}
+	for _, token := range tokens {
+		c := s.counts[token]
+		if spam {
+			c.Spam++
+		} else {
+			c.Ham++
+		}
+		s.counts[token] = c
+	}
+	return nil
+}
+
+func TestClassifier(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{}
+	cl := Classifier{Store: store, HoldAt: 0.7, RejectAt: 0.95, MinDocuments: 3}
+
+	train := func(text string, spam bool) {
+		t.Helper()
+		if err := Train(ctx, store, text, spam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	train("cheap pills buy now", true)
+	train("buy cheap watches now", true)
+	if d, err := cl.Check(ctx, Content{Body: "buy cheap pills now"}); err != nil || d.Verdict != Allow {
+		t.Fatalf("undertrained classifier: %+v, %v; want allow", d, err)
+	}
+
+	train("cheap pills cheap pills", true)
+	train("when is the exam", false)
+	train("notes from the lecture", false)
+	train("is the lecture recorded", false)
+
+	if d, err := cl.Check(ctx, Content{Body: "Buy cheap pills now!"}); err != nil || d.Verdict == Allow {
+		t.Errorf("spam: %+v, %v; want it held or rejected", d, err)
+	}
+	if d, err := cl.Check(ctx, Content{Body: "When is the lecture?"}); err != nil || d.Verdict != Allow {
+		t.Errorf("ham: %+v, %v; want allow", d, err)
+	}
+}
@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+
+// LinkLimit holds content from accounts younger than NewAccountAge that
+// contains more than MaxLinks links, since link-heavy posts from brand new
+// accounts are the usual shape of spam.
+type LinkLimit struct {
+	NewAccountAge time.Duration
+	MaxLinks      int
+}
+
+func (l LinkLimit) Check(ctx context.Context, c Content) (Decision, error) {
+	if c.AccountAge >= l.NewAccountAge {
+		return Decision{}, nil
+	}
+	if n := len(linkPattern.FindAllStringIndex(c.Text(), -1)); n > l.MaxLinks {
+		return Decision{Hold, "links", fmt.Sprintf("%d links from an account under %s old", n, formatAge(l.NewAccountAge))}, nil
+	}
+	return Decision{}, nil
+}
+
+func formatAge(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		days := int(d / (24 * time.Hour))
+		if days == 1 {
+			return "1 day"
+		}
+		return fmt.Sprintf("%d days", days)
+	}
+	return d.String()
+}
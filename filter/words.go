@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WordList rejects or holds content containing listed words or phrases.
+// Matching ignores case and punctuation and only matches whole words, so
+// "ass" does not match "class".
+type WordList struct {
+	Reject []string
+	Hold   []string
+}
+
+// LoadWordList reads a word list file. Each line is "reject: <phrase>" or
+// "hold: <phrase>"; blank lines and lines starting with # are ignored. A
+// missing file gives an empty list.
+func LoadWordList(path string) (WordList, error) {
+	var list WordList
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return list, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, phrase, ok := strings.Cut(line, ":")
+		phrase = Normalize(phrase)
+		if !ok || phrase == "" {
+			return list, fmt.Errorf("%s:%d: expected \"reject: <phrase>\" or \"hold: <phrase>\"", path, n)
+		}
+		switch strings.TrimSpace(kind) {
+		case "reject":
+			list.Reject = append(list.Reject, phrase)
+		case "hold":
+			list.Hold = append(list.Hold, phrase)
+		default:
+			return list, fmt.Errorf("%s:%d: unknown list %q", path, n, kind)
+		}
+	}
+	return list, scanner.Err()
+}
+
+func (l WordList) Check(ctx context.Context, c Content) (Decision, error) {
+	text := " " + Normalize(c.Text()) + " "
+	if phrase, ok := findPhrase(text, l.Reject); ok {
+		return Decision{Reject, "words", fmt.Sprintf("contains the blocked phrase %q", phrase)}, nil
+	}
+	if phrase, ok := findPhrase(text, l.Hold); ok {
+		return Decision{Hold, "words", fmt.Sprintf("contains the flagged phrase %q", phrase)}, nil
+	}
+	return Decision{}, nil
+}
+
+// findPhrase looks for a normalized phrase in text, which must be normalized
+// and padded with spaces.
+func findPhrase(text string, phrases []string) (string, bool) {
+	for _, phrase := range phrases {
+		if strings.Contains(text, " "+Normalize(phrase)+" ") {
+			return phrase, true
+		}
+	}
+	return "", false
+}
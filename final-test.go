@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"university-forum/server"
 )
 
 func serveLogin(w http.ResponseWriter, r *http.Request) {
@@ -34,5 +35,7 @@ func main() {
 	http.HandleFunc("/login", serveLogin)
 
 	fmt.Println("Server starting on port 6000...")
-	log.Fatal(http.ListenAndServe(":6000", nil))
+	if err := server.ListenAndServe(":6000", nil); err != nil {
+		log.Fatal(err)
+	}
 }
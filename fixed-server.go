@@ -6,6 +6,8 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"university-forum/config"
+	"university-forum/server"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -13,14 +15,17 @@ import (
 )
 
 var (
-	dbFixed    *sql.DB
-	storeFixed *sessions.CookieStore
+	dbFixed     *sql.DB
+	storeFixed  *sessions.CookieStore
+	configFixed *config.Config
 )
 
 func init() {
+	configFixed = config.FromCommandLine()
+
 	var err error
 	// Initialize database
-	dbFixed, err = sql.Open("sqlite3", "./forum.db")
+	dbFixed, err = sql.Open("sqlite3", configFixed.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -28,7 +33,7 @@ func init() {
 	// Create tables
 	createFixedTables()
 
-	storeFixed = sessions.NewCookieStore([]byte("super-secret-key"))
+	storeFixed = sessions.NewCookieStore([]byte(configFixed.SessionKey))
 }
 
 func createFixedTables() {
@@ -183,8 +188,10 @@ func runFixedServer() {
 	r.HandleFunc("/login", loginFixedHandler).Methods("GET", "POST")
 	r.HandleFunc("/logout", logoutFixedHandler).Methods("GET")
 
-	fmt.Println("Fixed server starting on port 7000...")
-	log.Fatal(http.ListenAndServe(":7000", r))
+	fmt.Printf("Fixed server starting on %s...\n", configFixed.Addr)
+	if err := server.ListenAndServe(configFixed.Addr, r); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getFixedPosts() ([]PostFixed, error) {
@@ -193,11 +200,12 @@ func getFixedPosts() ([]PostFixed, error) {
 }
 
 type PostFixed struct {
-	ID         int64
-	Title      string
-	Content    string
-	AuthorName string
-	CreatedAt  string
+	ID          int64
+	Title       string
+	Content     string
+	AuthorName  string
+	CreatedAt   string
+	IsAnonymous bool
 }
 
 func main() {
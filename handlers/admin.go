@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// statsTTL is how long dashboard figures are reused before the aggregate
+	// queries are run again.
+	statsTTL     = 5 * time.Minute
+	trendDays    = 14
+	trendWeeks   = 12
+	activeWindow = 30 * 24 * time.Hour
+	leaderSize   = 10
+)
+
+// unansweredPost matches visible, non-announcement posts p that have no
+// visible reply from anyone other than their author.
+const unansweredPost = `p.is_hidden = 0 AND p.is_announcement = 0
+	AND NOT EXISTS (
+		SELECT 1 FROM comments c
+		WHERE c.post_id = p.id AND c.author_id != p.author_id AND c.is_hidden = 0
+	)`
+
+// Totals counts everything on the site, along with how much of it was added
+// in the last week.
+type Totals struct {
+	Users, Posts, Comments, Courses int
+	NewUsers, NewPosts, NewComments int
+}
+
+// TrendPoint is the number of users, posts and comments created in one day
+// or week.
+type TrendPoint struct {
+	Label                  string
+	Users, Posts, Comments int
+}
+
+// Trend is a series of TrendPoints, oldest first.
+type Trend struct {
+	Points []TrendPoint
+	Max    int
+}
+
+// Percent scales n against the busiest value in the trend for drawing bars.
+func (t Trend) Percent(n int) int {
+	if t.Max == 0 {
+		return 0
+	}
+	return n * 100 / t.Max
+}
+
+// ActiveCourse is a category ranked by recent activity.
+type ActiveCourse struct {
+	Name, Slug      string
+	Posts, Comments int
+	Unanswered      int
+}
+
+// ActiveUser is a member ranked by recent activity.
+type ActiveUser struct {
+	Username        string
+	Posts, Comments int
+}
+
+// Unanswered counts posts still waiting for a reply.
+type Unanswered struct {
+	Total, LastWeek, OlderThanWeek int
+}
+
+// StorageUsage is the space taken by uploads and the database itself.
+// Attachment sizes are the original uploads and exclude thumbnails.
+type StorageUsage struct {
+	Attachments                           int
+	PostBytes, CommentBytes, MessageBytes int64
+	Avatars                               int
+	DatabaseBytes                         int64
+}
+
+func (s StorageUsage) AttachmentLabel() string {
+	return byteSize(s.PostBytes + s.CommentBytes + s.MessageBytes)
+}
+func (s StorageUsage) PostLabel() string     { return byteSize(s.PostBytes) }
+func (s StorageUsage) CommentLabel() string  { return byteSize(s.CommentBytes) }
+func (s StorageUsage) MessageLabel() string  { return byteSize(s.MessageBytes) }
+func (s StorageUsage) DatabaseLabel() string { return byteSize(s.DatabaseBytes) }
+
+// SiteStats is everything shown on the admin dashboard.
+type SiteStats struct {
+	Totals     Totals
+	Daily      Trend
+	Weekly     Trend
+	Courses    []ActiveCourse
+	Users      []ActiveUser
+	Unanswered Unanswered
+	Storage    StorageUsage
+	ComputedAt time.Time
+}
+
+// siteStats caches the dashboard so that loading it does not scan every
+// table on each request. The lock is held while computing so concurrent
+// requests after expiry wait for one computation instead of each running it.
+var siteStats struct {
+	sync.Mutex
+	stats *SiteStats
+}
+
+// cachedSiteStats returns the dashboard figures, recomputing them when they
+// are older than statsTTL or refresh is set.
+func cachedSiteStats(refresh bool) (*SiteStats, error) {
+	siteStats.Lock()
+	defer siteStats.Unlock()
+	if !refresh && siteStats.stats != nil && time.Since(siteStats.stats.ComputedAt) < statsTTL {
+		return siteStats.stats, nil
+	}
+	stats, err := computeSiteStats(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	siteStats.stats = stats
+	return stats, nil
+}
+
+func computeSiteStats(now time.Time) (*SiteStats, error) {
+	stats := &SiteStats{ComputedAt: now}
+	week := sql.Named("week", now.Add(-7*24*time.Hour).UTC().Format(sqliteTime))
+
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM users),
+			(SELECT COUNT(*) FROM posts),
+			(SELECT COUNT(*) FROM comments),
+			(SELECT COUNT(*) FROM categories),
+			(SELECT COUNT(*) FROM users WHERE created_at >= @week),
+			(SELECT COUNT(*) FROM posts WHERE created_at >= @week),
+			(SELECT COUNT(*) FROM comments WHERE created_at >= @week)
+	`, week).Scan(&stats.Totals.Users, &stats.Totals.Posts, &stats.Totals.Comments, &stats.Totals.Courses,
+		&stats.Totals.NewUsers, &stats.Totals.NewPosts, &stats.Totals.NewComments)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.Daily, err = dailyTrend(now); err != nil {
+		return nil, err
+	}
+	if stats.Weekly, err = weeklyTrend(now); err != nil {
+		return nil, err
+	}
+	if stats.Courses, err = activeCourses(now.Add(-activeWindow)); err != nil {
+		return nil, err
+	}
+	if stats.Users, err = activeUsers(now.Add(-activeWindow)); err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(p.created_at >= @week), 0)
+		FROM posts p
+		WHERE `+unansweredPost, week).Scan(&stats.Unanswered.Total, &stats.Unanswered.LastWeek)
+	if err != nil {
+		return nil, err
+	}
+	stats.Unanswered.OlderThanWeek = stats.Unanswered.Total - stats.Unanswered.LastWeek
+
+	if stats.Storage, err = storageUsage(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// trendTables are the tables counted in each TrendPoint.
+var trendTables = []string{"users", "posts", "comments"}
+
+// countByBucket counts rows in each table created since the cutoff, grouped
+// by the SQL date expression bucket applied to created_at.
+func countByBucket(bucket string, since time.Time) (map[string][3]int, error) {
+	counts := make(map[string][3]int)
+	for i, table := range trendTables {
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT %s AS bucket, COUNT(*)
+			FROM %s
+			WHERE created_at >= ?
+			GROUP BY bucket
+		`, bucket, table), since.UTC().Format(sqliteTime))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			var n int
+			if err := rows.Scan(&key, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			c := counts[key]
+			c[i] = n
+			counts[key] = c
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// buildTrend lays counts out over consecutive buckets starting at first,
+// filling in the ones with no activity.
+func buildTrend(counts map[string][3]int, first time.Time, n int, step func(time.Time) time.Time) Trend {
+	var trend Trend
+	for day, i := first, 0; i < n; day, i = step(day), i+1 {
+		c := counts[day.Format("2006-01-02")]
+		trend.Points = append(trend.Points, TrendPoint{
+			Label:    day.Format("Jan 2"),
+			Users:    c[0],
+			Posts:    c[1],
+			Comments: c[2],
+		})
+		for _, v := range c {
+			if v > trend.Max {
+				trend.Max = v
+			}
+		}
+	}
+	return trend
+}
+
+func dailyTrend(now time.Time) (Trend, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, 1-trendDays)
+	counts, err := countByBucket("date(created_at)", first)
+	if err != nil {
+		return Trend{}, err
+	}
+	return buildTrend(counts, first, trendDays, func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }), nil
+}
+
+// weeklyTrend groups by the Monday starting each week.
+func weeklyTrend(now time.Time) (Trend, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	first := monday.AddDate(0, 0, -7*(trendWeeks-1))
+	counts, err := countByBucket("date(created_at, 'weekday 0', '-6 days')", first)
+	if err != nil {
+		return Trend{}, err
+	}
+	return buildTrend(counts, first, trendWeeks, func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }), nil
+}
+
+func activeCourses(since time.Time) ([]ActiveCourse, error) {
+	rows, err := db.Query(`
+		SELECT name, slug, posts, comments, unanswered FROM (
+			SELECT cat.name, cat.slug,
+				(SELECT COUNT(*) FROM posts p
+				 WHERE p.category_id = cat.id AND p.created_at >= @since) AS posts,
+				(SELECT COUNT(*) FROM comments m JOIN posts p ON p.id = m.post_id
+				 WHERE p.category_id = cat.id AND m.created_at >= @since) AS comments,
+				(SELECT COUNT(*) FROM posts p
+				 WHERE p.category_id = cat.id AND `+unansweredPost+`) AS unanswered
+			FROM categories cat
+		)
+		WHERE posts + comments > 0
+		ORDER BY posts + comments DESC, name
+		LIMIT @limit
+	`, sql.Named("since", since.UTC().Format(sqliteTime)), sql.Named("limit", leaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var courses []ActiveCourse
+	for rows.Next() {
+		var c ActiveCourse
+		if err := rows.Scan(&c.Name, &c.Slug, &c.Posts, &c.Comments, &c.Unanswered); err != nil {
+			return nil, err
+		}
+		courses = append(courses, c)
+	}
+	return courses, rows.Err()
+}
+
+func activeUsers(since time.Time) ([]ActiveUser, error) {
+	rows, err := db.Query(`
+		SELECT u.username, COALESCE(p.n, 0), COALESCE(c.n, 0)
+		FROM users u
+		LEFT JOIN (
+			SELECT author_id, COUNT(*) AS n FROM posts
+			WHERE created_at >= @since GROUP BY author_id
+		) p ON p.author_id = u.id
+		LEFT JOIN (
+			SELECT author_id, COUNT(*) AS n FROM comments
+			WHERE created_at >= @since GROUP BY author_id
+		) c ON c.author_id = u.id
+		WHERE p.n IS NOT NULL OR c.n IS NOT NULL
+		ORDER BY COALESCE(p.n, 0) + COALESCE(c.n, 0) DESC, u.username
+		LIMIT @limit
+	`, sql.Named("since", since.UTC().Format(sqliteTime)), sql.Named("limit", leaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []ActiveUser
+	for rows.Next() {
+		var u ActiveUser
+		if err := rows.Scan(&u.Username, &u.Posts, &u.Comments); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func storageUsage() (StorageUsage, error) {
+	var s StorageUsage
+	err := db.QueryRow(`
+		SELECT COUNT(*),
+			COALESCE(SUM(CASE WHEN post_id IS NOT NULL THEN size END), 0),
+			COALESCE(SUM(CASE WHEN comment_id IS NOT NULL THEN size END), 0),
+			COALESCE(SUM(CASE WHEN message_id IS NOT NULL THEN size END), 0)
+		FROM attachments
+	`).Scan(&s.Attachments, &s.PostBytes, &s.CommentBytes, &s.MessageBytes)
+	if err != nil {
+		return s, err
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_profiles WHERE avatar_key IS NOT NULL").Scan(&s.Avatars); err != nil {
+		return s, err
+	}
+	var pages, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return s, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return s, err
+	}
+	s.DatabaseBytes = pages * pageSize
+	return s, nil
+}
+
+// AdminPage is the admin dashboard.
+type AdminPage struct {
+	Page
+	Stats      *SiteStats
+	ComputedAt string
+	ActiveDays int
+}
+
+// AdminDashboardHandler shows site-wide totals, trends and storage usage to
+// admins. Figures are cached for statsTTL; ?refresh=1 recomputes them.
+func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) error {
+	_, role := currentUser(r)
+	if role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can view the dashboard")
+	}
+
+	stats, err := cachedSiteStats(r.URL.Query().Get("refresh") != "")
+	if err != nil {
+		return internalError(err, "Error computing site statistics")
+	}
+
+	return templates.ExecuteTemplate(w, "admin.html", AdminPage{
+		Page:       newPage(w, r, "admin", "Dashboard"),
+		Stats:      stats,
+		ComputedAt: stats.ComputedAt.UTC().Format("Jan 2, 2006 15:04 UTC"),
+		ActiveDays: int(activeWindow / (24 * time.Hour)),
+	})
+}
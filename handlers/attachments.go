@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"university-forum/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxUploadFiles   = 5
+	maxUploadSize    = 10 << 20 // per file
+	maxRequestSize   = maxUploadFiles*maxUploadSize + 1<<20
+	thumbnailMaxSize = 320
+)
+
+// allowedUploadTypes maps sniffed content types to whether they are images.
+// Code and other text files sniff as text/plain.
+var allowedUploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"application/pdf": false,
+	"text/plain":      false,
+}
+
+var blobs storage.BlobStore
+
+// InitStorage sets the blob store attachments are written to.
+func InitStorage(store storage.BlobStore) {
+	blobs = store
+}
+
+// Attachment is a file uploaded with a post or comment.
+type Attachment struct {
+	ID           int64
+	Filename     string
+	ContentType  string
+	Size         int64
+	HasThumbnail bool
+}
+
+func (a Attachment) IsImage() bool {
+	return allowedUploadTypes[a.ContentType]
+}
+
+// SizeLabel formats the attachment size for display.
+func (a Attachment) SizeLabel() string {
+	return byteSize(a.Size)
+}
+
+// byteSize formats a number of bytes for display.
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// uploadError is a problem with the uploaded files that should be reported
+// to the user rather than treated as a server error.
+type uploadError struct {
+	msg string
+}
+
+func (e uploadError) Error() string { return e.msg }
+
+// uploadFailure returns the error for a failed upload, showing the user
+// what was wrong with their files where that is the cause.
+func uploadFailure(err error, fallback string) error {
+	var uerr uploadError
+	if errors.As(err, &uerr) {
+		return newError(http.StatusBadRequest, uerr.msg)
+	}
+	return internalError(err, fallback)
+}
+
+// failUpload records an upload problem against the attachments field of a
+// form that is about to be shown again. Any other error is returned as a
+// server error.
+func failUpload(err error, form *Form, fallback string) error {
+	var uerr uploadError
+	if errors.As(err, &uerr) {
+		form.Fail("attachments", uerr.msg)
+		return nil
+	}
+	return internalError(err, fallback)
+}
+
+// attachmentOwner identifies what an upload is attached to. Exactly one of
+// the IDs is set.
+type attachmentOwner struct {
+	PostID    int64
+	CommentID int64
+	MessageID int64
+}
+
+// limitUploads caps the request body before the multipart form is parsed.
+func limitUploads(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err == http.ErrNotMultipart {
+		return nil
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return uploadError{fmt.Sprintf("Uploads are limited to %d MB in total", maxRequestSize>>20)}
+	}
+	return err
+}
+
+// removeUploads deletes the temporary files a parsed multipart form keeps on
+// disk. The server only cleans up the form of the request it created, not of
+// the copies middleware makes with WithContext, so every handler that parses
+// uploads defers it.
+func removeUploads(r *http.Request) {
+	if r.MultipartForm != nil {
+		r.MultipartForm.RemoveAll()
+	}
+}
+
+// saveAttachments validates the files uploaded in the "attachments" field,
+// writes them to blob storage and records them in tx. On error, any blobs
+// already written are removed again.
+func saveAttachments(ctx context.Context, tx *sql.Tx, r *http.Request, owner attachmentOwner, uploaderID int64) error {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["attachments"]) == 0 {
+		return nil
+	}
+	files := r.MultipartForm.File["attachments"]
+	if len(files) > maxUploadFiles {
+		return uploadError{fmt.Sprintf("You can attach at most %d files", maxUploadFiles)}
+	}
+
+	var written []string
+	cleanup := func() {
+		for _, key := range written {
+			blobs.Delete(context.Background(), key)
+		}
+	}
+
+	for _, fh := range files {
+		if fh.Size > maxUploadSize {
+			cleanup()
+			return uploadError{fmt.Sprintf("%s is larger than %d MB", fh.Filename, maxUploadSize>>20)}
+		}
+
+		keys, err := saveAttachment(ctx, tx, fh, owner, uploaderID)
+		written = append(written, keys...)
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+	return nil
+}
+
+func saveAttachment(ctx context.Context, tx *sql.Tx, fh *multipart.FileHeader, owner attachmentOwner, uploaderID int64) ([]string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Trust the content, not the client-supplied type or extension.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	contentType := strings.TrimSpace(strings.Split(http.DetectContentType(head[:n]), ";")[0])
+	isImage, ok := allowedUploadTypes[contentType]
+	if !ok {
+		return nil, uploadError{fmt.Sprintf("%s is not an allowed file type (images, PDFs and text files only)", fh.Filename)}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	key, err := newBlobKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := blobs.Put(ctx, key, f, fh.Size, contentType); err != nil {
+		return nil, err
+	}
+	keys := []string{key}
+
+	var thumbKey, thumbType sql.NullString
+	if isImage {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return keys, err
+		}
+		// A picture we can't decode is still a valid attachment; it just
+		// won't get a preview.
+		if thumb, typ, err := storage.Thumbnail(f, thumbnailMaxSize); err == nil {
+			thumbKey = sql.NullString{String: key + "-thumb", Valid: true}
+			thumbType = sql.NullString{String: typ, Valid: true}
+			err := blobs.Put(ctx, thumbKey.String, bytes.NewReader(thumb), int64(len(thumb)), typ)
+			if err != nil {
+				return keys, err
+			}
+			keys = append(keys, thumbKey.String)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO attachments (post_id, comment_id, message_id, uploader_id, storage_key, thumbnail_key, thumbnail_type,
+			filename, content_type, size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, nullID(owner.PostID), nullID(owner.CommentID), nullID(owner.MessageID), uploaderID, key, thumbKey, thumbType,
+		filepath.Base(fh.Filename), contentType, fh.Size)
+	return keys, err
+}
+
+func newBlobKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b)
+	return "attachments/" + name[:2] + "/" + name, nil
+}
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// attachmentsFor loads the attachments of a post, comment or message.
+func attachmentsFor(owner attachmentOwner) ([]Attachment, error) {
+	rows, err := queryPrepared(context.Background(), `
+		SELECT id, filename, content_type, size, thumbnail_key IS NOT NULL
+		FROM attachments
+		WHERE (post_id = ? AND comment_id IS NULL) OR comment_id = ? OR message_id = ?
+		ORDER BY id
+	`, owner.PostID, owner.CommentID, owner.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Filename, &a.ContentType, &a.Size, &a.HasThumbnail); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// canViewPost reports whether the viewer may see a post and therefore its
+// attachments. Posts are public unless hidden, when only moderators and the
+// author can see them.
+func canViewPost(postID, viewerID int64, role string) bool {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM posts WHERE id = ? AND (is_hidden = 0 OR ? OR author_id = ?))",
+		postID, IsModerator(role), viewerID).Scan(&exists)
+	return err == nil && exists
+}
+
+// canViewAttachment reports whether the viewer may see an attachment on a
+// post or, when conversationID is set, on a direct message.
+func canViewAttachment(postID, conversationID, viewerID int64, role string) bool {
+	if conversationID != 0 {
+		access, err := conversationAccessFor(conversationID, viewerID, role)
+		return err == nil && access != noAccess
+	}
+	return canViewPost(postID, viewerID, role)
+}
+
+// AttachmentHandler serves an attachment to viewers who can see the post or
+// conversation it belongs to.
+func AttachmentHandler(w http.ResponseWriter, r *http.Request) error {
+	return serveAttachment(w, r, false)
+}
+
+// AttachmentThumbnailHandler serves the thumbnail of an image attachment.
+func AttachmentThumbnailHandler(w http.ResponseWriter, r *http.Request) error {
+	return serveAttachment(w, r, true)
+}
+
+func serveAttachment(w http.ResponseWriter, r *http.Request, thumbnail bool) error {
+	viewerID, role := currentUser(r)
+
+	attachmentID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid attachment ID")
+	}
+
+	var a Attachment
+	var postID, conversationID int64
+	var commentHidden bool
+	var commentAuthorID int64
+	var key string
+	var thumbKey, thumbType sql.NullString
+	err = db.QueryRowContext(r.Context(), `
+		SELECT a.id, a.filename, a.content_type, a.size, a.storage_key, a.thumbnail_key, a.thumbnail_type,
+			COALESCE(a.post_id, c.post_id, 0), COALESCE(m.conversation_id, 0), COALESCE(c.is_hidden, 0),
+			COALESCE(c.author_id, 0)
+		FROM attachments a
+		LEFT JOIN comments c ON a.comment_id = c.id
+		LEFT JOIN messages m ON a.message_id = m.id
+		WHERE a.id = ?
+	`, attachmentID).Scan(&a.ID, &a.Filename, &a.ContentType, &a.Size, &key, &thumbKey, &thumbType, &postID, &conversationID,
+		&commentHidden, &commentAuthorID)
+	hiddenFromViewer := commentHidden && !IsModerator(role) && commentAuthorID != viewerID
+	if err != nil || hiddenFromViewer || !canViewAttachment(postID, conversationID, viewerID, role) {
+		return newError(http.StatusNotFound, "Attachment not found")
+	}
+
+	contentType := a.ContentType
+	if thumbnail {
+		if !thumbKey.Valid {
+			return newError(http.StatusNotFound, "Attachment not found")
+		}
+		key, contentType = thumbKey.String, thumbType.String
+	}
+
+	body, err := blobs.Get(r.Context(), key)
+	if err == storage.ErrNotFound {
+		return newError(http.StatusNotFound, "Attachment not found")
+	}
+	if err != nil {
+		return internalError(err, "Error reading attachment")
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if a.IsImage() || a.ContentType == "application/pdf" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if !thumbnail {
+		w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	}
+	io.Copy(w, body)
+	return nil
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUploadTempFilesRemoved(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	// Files too large to keep in memory are spooled to the temporary
+	// directory while the form is parsed.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Lecture notes")
+	mw.WriteField("content", "Attached")
+	part, err := mw.CreateFormFile("attachments", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(strings.Repeat("notes ", (maxUploadSize+1<<20)/6)))
+	mw.Close()
+
+	e.do(Handler(CreatePostHandler), request{
+		method:      http.MethodPost,
+		target:      "/create-post",
+		user:        author,
+		body:        &body,
+		contentType: mw.FormDataContentType(),
+	})
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("temporary file %s left behind", entry.Name())
+	}
+}
+
+func TestThumbnailServedWithItsOwnType(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	encoders := map[string]func(io.Writer) error{
+		"photo.jpg":   func(w io.Writer) error { return jpeg.Encode(w, img, nil) },
+		"diagram.png": func(w io.Writer) error { return png.Encode(w, img) },
+		"anim.gif":    func(w io.Writer) error { return gif.Encode(w, img, nil) },
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Pictures")
+	mw.WriteField("content", "Attached")
+	for name, encode := range encoders {
+		part, err := mw.CreateFormFile("attachments", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encode(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mw.Close()
+	w := e.do(Handler(CreatePostHandler), request{method: http.MethodPost, target: "/create-post", user: author,
+		body: &body, contentType: mw.FormDataContentType()})
+	wantStatus(t, w, http.StatusSeeOther)
+
+	rows, err := db.Query("SELECT id, filename, thumbnail_type FROM attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for ; rows.Next(); n++ {
+		var id int64
+		var filename, thumbType string
+		if err := rows.Scan(&id, &filename, &thumbType); err != nil {
+			t.Fatal(err)
+		}
+		attachment := strconv.FormatInt(id, 10)
+		w := e.do(Handler(AttachmentThumbnailHandler), request{method: http.MethodGet,
+			target: "/attachments/" + attachment + "/thumb", vars: map[string]string{"id": attachment}, user: author})
+		wantStatus(t, w, http.StatusOK)
+		got := w.Header().Get("Content-Type")
+		if sniffed := http.DetectContentType(w.Body.Bytes()); got != thumbType || got != sniffed {
+			t.Errorf("%s: thumbnail served as %s, stored as %s, but is %s", filename, got, thumbType, sniffed)
+		}
+	}
+	if n != len(encoders) {
+		t.Errorf("%d attachments saved, want %d", n, len(encoders))
+	}
+}
+
+func TestThumbnailTypeBackfilled(t *testing.T) {
+	all := migrations
+	t.Cleanup(func() { migrations = all })
+
+	database := openBaseDB(t, t.TempDir())
+	migrations = all[:50]
+	if err := Migrate(database.Write); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"INSERT INTO users (username, email, password_hash) VALUES ('alice', 'alice@example.edu', '!')",
+		"INSERT INTO posts (title, content, author_id) VALUES ('Pictures', 'Body', 1)",
+		`INSERT INTO attachments (post_id, uploader_id, storage_key, thumbnail_key, filename, content_type, size) VALUES
+			(1, 1, 'a', 'a-thumb', 'photo.jpg', 'image/jpeg', 1),
+			(1, 1, 'b', 'b-thumb', 'anim.gif', 'image/gif', 1),
+			(1, 1, 'c', NULL, 'notes.txt', 'text/plain', 1)`,
+	} {
+		if _, err := database.Write.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	migrations = all
+	if err := Migrate(database.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"photo.jpg": "image/jpeg", "anim.gif": "image/png", "notes.txt": ""}
+	for filename, thumbType := range want {
+		var got string
+		err := database.Read.QueryRow("SELECT COALESCE(thumbnail_type, '') FROM attachments WHERE filename = ?", filename).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != thumbType {
+			t.Errorf("%s: thumbnail type %q, want %q", filename, got, thumbType)
+		}
+	}
+}
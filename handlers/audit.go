@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audited actions that are not moderation actions on reported content.
+// Moderation and sanction actions are logged under the same names as in
+// moderation_actions.
+const (
+	ActionPin              = "pin"
+	ActionUnpin            = "unpin"
+	ActionLock             = "lock"
+	ActionUnlock           = "unlock"
+	ActionAnnounce         = "announce"
+	ActionUnannounce       = "unannounce"
+	ActionEndorse          = "endorse"
+	ActionUnendorse        = "unendorse"
+	ActionChangeRole       = "change-role"
+	ActionCreateCategory   = "create-category"
+	ActionRenameTag        = "rename-tag"
+	ActionReadConversation = "read-conversation"
+)
+
+// Kinds of record an audit entry can be about, stored in
+// audit_log.target_type.
+const (
+	TargetPost         = "post"
+	TargetComment      = "comment"
+	TargetUser         = "user"
+	TargetSanction     = "sanction"
+	TargetAppeal       = "appeal"
+	TargetCategory     = "category"
+	TargetTag          = "tag"
+	TargetConversation = "conversation"
+)
+
+const auditPageSize = 50
+
+// auditTable describes how to snapshot one kind of target: the columns
+// captured and an expression for the user the record concerns, if any.
+type auditTable struct {
+	table   string
+	owner   string
+	columns []string
+}
+
+var auditTables = map[string]auditTable{
+	TargetPost: {"posts", "author_id", []string{"title", "content", "author_id", "category_id", "is_anonymous",
+		"is_hidden", "is_locked", "pin_scope", "is_announcement", "endorsed_by"}},
+	TargetComment: {"comments", "author_id", []string{"content", "post_id", "author_id", "is_anonymous",
+		"is_hidden", "endorsed_by"}},
+	TargetUser: {"users", "id", []string{"username", "role"}},
+	TargetSanction: {"user_sanctions", "user_id", []string{"user_id", "kind", "reason", "expires_at",
+		"lifted_by", "lifted_at", "lift_reason"}},
+	TargetAppeal: {"sanction_appeals", "(SELECT user_id FROM user_sanctions WHERE id = sanction_id)",
+		[]string{"sanction_id", "message", "status", "response", "reviewed_by"}},
+	TargetCategory:     {"categories", "NULL", []string{"name", "slug", "description"}},
+	TargetTag:          {"tags", "NULL", []string{"name"}},
+	TargetConversation: {"conversations", "NULL", []string{"subject", "created_by"}},
+}
+
+// auditTarget identifies the record an audited action changed.
+type auditTarget struct {
+	Type string
+	ID   int64
+}
+
+func (c reportedContent) auditTarget() auditTarget {
+	if c.CommentID != 0 {
+		return auditTarget{TargetComment, c.CommentID}
+	}
+	return auditTarget{TargetPost, c.PostID}
+}
+
+// snapshot returns the audited columns of target as JSON, along with the
+// user the record concerns. The snapshot is NULL when the record does not
+// exist.
+func snapshot(tx *sql.Tx, target auditTarget) (sql.NullString, sql.NullInt64, error) {
+	var owner sql.NullInt64
+	t, ok := auditTables[target.Type]
+	if !ok {
+		return sql.NullString{}, owner, fmt.Errorf("audit: unknown target type %q", target.Type)
+	}
+
+	values := make([]interface{}, len(t.columns))
+	dest := []interface{}{&owner}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	err := tx.QueryRow("SELECT "+t.owner+", "+strings.Join(t.columns, ", ")+" FROM "+t.table+" WHERE id = ?",
+		target.ID).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return sql.NullString{}, owner, nil
+	}
+	if err != nil {
+		return sql.NullString{}, owner, err
+	}
+
+	record := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		record[t.columns[i]] = value
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return sql.NullString{}, owner, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, owner, nil
+}
+
+// audited applies change in tx and appends it to the audit log with
+// snapshots of target taken before and after.
+func audited(tx *sql.Tx, actorID int64, action string, target auditTarget, reason string, change func() error) error {
+	before, owner, err := snapshot(tx, target)
+	if err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	after, afterOwner, err := snapshot(tx, target)
+	if err != nil {
+		return err
+	}
+	if !owner.Valid {
+		owner = afterOwner
+	}
+	return appendAudit(tx, actorID, action, target, owner, before, after, reason)
+}
+
+// auditedUpdate runs a single update statement in its own transaction and
+// records it in the audit log.
+func auditedUpdate(actorID int64, action string, target auditTarget, query string, args ...interface{}) error {
+	tx, err := writeDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, actorID, action, target, "", func() error {
+		_, err := tx.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// auditCreated appends the creation of target, which must already exist in
+// tx, to the audit log.
+func auditCreated(tx *sql.Tx, actorID int64, action string, target auditTarget, reason string) error {
+	after, owner, err := snapshot(tx, target)
+	if err != nil {
+		return err
+	}
+	return appendAudit(tx, actorID, action, target, owner, sql.NullString{}, after, reason)
+}
+
+func appendAudit(tx *sql.Tx, actorID int64, action string, target auditTarget, owner sql.NullInt64, before, after sql.NullString, reason string) error {
+	_, err := tx.Exec(`
+		INSERT INTO audit_log (actor_id, action, target_type, target_id, target_user_id, before, after, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, actorID, action, target.Type, target.ID, owner, before, after, reason)
+	return err
+}
+
+// AuditEntry is a row of the audit log. Before and After are JSON snapshots
+// of the target, empty when it did not exist.
+type AuditEntry struct {
+	ID         int64
+	CreatedAt  string
+	ActorName  string
+	Action     string
+	TargetType string
+	TargetID   int64
+	TargetUser string
+	Reason     string
+	Before     string
+	After      string
+}
+
+// auditFilter narrows the audit log by the query parameters of the admin
+// page: actor and user are usernames, from and to are YYYY-MM-DD dates.
+type auditFilter struct {
+	Actor  string
+	Action string
+	Type   string
+	User   string
+	From   string
+	To     string
+}
+
+func auditFilterFrom(query url.Values) auditFilter {
+	f := auditFilter{
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Action: query.Get("action"),
+		Type:   query.Get("type"),
+		User:   strings.TrimSpace(query.Get("user")),
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+	}
+	// Ignore malformed dates rather than comparing them as strings.
+	if _, err := time.Parse("2006-01-02", f.From); err != nil {
+		f.From = ""
+	}
+	if _, err := time.Parse("2006-01-02", f.To); err != nil {
+		f.To = ""
+	}
+	return f
+}
+
+// clause returns the FROM/WHERE clause for the filtered log, with the actor
+// joined as actor and the target user as target.
+func (f auditFilter) clause() (string, []interface{}) {
+	return `
+		FROM audit_log l
+		JOIN users actor ON l.actor_id = actor.id
+		LEFT JOIN users target ON l.target_user_id = target.id
+		WHERE (@actor = '' OR actor.username = @actor)
+			AND (@action = '' OR l.action = @action)
+			AND (@type = '' OR l.target_type = @type)
+			AND (@user = '' OR target.username = @user)
+			AND (@from = '' OR l.created_at >= @from)
+			AND (@to = '' OR l.created_at < date(@to, '+1 day'))
+	`, []interface{}{sql.Named("actor", f.Actor), sql.Named("action", f.Action), sql.Named("type", f.Type),
+		sql.Named("user", f.User), sql.Named("from", f.From), sql.Named("to", f.To)}
+}
+
+// listAudit returns the matching entries, newest first. A negative limit
+// returns them all.
+func listAudit(f auditFilter, limit, offset int) ([]AuditEntry, error) {
+	clause, args := f.clause()
+	rows, err := db.Query(`
+		SELECT l.id, l.created_at, actor.username, l.action, l.target_type, l.target_id,
+			COALESCE(target.username, ''), l.reason, COALESCE(l.before, ''), COALESCE(l.after, '')
+		`+clause+`
+		ORDER BY l.id DESC
+		LIMIT @limit OFFSET @offset
+	`, append(args, sql.Named("limit", limit), sql.Named("offset", offset))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorName, &e.Action, &e.TargetType, &e.TargetID,
+			&e.TargetUser, &e.Reason, &e.Before, &e.After)
+		if err != nil {
+			return nil, err
+		}
+		e.CreatedAt = formatDate(e.CreatedAt, sqliteTime)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func auditActions() ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT action FROM audit_log ORDER BY action")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []string
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// AuditPage is one page of the filtered audit log.
+type AuditPage struct {
+	Page
+	Entries     []AuditEntry
+	Filter      auditFilter
+	Actions     []string
+	TargetTypes []string
+	Pagination  Pagination
+	Query       template.URL
+}
+
+// AuditLogHandler lets admins browse and filter the audit log.
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) error {
+	_, role := currentUser(r)
+	if role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can view the audit log")
+	}
+
+	filter := auditFilterFrom(r.URL.Query())
+	clause, args := filter.clause()
+	var total int
+	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) "+clause, args...).Scan(&total); err != nil {
+		return internalError(err, "Error fetching audit log")
+	}
+	page := pageParam(r)
+	entries, err := listAudit(filter, auditPageSize, (page-1)*auditPageSize)
+	if err != nil {
+		return internalError(err, "Error fetching audit log")
+	}
+	actions, err := auditActions()
+	if err != nil {
+		return internalError(err, "Error fetching audit log")
+	}
+
+	// Links to other pages and exports keep the filters but not the page.
+	query := r.URL.Query()
+	query.Del("page")
+
+	return templates.ExecuteTemplate(w, "audit.html", AuditPage{
+		Page:        newPage(w, r, "audit", "Audit Log"),
+		Entries:     entries,
+		Filter:      filter,
+		Actions:     actions,
+		TargetTypes: auditTargetTypes(),
+		Pagination:  newPagination(page, total, auditPageSize),
+		Query:       template.URL(query.Encode()),
+	})
+}
+
+func auditTargetTypes() []string {
+	return []string{TargetPost, TargetComment, TargetUser, TargetSanction, TargetAppeal, TargetCategory,
+		TargetTag, TargetConversation}
+}
+
+// AuditExportHandler downloads the filtered audit log as CSV, or as JSON
+// with ?format=json.
+func AuditExportHandler(w http.ResponseWriter, r *http.Request) error {
+	_, role := currentUser(r)
+	if role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can export the audit log")
+	}
+
+	entries, err := listAudit(auditFilterFrom(r.URL.Query()), -1, 0)
+	if err != nil {
+		return internalError(err, "Error fetching audit log")
+	}
+
+	filename := "audit-log-" + time.Now().Format("2006-01-02")
+	if r.URL.Query().Get("format") == "json" {
+		type jsonEntry struct {
+			ID         int64           `json:"id"`
+			CreatedAt  string          `json:"created_at"`
+			Actor      string          `json:"actor"`
+			Action     string          `json:"action"`
+			TargetType string          `json:"target_type"`
+			TargetID   int64           `json:"target_id"`
+			TargetUser string          `json:"target_user,omitempty"`
+			Reason     string          `json:"reason,omitempty"`
+			Before     json.RawMessage `json:"before"`
+			After      json.RawMessage `json:"after"`
+		}
+		out := make([]jsonEntry, len(entries))
+		for i, e := range entries {
+			out[i] = jsonEntry{e.ID, e.CreatedAt, e.ActorName, e.Action, e.TargetType, e.TargetID, e.TargetUser,
+				e.Reason, rawSnapshot(e.Before), rawSnapshot(e.After)}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			return internalError(err, "Error exporting audit log")
+		}
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "created_at", "actor", "action", "target_type", "target_id", "target_user", "reason",
+		"before", "after"})
+	for _, e := range entries {
+		out.Write([]string{strconv.FormatInt(e.ID, 10), e.CreatedAt, csvText(e.ActorName), e.Action, e.TargetType,
+			strconv.FormatInt(e.TargetID, 10), csvText(e.TargetUser), csvText(e.Reason), csvText(e.Before), csvText(e.After)})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return internalError(err, "Error exporting audit log")
+	}
+	return nil
+}
+
+// csvText keeps user-supplied text from being read as a formula when the
+// export is opened in a spreadsheet, by quoting cells that start with a
+// character spreadsheets treat as the start of one.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func rawSnapshot(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuditExportNeutralizesFormulas(t *testing.T) {
+	e := newTestEnv(t)
+	admin := e.addUser("admin", RoleAdmin)
+	target := e.addUser("-target", RoleStudent)
+	reason := `=HYPERLINK("http://evil.example","click")`
+	e.exec(`INSERT INTO audit_log (actor_id, action, target_type, target_id, target_user_id, before, after, reason)
+		VALUES (?, ?, ?, ?, ?, '{"role":"student"}', '{"role":"moderator"}', ?)`,
+		admin, ActionChangeRole, TargetUser, target, target, reason)
+
+	w := e.do(Handler(AuditExportHandler), request{method: http.MethodGet, target: "/admin/audit/export", user: admin})
+	wantStatus(t, w, http.StatusOK)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d rows, want a header and one entry", len(records))
+	}
+	row := map[string]string{}
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+	if got := row["reason"]; got != "'"+reason {
+		t.Errorf("reason = %q, want it prefixed with a quote", got)
+	}
+	if got := row["target_user"]; got != "'-target" {
+		t.Errorf("target_user = %q, want it prefixed with a quote", got)
+	}
+	if got := row["before"]; got != `{"role":"student"}` {
+		t.Errorf("before = %q, want it unchanged", got)
+	}
+
+	// JSON isn't opened as a spreadsheet, so it is exported as stored.
+	w = e.do(Handler(AuditExportHandler), request{method: http.MethodGet, target: "/admin/audit/export?format=json", user: admin})
+	wantStatus(t, w, http.StatusOK)
+	var entries []struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Reason != reason {
+		t.Errorf("JSON entries = %+v, want the reason as stored", entries)
+	}
+}
+
+func TestAuditExportRequiresAdmin(t *testing.T) {
+	e := newTestEnv(t)
+	moderator := e.addUser("moderator", RoleModerator)
+	w := e.do(Handler(AuditExportHandler), request{method: http.MethodGet, target: "/admin/audit/export", user: moderator})
+	wantStatus(t, w, http.StatusForbidden)
+	if strings.Contains(w.Body.String(), "actor") {
+		t.Error("export was written for a moderator")
+	}
+}
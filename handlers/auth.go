@@ -2,109 +2,213 @@ package handlers
 
 import (
 	"database/sql"
-	"html/template"
+	"fmt"
+	"io"
 	"net/http"
+	"net/mail"
+	"regexp"
+	"unicode/utf8"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
+
+	"university-forum/telemetry"
 )
 
+// Renderer executes a page template by its file name, such as "login.html".
+// *template.Template satisfies it, as does views.Renderer.
+type Renderer interface {
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+// Pages lists the page templates the handlers render, so a server can check
+// they all exist before it starts.
+var Pages = []string{
+	"403.html", "404.html", "500.html", "error.html", "account-status.html", "admin.html", "appeals.html", "audit.html",
+	"categories.html", "category.html", "conversation.html", "create-post.html",
+	"edit-profile.html", "held.html", "index.html", "login.html", "messages.html",
+	"moderation.html", "notifications.html", "profile.html", "register.html",
+	"search.html", "tag.html", "unsubscribe.html", "view-post.html",
+}
+
 var (
+	// db runs reads. Writes go through writeDB, whose single connection
+	// makes them take turns; reads that must see a write in progress go
+	// through its transaction.
 	db        *sql.DB
+	writeDB   *sql.DB
 	store     *sessions.CookieStore
-	templates *template.Template
+	templates Renderer
 )
 
-func InitHandlers(database *sql.DB, sessionStore *sessions.CookieStore, tmpl *template.Template) {
+func InitHandlers(database, writer *sql.DB, sessionStore *sessions.CookieStore, tmpl Renderer) {
 	db = database
+	writeDB = writer
 	store = sessionStore
 	templates = tmpl
+	resetStatements()
 }
 
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		username := r.FormValue("username")
-		email := r.FormValue("email")
-		password := r.FormValue("password")
+const (
+	minPasswordLength = 8
+	maxUsernameLength = 30
+)
 
-		if username == "" || email == "" || password == "" {
-			http.Error(w, "All fields are required", http.StatusBadRequest)
-			return
-		}
+// usernamePattern matches the names an @mention can refer to.
+var usernamePattern = regexp.MustCompile(`^(\w[\w.-]*\w|\w)$`)
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			http.Error(w, "Error processing registration", http.StatusInternalServerError)
-			return
-		}
+// RegisterPage is the sign-up form.
+type RegisterPage struct {
+	Page
+	Form              Form
+	MinPasswordLength int
+}
+
+func RegisterHandler(w http.ResponseWriter, r *http.Request) error {
+	form := newForm(r, "username", "email")
+	if r.Method != "POST" {
+		return renderRegister(w, r, form, http.StatusOK)
+	}
+
+	username, email := form.Get("username"), form.Get("email")
+	password := r.FormValue("password")
 
-		_, err = db.Exec("INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)",
-			username, email, string(hashedPassword))
+	form.Required("username", "email")
+	form.MaxLength("username", maxUsernameLength)
+	if username != "" && !usernamePattern.MatchString(username) {
+		form.Fail("username", "Use only letters, numbers, dots, dashes and underscores")
+	}
+	// "edit" would collide with the /user/edit route.
+	if username == "edit" {
+		form.Fail("username", "That username is not available")
+	}
+	if email != "" {
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			form.Fail("email", "Enter a valid email address")
+		}
+	}
+	if password == "" {
+		form.Fail("password", "This field is required")
+	} else if utf8.RuneCountInString(password) < minPasswordLength {
+		form.Fail("password", fmt.Sprintf("Must be at least %d characters", minPasswordLength))
+	}
+	if form.Valid() {
+		var usernameTaken, emailTaken bool
+		err := db.QueryRowContext(r.Context(), `
+			SELECT EXISTS(SELECT 1 FROM users WHERE username = ?), EXISTS(SELECT 1 FROM users WHERE email = ?)
+		`, username, email).Scan(&usernameTaken, &emailTaken)
 		if err != nil {
-			http.Error(w, "Username or email already exists", http.StatusBadRequest)
-			return
+			return internalError(err, "Error processing registration")
 		}
-
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
+		if usernameTaken {
+			form.Fail("username", "That username is already taken")
+		}
+		if emailTaken {
+			form.Fail("email", "An account with that email already exists")
+		}
+	}
+	if !form.Valid() {
+		return renderRegister(w, r, form, http.StatusBadRequest)
 	}
 
-	err := templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-		"IsAuthenticated": false,
-		"PageID":          "register",
-	})
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return internalError(err, "Error processing registration")
+	}
 
+	_, err = writeDB.ExecContext(r.Context(), "INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)",
+		username, email, string(hashedPassword))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Someone else registered the same name or email in the meantime.
+		form.Fail(formError, "Username or email already exists")
+		return renderRegister(w, r, form, http.StatusBadRequest)
 	}
-}
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		username := r.FormValue("username")
-		password := r.FormValue("password")
+	addFlash(w, r, FlashSuccess, "Your account has been created. Log in to get started.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
 
-		var user struct {
-			ID           int64
-			PasswordHash string
-		}
+func renderRegister(w http.ResponseWriter, r *http.Request, form Form, status int) error {
+	page := RegisterPage{
+		Page:              newPage(w, r, "register", "Register"),
+		Form:              form,
+		MinPasswordLength: minPasswordLength,
+	}
+	return render(w, "register.html", page, status)
+}
 
-		err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).
-			Scan(&user.ID, &user.PasswordHash)
-		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
+// LoginPage is the login form.
+type LoginPage struct {
+	Page
+	Form Form
+}
 
-		err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
-		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
+func LoginHandler(w http.ResponseWriter, r *http.Request) error {
+	form := newForm(r, "username")
+	if r.Method != "POST" {
+		return renderLogin(w, r, form, http.StatusOK)
+	}
 
-		session, _ := store.Get(r, "session-name")
-		session.Values["authenticated"] = true
-		session.Values["user_id"] = user.ID
-		session.Save(r, w)
+	username := form.Get("username")
+	password := r.FormValue("password")
+	form.Required("username")
+	if password == "" {
+		form.Fail("password", "This field is required")
+	}
+	if !form.Valid() {
+		return renderLogin(w, r, form, http.StatusBadRequest)
+	}
 
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	var user struct {
+		ID           int64
+		PasswordHash string
 	}
 
-	err := templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-		"IsAuthenticated": false,
-		"PageID":          "login",
-	})
+	err := db.QueryRowContext(r.Context(), "SELECT id, password_hash FROM users WHERE username = ?", username).
+		Scan(&user.ID, &user.PasswordHash)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	}
+	if err != nil {
+		// Don't say which of the two was wrong.
+		telemetry.Logins.WithLabelValues("failure").Inc()
+		form.Fail(formError, "Invalid username or password")
+		return renderLogin(w, r, form, http.StatusUnauthorized)
+	}
 
+	_, locked, err := sanctionInForce(user.ID, SanctionSuspension, SanctionBan)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return internalError(err, "Error checking account status")
+	}
+	if locked {
+		telemetry.Logins.WithLabelValues("locked").Inc()
+		lockOut(w, r, user.ID)
+		return nil
 	}
+
+	session, _ := store.Get(r, "session-name")
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = user.ID
+	delete(session.Values, "sanctioned_user_id")
+	telemetry.Logins.WithLabelValues("success").Inc()
+	session.AddFlash(Flash{Kind: FlashSuccess, Message: "Welcome back, " + username + "."})
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, form Form, status int) error {
+	return render(w, "login.html", LoginPage{Page: newPage(w, r, "login", "Login"), Form: form}, status)
 }
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+func LogoutHandler(w http.ResponseWriter, r *http.Request) error {
 	session, _ := store.Get(r, "session-name")
 	session.Values["authenticated"] = false
 	session.Values["user_id"] = nil
+	session.AddFlash(Flash{Kind: FlashInfo, Message: "You have been logged out."})
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"university-forum/bench"
+)
+
+// benchmarkPages serves the requests next returns from many goroutines at
+// once, as a logged-in student, against a seeded forum.
+func benchmarkPages(b *testing.B, h Handler, next func(rng *rand.Rand, data bench.Dataset) (string, map[string]string)) {
+	e := newTestEnv(b)
+	data, err := bench.Seed(context.Background(), writeDB, bench.Size{Users: 100, Posts: 1000, CommentsPerPost: 5, Tags: 20})
+	if err != nil {
+		b.Fatal(err)
+	}
+	cookies := sessionCookies(e.t, data.UserIDs[0])
+	handler := Observe(SanctionMiddleware(h))
+
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			target, vars := next(rng, data)
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+			r = mux.SetURLVars(r, vars)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				b.Errorf("GET %s: status %d", target, w.Code)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkFeed(b *testing.B) {
+	benchmarkPages(b, HomeHandler, func(rng *rand.Rand, _ bench.Dataset) (string, map[string]string) {
+		// Most visitors stay on the first few pages.
+		return "/?page=" + strconv.Itoa(1+rng.Intn(5)), nil
+	})
+}
+
+func BenchmarkPost(b *testing.B) {
+	benchmarkPages(b, ViewPostHandler, func(rng *rand.Rand, data bench.Dataset) (string, map[string]string) {
+		id := strconv.FormatInt(data.PostIDs[rng.Intn(len(data.PostIDs))], 10)
+		return "/post/" + id, map[string]string{"id": id}
+	})
+}
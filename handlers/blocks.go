@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// notBlocked is a condition on a user aliased as alias: neither they nor the
+// user bound to @other has blocked the other.
+func notBlocked(alias string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM user_blocks b
+		WHERE (b.blocker_id = ` + alias + `.id AND b.blocked_id = @other)
+			OR (b.blocker_id = @other AND b.blocked_id = ` + alias + `.id)
+	)`
+}
+
+func hasBlocked(blockerID, blockedID int64) (bool, error) {
+	var blocked bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?)",
+		blockerID, blockedID).Scan(&blocked)
+	return blocked, err
+}
+
+// BlockUserHandler toggles whether the logged-in user blocks another user.
+// Blocked users cannot @mention the user who blocked them, and neither sees
+// the other in mention suggestions.
+func BlockUserHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	username := mux.Vars(r)["username"]
+	var blockedID int64
+	if err := db.QueryRowContext(r.Context(), "SELECT id FROM users WHERE username = ?", username).Scan(&blockedID); err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+	if blockedID == userID {
+		return newError(http.StatusBadRequest, "You cannot block yourself")
+	}
+
+	blocked, err := hasBlocked(userID, blockedID)
+	if err != nil {
+		return internalError(err, "Error updating block")
+	}
+	if blocked {
+		_, err = writeDB.ExecContext(r.Context(), "DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", userID, blockedID)
+	} else {
+		_, err = writeDB.ExecContext(r.Context(), "INSERT INTO user_blocks (blocker_id, blocked_id) VALUES (?, ?)", userID, blockedID)
+	}
+	if err != nil {
+		return internalError(err, "Error updating block")
+	}
+
+	http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+	return nil
+}
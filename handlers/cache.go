@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"university-forum/cache"
+)
+
+// The home feed and post pages are the most visited and each takes a dozen
+// or so queries, so the data behind them is cached. Entries are keyed by the
+// viewer's role, which decides whether anonymous authors are shown, and are
+// built for no viewer in particular; forViewer then applies what depends on
+// who is looking. Every write to a post or comment drops the entries it
+// affects. Caching is off until InitCache is called.
+var (
+	feedCache = cache.New[feedView](0, 0)
+	postCache = cache.New[postView](0, 0)
+)
+
+// InitCache turns on caching of up to entries feed pages and as many post
+// views, each kept for at most ttl.
+func InitCache(entries int, ttl time.Duration) {
+	feedCache = cache.New[feedView](entries, ttl)
+	postCache = cache.New[postView](entries, ttl)
+}
+
+// feedView is one page of the home feed.
+type feedView struct {
+	pinned     []Post
+	posts      []Post
+	pagination Pagination
+	built      time.Time
+}
+
+func feedKey(role string, page int) string {
+	return role + "/" + strconv.Itoa(page)
+}
+
+func (v feedView) forViewer(viewerID int64) (pinned, posts []Post) {
+	return unmaskPosts(v.pinned, viewerID), unmaskPosts(v.posts, viewerID)
+}
+
+// postView is a post with all its comments, hidden ones included.
+type postView struct {
+	post  Post
+	built time.Time
+}
+
+func postKey(postID int64, role string) string {
+	return strconv.FormatInt(postID, 10) + "/" + role
+}
+
+// forViewer returns the post and comments as viewerID sees them, leaving out
+// hidden content unless they are a moderator or wrote it. It reports false
+// if the post itself is hidden from them.
+func (v postView) forViewer(viewerID int64, role string) (Post, bool) {
+	visible := func(hidden bool, authorID int64) bool {
+		return !hidden || IsModerator(role) || (viewerID != 0 && authorID == viewerID)
+	}
+
+	post := v.post
+	if !visible(post.IsHidden, post.authorID) {
+		return Post{}, false
+	}
+	post.unmask(viewerID)
+	post.Comments = nil
+	for _, c := range v.post.Comments {
+		if visible(c.IsHidden, c.authorID) {
+			c.unmask(viewerID)
+			post.Comments = append(post.Comments, c)
+		}
+	}
+	return post, true
+}
+
+// unmask shows an anonymous post to its own author as theirs, as
+// visibleAuthor does in SQL for the viewer it is given.
+func (p *Post) unmask(viewerID int64) {
+	if p.IsAnonymous && viewerID != 0 && p.authorID == viewerID {
+		p.AuthorID, p.AuthorName = p.authorID, p.authorName
+	}
+}
+
+func (c *Comment) unmask(viewerID int64) {
+	if c.IsAnonymous && viewerID != 0 && c.authorID == viewerID {
+		c.AuthorID, c.AuthorName = c.authorID, c.authorName
+	}
+}
+
+// unmaskPosts returns posts as viewerID sees them, copying the slice rather
+// than changing the cached one.
+func unmaskPosts(posts []Post, viewerID int64) []Post {
+	if viewerID == 0 {
+		return posts
+	}
+	out := make([]Post, len(posts))
+	copy(out, posts)
+	for i := range out {
+		out[i].unmask(viewerID)
+	}
+	return out
+}
+
+// invalidatePost drops the cached views of a post and every feed page,
+// which may list it. Call it once a change to the post has committed.
+func invalidatePost(postID int64) {
+	invalidateComments(postID)
+	feedCache.Clear()
+}
+
+// invalidateComments drops the cached views of a post whose comments have
+// changed. The feed doesn't show comments, so it is kept.
+func invalidateComments(postID int64) {
+	prefix := strconv.FormatInt(postID, 10) + "/"
+	postCache.RemoveFunc(func(key string) bool { return strings.HasPrefix(key, prefix) })
+}
+
+// invalidatePosts drops everything cached, for changes that may touch any
+// number of posts.
+func invalidatePosts() {
+	feedCache.Clear()
+	postCache.Clear()
+}
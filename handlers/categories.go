@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Category groups posts for one course or topic. Members of a category are
+// the course members who receive its announcements.
+type Category struct {
+	ID          int64
+	Name        string
+	Slug        string
+	Description string
+	PostCount   int
+	IsMember    bool
+}
+
+func listCategories(viewerID int64) ([]Category, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.name, c.slug, c.description,
+			(SELECT COUNT(*) FROM posts p WHERE p.category_id = c.id),
+			EXISTS (SELECT 1 FROM category_members m WHERE m.category_id = c.id AND m.user_id = ?)
+		FROM categories c
+		ORDER BY c.name
+	`, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.PostCount, &c.IsMember); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func categoryBySlug(slug string, viewerID int64) (Category, error) {
+	var c Category
+	err := db.QueryRow(`
+		SELECT c.id, c.name, c.slug, c.description,
+			EXISTS (SELECT 1 FROM category_members m WHERE m.category_id = c.id AND m.user_id = ?)
+		FROM categories c
+		WHERE c.slug = ?
+	`, viewerID, slug).Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.IsMember)
+	return c, err
+}
+
+// HomePage is the home feed.
+type HomePage struct {
+	Page
+	Pinned     []Post
+	Posts      []Post
+	Pagination Pagination
+}
+
+// HomeHandler shows the home feed. Globally pinned posts sit above the
+// paginated list and are left out of it.
+func HomeHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+	page := pageParam(r)
+
+	feed, err := feedCache.Load(feedKey(role, page), func() (feedView, error) {
+		return loadFeed(role, page)
+	})
+	if err != nil {
+		return internalError(err, "Error fetching posts")
+	}
+	pinned, posts := feed.forViewer(viewerID)
+
+	return renderCacheable(w, r, "index.html", HomePage{
+		Page:       newPage(w, r, "index", ""),
+		Pinned:     pinned,
+		Posts:      posts,
+		Pagination: feed.pagination,
+	}, feed.built)
+}
+
+// loadFeed fetches a page of the home feed as a viewer with the given role
+// and no ID sees it.
+func loadFeed(role string, page int) (feedView, error) {
+	pinned, err := pinnedPosts(0, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		WHERE p.pin_scope = @global
+	`, sql.Named("global", PinGlobal))
+	if err != nil {
+		return feedView{}, err
+	}
+
+	posts, pagination, err := listPosts(0, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		WHERE p.pin_scope != @global
+	`, page, sql.Named("global", PinGlobal))
+	if err != nil {
+		return feedView{}, err
+	}
+	return feedView{pinned: pinned, posts: posts, pagination: pagination, built: time.Now()}, nil
+}
+
+// CategoriesPage lists every category.
+type CategoriesPage struct {
+	Page
+	Categories []Category
+}
+
+// CategoriesHandler lists all categories. Moderators can also create new ones
+// from this page.
+func CategoriesHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+
+	if r.Method == "POST" {
+		if !IsModerator(role) {
+			return newError(http.StatusForbidden, "Only moderators can create categories")
+		}
+
+		name := strings.TrimSpace(r.FormValue("name"))
+		slug := normalizeTag(r.FormValue("slug"))
+		if slug == "" {
+			slug = normalizeTag(name)
+		}
+		if name == "" || slug == "" {
+			return newError(http.StatusBadRequest, "Category name is required")
+		}
+
+		tx, err := writeDB.BeginTx(r.Context(), nil)
+		if err != nil {
+			return internalError(err, "Error creating category")
+		}
+		defer tx.Rollback()
+
+		result, err := tx.ExecContext(r.Context(), "INSERT INTO categories (name, slug, description) VALUES (?, ?, ?)",
+			name, slug, strings.TrimSpace(r.FormValue("description")))
+		if err != nil {
+			return newError(http.StatusBadRequest, "A category with that name already exists")
+		}
+		categoryID, _ := result.LastInsertId()
+		if err := auditCreated(tx, viewerID, ActionCreateCategory, auditTarget{TargetCategory, categoryID}, ""); err != nil {
+			return internalError(err, "Error creating category")
+		}
+		if err := tx.Commit(); err != nil {
+			return internalError(err, "Error creating category")
+		}
+
+		http.Redirect(w, r, "/category/"+slug, http.StatusSeeOther)
+		return nil
+	}
+
+	categories, err := listCategories(viewerID)
+	if err != nil {
+		return internalError(err, "Error fetching categories")
+	}
+
+	return templates.ExecuteTemplate(w, "categories.html", CategoriesPage{
+		Page:       newPage(w, r, "categories", "Categories"),
+		Categories: categories,
+	})
+}
+
+// CategoryPage is one page of a category's posts.
+type CategoryPage struct {
+	Page
+	Category   Category
+	Pinned     []Post
+	Posts      []Post
+	Pagination Pagination
+}
+
+// CategoryHandler lists a category's posts, with posts pinned globally or to
+// the category shown above the paginated list.
+func CategoryHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+
+	category, err := categoryBySlug(mux.Vars(r)["slug"], viewerID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Category not found")
+	}
+
+	pinned, err := pinnedPosts(viewerID, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		WHERE p.category_id = @category AND p.pin_scope != ''
+	`, sql.Named("category", category.ID))
+	if err != nil {
+		return internalError(err, "Error fetching posts")
+	}
+
+	posts, pagination, err := listPosts(viewerID, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		WHERE p.category_id = @category AND p.pin_scope = ''
+	`, pageParam(r), sql.Named("category", category.ID))
+	if err != nil {
+		return internalError(err, "Error fetching posts")
+	}
+
+	return templates.ExecuteTemplate(w, "category.html", CategoryPage{
+		Page:       newPage(w, r, "category", category.Name),
+		Category:   category,
+		Pinned:     pinned,
+		Posts:      posts,
+		Pagination: pagination,
+	})
+}
+
+// JoinCategoryHandler toggles the current user's membership of a category.
+func JoinCategoryHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	slug := mux.Vars(r)["slug"]
+	category, err := categoryBySlug(slug, userID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Category not found")
+	}
+
+	if category.IsMember {
+		_, err = writeDB.ExecContext(r.Context(), "DELETE FROM category_members WHERE category_id = ? AND user_id = ?", category.ID, userID)
+	} else {
+		_, err = writeDB.ExecContext(r.Context(), "INSERT INTO category_members (category_id, user_id) VALUES (?, ?)", category.ID, userID)
+	}
+	if err != nil {
+		return internalError(err, "Error updating membership")
+	}
+
+	http.Redirect(w, r, "/category/"+slug, http.StatusSeeOther)
+	return nil
+}
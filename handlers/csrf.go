@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// csrfField is the form field, and csrfHeader the header, that carry the
+// session's CSRF token on every request that changes something.
+const (
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfPeekSize bounds how much of a multipart body is read ahead to find the
+// token, which forms put in their first part.
+const csrfPeekSize = 4096
+
+// sessionCSRFToken returns the session's CSRF token, issuing one if it has
+// none yet. The caller saves the session when issued is true.
+func sessionCSRFToken(session *sessions.Session) (token string, issued bool) {
+	if token, _ = session.Values[csrfField].(string); token != "" {
+		return token, false
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", false
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	session.Values[csrfField] = token
+	return token, true
+}
+
+// csrfExempt marks a route that authenticates its callers some other way
+// than the session cookie, so forged requests from a browser carry nothing
+// it would accept.
+type csrfExempt struct{ http.Handler }
+
+// CSRFExempt lets requests to h through CSRFMiddleware without a token.
+func CSRFExempt(h http.Handler) http.Handler { return csrfExempt{h} }
+
+// CSRFMiddleware refuses requests that could change something unless they
+// carry the token newPage puts in every form, so another site can't submit
+// forms with the viewer's session.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if _, ok := route.GetHandler().(csrfExempt); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		session, _ := store.Get(r, "session-name")
+		want, _ := session.Values[csrfField].(string)
+		got := requestCSRFToken(r)
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			serveError(trackWrites(w), r, newError(http.StatusForbidden,
+				"This form has expired. Go back, reload the page and try again."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestCSRFToken returns the token sent with r, from the header or the
+// form. A multipart form isn't parsed here, since its handler sets its own
+// size limits first; the token is read from the form's first part instead,
+// leaving the body as it was.
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.PostFormValue(csrfField)
+	}
+
+	br := bufio.NewReaderSize(r.Body, csrfPeekSize)
+	head, _ := br.Peek(csrfPeekSize)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+
+	part, err := multipart.NewReader(bytes.NewReader(head), params["boundary"]).NextPart()
+	if err != nil || part.FormName() != csrfField {
+		return ""
+	}
+	token, err := io.ReadAll(part)
+	if err != nil {
+		return ""
+	}
+	return string(token)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// csrfRouter routes the post form, and a route exempt from the check,
+// through the CSRF middleware as the forum's router does.
+func csrfRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/create-post", Handler(CreatePostHandler)).Methods("GET", "POST")
+	router.Handle("/webhook", CSRFExempt(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("POST")
+	router.Use(CSRFMiddleware)
+	return Observe(router)
+}
+
+// loadForm fetches the post form as user, returning the session cookies it
+// leaves and the CSRF token in the form.
+func loadForm(t *testing.T, router http.Handler, user int64) ([]*http.Cookie, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/create-post", nil)
+	for _, c := range sessionCookies(t, user) {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	wantStatus(t, w, http.StatusOK)
+	m := csrfInput.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("form has no CSRF token")
+	}
+	if !strings.Contains(w.Body.String(), `<meta name="csrf-token" content="`+m[1]+`">`) {
+		t.Error("page has no CSRF token for scripts")
+	}
+	return w.Result().Cookies(), m[1]
+}
+
+// csrfPost submits body to target with the given session cookies.
+func csrfPost(router http.Handler, target string, cookies []*http.Cookie, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, body)
+	r.Header.Set("Content-Type", contentType)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestCSRFRefusesPostWithoutToken(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	router := csrfRouter()
+	cookies, token := loadForm(t, router, author)
+	submit := func(form url.Values) *httptest.ResponseRecorder {
+		form.Set("title", "Forged")
+		form.Set("content", "Body")
+		return csrfPost(router, "/create-post", cookies, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	}
+
+	wantStatus(t, submit(url.Values{}), http.StatusForbidden)
+	wantStatus(t, submit(url.Values{"csrf_token": {token + "x"}}), http.StatusForbidden)
+	// The token belongs to the session, so a form from another one fails.
+	otherCookies, otherToken := loadForm(t, router, e.addUser("other", RoleStudent))
+	wantStatus(t, csrfPost(router, "/create-post", otherCookies,
+		strings.NewReader(url.Values{"csrf_token": {token}}.Encode()), "application/x-www-form-urlencoded"), http.StatusForbidden)
+	if otherToken == token {
+		t.Error("two sessions share a token")
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM posts"); n != 0 {
+		t.Fatalf("%d posts created without a valid token", n)
+	}
+
+	wantStatus(t, submit(url.Values{"csrf_token": {token}}), http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM posts WHERE author_id = ?", author); n != 1 {
+		t.Errorf("%d posts created with the token, want 1", n)
+	}
+}
+
+func TestCSRFMultipartForm(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	router := csrfRouter()
+	cookies, token := loadForm(t, router, author)
+	submit := func(token string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if token != "" {
+			mw.WriteField("csrf_token", token)
+		}
+		mw.WriteField("title", "Notes")
+		mw.WriteField("content", "Attached")
+		part, err := mw.CreateFormFile("attachments", "notes.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(strings.Repeat("notes ", 2000)))
+		mw.Close()
+		return csrfPost(router, "/create-post", cookies, &body, mw.FormDataContentType())
+	}
+
+	wantStatus(t, submit(""), http.StatusForbidden)
+	wantStatus(t, submit(token), http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM attachments"); n != 1 {
+		t.Errorf("%d attachments saved, want the one sent with the token", n)
+	}
+}
+
+func TestCSRFExemptRoute(t *testing.T) {
+	newTestEnv(t)
+	w := csrfPost(csrfRouter(), "/webhook", nil, strings.NewReader("to=x"), "application/x-www-form-urlencoded")
+	wantStatus(t, w, http.StatusNoContent)
+}
@@ -0,0 +1,638 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"university-forum/filter"
+	"university-forum/mailer"
+	"university-forum/telemetry"
+)
+
+// Email frequencies stored in email_settings.frequency. Users without a row
+// get daily digests.
+const (
+	EmailImmediate = "immediate"
+	EmailDaily     = "daily"
+	EmailWeekly    = "weekly"
+	EmailOff       = "off"
+)
+
+// EmailFrequency is an option on the email settings form.
+type EmailFrequency struct {
+	Value string
+	Label string
+}
+
+var emailFrequencies = []EmailFrequency{
+	{Value: EmailImmediate, Label: "Email me as things happen"},
+	{Value: EmailDaily, Label: "Daily digest"},
+	{Value: EmailWeekly, Label: "Weekly digest"},
+	{Value: EmailOff, Label: "Don't email me"},
+}
+
+const (
+	emailBatchSize  = 100
+	maxDigestPosts  = 50
+	maxEmailExcerpt = 500
+	sqliteTime      = "2006-01-02 15:04:05"
+)
+
+// MailConfig holds the settings used to build outgoing email.
+type MailConfig struct {
+	BaseURL string // public URL of the site, used for links, e.g. "http://localhost:7000"
+
+	// ReplyDomain is the domain reply-by-email addresses are issued under, as
+	// reply+<token>@ReplyDomain. Reply-by-email is off when it is empty.
+	ReplyDomain string
+
+	// InboundSecret must be sent by the inbound mail webhook in the
+	// X-Inbound-Secret header. Inbound email is refused when it is empty.
+	InboundSecret string
+}
+
+var (
+	outbox     mailer.Mailer
+	mailConfig MailConfig
+)
+
+// InitMail sets the mailer notification emails and digests are sent through.
+func InitMail(m mailer.Mailer, cfg MailConfig) {
+	outbox = m
+	mailConfig = cfg
+	mailConfig.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+}
+
+func validEmailFrequency(frequency string) bool {
+	for _, f := range emailFrequencies {
+		if f.Value == frequency {
+			return true
+		}
+	}
+	return false
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// emailSettings returns a user's email frequency and unsubscribe token,
+// creating their settings with the defaults if they have none yet.
+func emailSettings(userID int64) (string, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = writeDB.Exec(`
+		INSERT INTO email_settings (user_id, unsubscribe_token) VALUES (?, ?)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	var frequency string
+	err = db.QueryRow("SELECT frequency, unsubscribe_token FROM email_settings WHERE user_id = ?", userID).
+		Scan(&frequency, &token)
+	return frequency, token, err
+}
+
+// setEmailFrequency changes how often a user is emailed. Notifications that
+// arrived before the change are not emailed afterwards, so switching to
+// immediate email does not send a backlog.
+func setEmailFrequency(userID int64, frequency string) error {
+	if _, _, err := emailSettings(userID); err != nil {
+		return err
+	}
+
+	tx, err := writeDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE email_settings SET frequency = ?, last_digest_at = CURRENT_TIMESTAMP
+		WHERE user_id = ?
+	`, frequency, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE notifications SET emailed_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND emailed_at IS NULL
+	`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replyAddress returns the address a user can email to comment on a post, or
+// "" when reply-by-email is off. Each user gets one token per post.
+func replyAddress(userID, postID int64) (string, error) {
+	if mailConfig.ReplyDomain == "" {
+		return "", nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = writeDB.Exec(`
+		INSERT INTO reply_tokens (token, user_id, post_id) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, post_id) DO NOTHING
+	`, token, userID, postID)
+	if err != nil {
+		return "", err
+	}
+	err = db.QueryRow("SELECT token FROM reply_tokens WHERE user_id = ? AND post_id = ?", userID, postID).Scan(&token)
+	if err != nil {
+		return "", err
+	}
+	return "reply+" + token + "@" + mailConfig.ReplyDomain, nil
+}
+
+// recipient is a user email is being sent to.
+type recipient struct {
+	ID       int64
+	Username string
+	Email    string
+}
+
+// sendEmail sends a message to a user with the unsubscribe link and headers
+// added.
+func sendEmail(ctx context.Context, to recipient, msg mailer.Message) error {
+	_, token, err := emailSettings(to.ID)
+	if err != nil {
+		return err
+	}
+	unsubscribe := mailConfig.BaseURL + "/unsubscribe?token=" + token
+
+	msg.To = to.Email
+	msg.Body += "\n--\nChange how often we email you: " + mailConfig.BaseURL + "/notifications\n" +
+		"Unsubscribe from all email: " + unsubscribe + "\n"
+	msg.Headers = map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribe + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	return outbox.Send(ctx, msg)
+}
+
+// describeNotification is the one-line summary of a notification used in
+// email subjects and digests.
+func describeNotification(n Notification) string {
+	actor := n.ActorName
+	if actor == "" {
+		actor = "Someone"
+	}
+	switch n.Type {
+	case NotifyReply:
+		return fmt.Sprintf("%s replied to your post %q", actor, n.PostTitle)
+	case NotifyMention:
+		return fmt.Sprintf("%s mentioned you in %q", actor, n.PostTitle)
+	case NotifyThread:
+		return fmt.Sprintf("%s commented on %q", actor, n.PostTitle)
+	case NotifyAnnouncement:
+		return fmt.Sprintf("New announcement: %q", n.PostTitle)
+	}
+	return n.PostTitle
+}
+
+func (n Notification) postURL() string {
+	return mailConfig.BaseURL + "/post/" + strconv.FormatInt(n.PostID, 10)
+}
+
+func excerpt(text string) string {
+	text = strings.TrimSpace(text)
+	if len(text) > maxEmailExcerpt {
+		text = strings.TrimSpace(text[:maxEmailExcerpt]) + "…"
+	}
+	return text
+}
+
+// RunEmailScheduler sends pending notification emails and digests every
+// interval until ctx is cancelled.
+func RunEmailScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sendPendingEmail(ctx, time.Now()); err != nil {
+			slog.Error("sending notification email", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendPendingEmail(ctx context.Context, now time.Time) error {
+	if outbox == nil {
+		return nil
+	}
+	if err := sendImmediateEmails(ctx); err != nil {
+		return err
+	}
+	return sendDigests(ctx, now)
+}
+
+// sendImmediateEmails emails each new notification to the users who asked to
+// be emailed as things happen. Replies carry a reply-by-email address.
+func sendImmediateEmails(ctx context.Context) error {
+	rows, err := db.Query(`
+		SELECT n.id, n.type, COALESCE(n.post_id, 0), COALESCE(p.title, ''), COALESCE(a.username, ''),
+			COALESCE(c.content, p.content, ''), u.id, u.username, u.email
+		FROM notifications n
+		JOIN users u ON n.user_id = u.id
+		JOIN email_settings es ON es.user_id = n.user_id
+		LEFT JOIN posts p ON n.post_id = p.id
+		LEFT JOIN comments c ON n.comment_id = c.id
+		LEFT JOIN users a ON n.actor_id = a.id
+		WHERE n.emailed_at IS NULL AND es.frequency = ?
+		ORDER BY n.id
+		LIMIT ?
+	`, EmailImmediate, emailBatchSize)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		Notification
+		Text string
+		To   recipient
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		err := rows.Scan(&p.ID, &p.Type, &p.PostID, &p.PostTitle, &p.ActorName, &p.Text,
+			&p.To.ID, &p.To.Username, &p.To.Email)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// A notification is marked as emailed even when sending fails: it is
+	// still shown on the site, and retrying would hold the rest of the
+	// queue up behind an address that may never accept mail.
+	for _, p := range batch {
+		if err := sendNotificationEmail(ctx, p.Notification, p.Text, p.To); err != nil {
+			slog.Error("sending notification email", "notification", p.ID, "user", p.To.ID, "error", err)
+		}
+		_, err = writeDB.Exec("UPDATE notifications SET emailed_at = CURRENT_TIMESTAMP WHERE id = ?", p.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendNotificationEmail(ctx context.Context, n Notification, text string, to recipient) error {
+	msg := mailer.Message{
+		Subject: describeNotification(n),
+		Body:    fmt.Sprintf("Hi %s,\n\n%s:\n\n%s\n\nView the discussion: %s\n", to.Username, describeNotification(n), excerpt(text), n.postURL()),
+	}
+	if n.PostID != 0 && n.Type != NotifyAnnouncement {
+		var err error
+		msg.ReplyTo, err = replyAddress(to.ID, n.PostID)
+		if err != nil {
+			return err
+		}
+		if msg.ReplyTo != "" {
+			msg.Body += "Reply to this email to post a comment.\n"
+		}
+	}
+	return sendEmail(ctx, to, msg)
+}
+
+// sendDigests sends each daily or weekly digest that is due: the user's
+// notifications since their last digest and the new posts in the courses
+// they have joined. Users with nothing new get no email.
+func sendDigests(ctx context.Context, now time.Time) error {
+	nowValue := now.UTC().Format(sqliteTime)
+	rows, err := db.Query(`
+		SELECT u.id, u.username, u.email, COALESCE(es.frequency, @daily),
+			COALESCE(es.last_digest_at, datetime(@now, CASE COALESCE(es.frequency, @daily) WHEN @weekly THEN '-7 days' ELSE '-1 day' END))
+		FROM users u
+		LEFT JOIN email_settings es ON es.user_id = u.id
+		WHERE COALESCE(es.frequency, @daily) IN (@daily, @weekly)
+			AND (es.last_digest_at IS NULL
+				OR es.last_digest_at <= datetime(@now, CASE es.frequency WHEN @weekly THEN '-7 days' ELSE '-1 day' END))
+		ORDER BY u.id
+		LIMIT @limit
+	`, sql.Named("now", nowValue), sql.Named("daily", EmailDaily), sql.Named("weekly", EmailWeekly),
+		sql.Named("limit", emailBatchSize))
+	if err != nil {
+		return err
+	}
+
+	type due struct {
+		To        recipient
+		Frequency string
+		Since     string
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.To.ID, &d.To.Username, &d.To.Email, &d.Frequency, &d.Since); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range batch {
+		if err := sendDigest(ctx, d.To, d.Frequency, d.Since, nowValue); err != nil {
+			slog.Error("sending digest", "user", d.To.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// sendDigest sends one user's digest and records it as sent. As with
+// immediate emails, a digest that can't be delivered is recorded anyway, so
+// the user is next tried when their following digest is due.
+func sendDigest(ctx context.Context, to recipient, frequency, since, now string) error {
+	rows, err := db.Query(`
+		SELECT n.id, n.type, COALESCE(n.post_id, 0), COALESCE(p.title, ''), COALESCE(a.username, '')
+		FROM notifications n
+		LEFT JOIN posts p ON n.post_id = p.id
+		LEFT JOIN users a ON n.actor_id = a.id
+		WHERE n.user_id = ? AND n.emailed_at IS NULL
+		ORDER BY n.id
+	`, to.ID)
+	if err != nil {
+		return err
+	}
+	var notifications []Notification
+	var lastID int64
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.PostID, &n.PostTitle, &n.ActorName); err != nil {
+			rows.Close()
+			return err
+		}
+		notifications = append(notifications, n)
+		lastID = n.ID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`
+		SELECT p.id, p.title, c.name
+		FROM posts p
+		JOIN categories c ON p.category_id = c.id
+		JOIN category_members m ON m.category_id = c.id AND m.user_id = ?
+		WHERE p.created_at > ? AND p.created_at <= ? AND p.author_id != ? AND p.is_hidden = 0
+		ORDER BY p.created_at
+		LIMIT ?
+	`, to.ID, since, now, to.ID, maxDigestPosts)
+	if err != nil {
+		return err
+	}
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Category); err != nil {
+			rows.Close()
+			return err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(notifications) > 0 || len(posts) > 0 {
+		period := "today"
+		if frequency == EmailWeekly {
+			period = "this week"
+		}
+
+		var body strings.Builder
+		fmt.Fprintf(&body, "Hi %s,\n\nHere's what happened on the University Forum %s.\n", to.Username, period)
+		if len(notifications) > 0 {
+			body.WriteString("\nFor you\n\n")
+			for _, n := range notifications {
+				fmt.Fprintf(&body, "- %s\n  %s\n", describeNotification(n), n.postURL())
+			}
+		}
+		if len(posts) > 0 {
+			body.WriteString("\nNew in your courses\n\n")
+			for _, p := range posts {
+				fmt.Fprintf(&body, "- [%s] %s\n  %s/post/%d\n", p.Category, p.Title, mailConfig.BaseURL, p.ID)
+			}
+		}
+
+		msg := mailer.Message{
+			Subject: fmt.Sprintf("Your %s University Forum digest", frequency),
+			Body:    body.String(),
+		}
+		if err := sendEmail(ctx, to, msg); err != nil {
+			slog.Error("sending digest", "user", to.ID, "error", err)
+		}
+	}
+
+	if _, _, err := emailSettings(to.ID); err != nil {
+		return err
+	}
+	_, err = writeDB.Exec("UPDATE email_settings SET last_digest_at = ? WHERE user_id = ?", now, to.ID)
+	if err != nil {
+		return err
+	}
+	_, err = writeDB.Exec(`
+		UPDATE notifications SET emailed_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND id <= ? AND emailed_at IS NULL
+	`, to.ID, lastID)
+	return err
+}
+
+// UnsubscribePage asks the owner of an unsubscribe link to confirm, or tells
+// them they have been unsubscribed.
+type UnsubscribePage struct {
+	Page
+	Token        string
+	Unsubscribed bool
+}
+
+// UnsubscribeHandler turns off all email for the user an unsubscribe link was
+// issued to. Opening the link only asks for confirmation, since mail scanners
+// and link previews follow links in email; the confirmation form and mail
+// clients offering one-click unsubscribe (RFC 8058) POST to the same URL.
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) error {
+	token := r.FormValue("token")
+	var userID int64
+	err := db.QueryRowContext(r.Context(), "SELECT user_id FROM email_settings WHERE unsubscribe_token = ?", token).Scan(&userID)
+	if err != nil {
+		return newError(http.StatusNotFound, "This unsubscribe link is not valid")
+	}
+
+	if r.Method != "POST" {
+		return templates.ExecuteTemplate(w, "unsubscribe.html", UnsubscribePage{
+			Page:  newPage(w, r, "unsubscribe", "Unsubscribe"),
+			Token: token,
+		})
+	}
+
+	if err := setEmailFrequency(userID, EmailOff); err != nil {
+		return internalError(err, "Error updating email settings")
+	}
+	if r.PostFormValue("List-Unsubscribe") == "One-Click" {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	return templates.ExecuteTemplate(w, "unsubscribe.html", UnsubscribePage{
+		Page:         newPage(w, r, "unsubscribe", "Unsubscribed"),
+		Unsubscribed: true,
+	})
+}
+
+// quoteHeader matches the line mail clients put above quoted text, e.g.
+// "On Mon, 2 Jun 2025 at 10:00, Forum <reply+...> wrote:".
+var quoteHeader = regexp.MustCompile(`^On .*wrote:$`)
+
+// stripQuotedReply returns the new text of an email reply, dropping the
+// quoted original and the signature.
+func stripQuotedReply(text string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") || trimmed == "--" || quoteHeader.MatchString(trimmed) {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// replyToken extracts the token from a reply+<token>@domain address.
+func replyToken(to string) string {
+	if addr, err := mail.ParseAddress(to); err == nil {
+		to = addr.Address
+	}
+	local, _, _ := strings.Cut(to, "@")
+	token, ok := strings.CutPrefix(local, "reply+")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// InboundEmailHandler accepts replies to notification emails from an inbound
+// mail webhook, which posts the recipient address as "to" and the plain-text
+// body as "text". The reply is added as a comment by the user the reply
+// address was issued to.
+func InboundEmailHandler(w http.ResponseWriter, r *http.Request) error {
+	secret := r.Header.Get("X-Inbound-Secret")
+	if mailConfig.InboundSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(mailConfig.InboundSecret)) != 1 {
+		return newError(http.StatusForbidden, "Forbidden")
+	}
+
+	var userID, postID int64
+	err := db.QueryRowContext(r.Context(), "SELECT user_id, post_id FROM reply_tokens WHERE token = ?", replyToken(r.FormValue("to"))).
+		Scan(&userID, &postID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Unknown reply address")
+	}
+
+	// Muted, suspended and banned users cannot post by email either.
+	_, sanctioned, err := sanctionInForce(userID, SanctionMute, SanctionSuspension, SanctionBan)
+	if err != nil {
+		return internalError(err, "Error checking account status")
+	}
+	if sanctioned {
+		return newError(http.StatusForbidden, "This account cannot post")
+	}
+
+	var role string
+	if err := db.QueryRowContext(r.Context(), "SELECT role FROM users WHERE id = ?", userID).Scan(&role); err != nil {
+		return internalError(err, "Error adding comment")
+	}
+
+	// The post may have been hidden since the reply address was issued.
+	var isLocked bool
+	err = db.QueryRowContext(r.Context(), "SELECT is_locked FROM posts WHERE id = ? AND (is_hidden = 0 OR ? OR author_id = ?)",
+		postID, IsModerator(role), userID).Scan(&isLocked)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+	if isLocked {
+		return newError(http.StatusForbidden, "This discussion is locked")
+	}
+
+	content := stripQuotedReply(r.FormValue("text"))
+	if content == "" {
+		return newError(http.StatusBadRequest, "Reply is empty")
+	}
+	decision, err := checkContent(r, userID, role, "", content)
+	if err != nil {
+		return err
+	}
+	held := decision.Verdict == filter.Hold
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), "INSERT INTO comments (content, post_id, author_id, is_hidden) VALUES (?, ?, ?, ?)",
+		content, postID, userID, held)
+	if err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	commentID, _ := result.LastInsertId()
+	if held {
+		if err := holdContent(tx, reportedContent{CommentID: commentID}, userID, decision); err != nil {
+			return internalError(err, "Error adding comment")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	telemetry.CommentsCreated.Inc()
+	invalidateComments(postID)
+
+	if held {
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	// An error now would have the webhook deliver the reply again and post
+	// it twice.
+	logAnnounceError(r, notifyComment(postID, commentID, userID, false, content), "sending notifications")
+	logAnnounceError(r, publishComment(postID, commentID), "publishing comment")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"university-forum/mailer"
+)
+
+// testMailer records the messages sent through it, failing those to the
+// addresses in fail.
+type testMailer struct {
+	mu   sync.Mutex
+	fail map[string]bool
+	sent []mailer.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail[msg.To] {
+		return errors.New("mailbox unavailable")
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *testMailer) sentTo() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var to []string
+	for _, msg := range m.sent {
+		to = append(to, msg.To)
+	}
+	return to
+}
+
+// useTestMailer sends the forum's email through a testMailer failing for
+// the given addresses.
+func useTestMailer(cfg MailConfig, fail ...string) *testMailer {
+	m := &testMailer{fail: map[string]bool{}}
+	for _, addr := range fail {
+		m.fail[addr] = true
+	}
+	InitMail(m, cfg)
+	return m
+}
+
+func TestImmediateEmailFailureDoesNotBlockOthers(t *testing.T) {
+	e := newTestEnv(t)
+	m := useTestMailer(MailConfig{BaseURL: "http://forum.test"}, "bounce@example.edu")
+	author := e.addUser("author", RoleStudent)
+	post := e.addPost(author, "Question")
+	var notifications []int64
+	for _, name := range []string{"bounce", "alice", "bob"} {
+		user := e.addUser(name, RoleStudent)
+		if err := setEmailFrequency(user, EmailImmediate); err != nil {
+			t.Fatal(err)
+		}
+		notifications = append(notifications, e.exec(
+			"INSERT INTO notifications (user_id, type, post_id, actor_id) VALUES (?, ?, ?, ?)",
+			user, NotifyThread, post, author))
+	}
+
+	if err := sendPendingEmail(context.Background(), time.Now()); err != nil {
+		t.Fatalf("sendPendingEmail: %v", err)
+	}
+	if got := m.sentTo(); len(got) != 2 || got[0] != "alice@example.edu" || got[1] != "bob@example.edu" {
+		t.Errorf("sent to %v, want alice and bob", got)
+	}
+	for _, id := range notifications {
+		if e.queryInt("SELECT COUNT(*) FROM notifications WHERE id = ? AND emailed_at IS NULL", id) != 0 {
+			t.Errorf("notification %d is still waiting to be emailed", id)
+		}
+	}
+
+	// Nothing is left to retry.
+	if err := sendPendingEmail(context.Background(), time.Now()); err != nil {
+		t.Fatalf("sendPendingEmail: %v", err)
+	}
+	if got := m.sentTo(); len(got) != 2 {
+		t.Errorf("second run sent %d more emails, want none", len(got)-2)
+	}
+}
+
+func TestDigestFailureDoesNotBlockOthers(t *testing.T) {
+	e := newTestEnv(t)
+	m := useTestMailer(MailConfig{BaseURL: "http://forum.test"}, "bounce@example.edu")
+	author := e.addUser("author", RoleStudent)
+	post := e.addPost(author, "Question")
+	users := map[string]int64{}
+	for _, name := range []string{"bounce", "alice"} {
+		// Users who haven't chosen get daily digests.
+		users[name] = e.addUser(name, RoleStudent)
+		e.exec("INSERT INTO notifications (user_id, type, post_id, actor_id) VALUES (?, ?, ?, ?)",
+			users[name], NotifyThread, post, author)
+	}
+
+	if err := sendPendingEmail(context.Background(), time.Now()); err != nil {
+		t.Fatalf("sendPendingEmail: %v", err)
+	}
+	if got := m.sentTo(); len(got) != 1 || got[0] != "alice@example.edu" {
+		t.Errorf("sent to %v, want just alice", got)
+	}
+	for name, id := range users {
+		if e.queryInt("SELECT COUNT(*) FROM email_settings WHERE user_id = ? AND last_digest_at IS NOT NULL", id) != 1 {
+			t.Errorf("%s's digest was not recorded", name)
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	e := newTestEnv(t)
+	user := e.addUser("alice", RoleStudent)
+	_, token, err := emailSettings(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frequency := func() string {
+		f, _, err := emailSettings(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Following the link, as a mail scanner would, only asks to confirm.
+	w := e.do(Handler(UnsubscribeHandler), request{method: http.MethodGet, target: "/unsubscribe?token=" + token})
+	wantStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), `name="token" value="`+token+`"`) {
+		t.Error("confirmation form does not carry the token")
+	}
+	if f := frequency(); f == EmailOff {
+		t.Fatal("GET unsubscribed the user")
+	}
+
+	w = e.do(Handler(UnsubscribeHandler), request{method: http.MethodPost, target: "/unsubscribe",
+		form: url.Values{"token": {token}}})
+	wantStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "unsubscribed") {
+		t.Error("confirmation page not shown")
+	}
+	if f := frequency(); f != EmailOff {
+		t.Errorf("frequency = %q after confirming, want %q", f, EmailOff)
+	}
+}
+
+func TestOneClickUnsubscribe(t *testing.T) {
+	e := newTestEnv(t)
+	user := e.addUser("alice", RoleStudent)
+	_, token, err := emailSettings(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := e.do(Handler(UnsubscribeHandler), request{method: http.MethodPost, target: "/unsubscribe?token=" + token,
+		form: url.Values{"List-Unsubscribe": {"One-Click"}}})
+	wantStatus(t, w, http.StatusOK)
+	if w.Body.Len() != 0 {
+		t.Errorf("one-click unsubscribe returned a page: %.100s", w.Body.String())
+	}
+	if f, _, _ := emailSettings(user); f != EmailOff {
+		t.Errorf("frequency = %q, want %q", f, EmailOff)
+	}
+
+	w = e.do(Handler(UnsubscribeHandler), request{method: http.MethodPost, target: "/unsubscribe?token=wrong",
+		form: url.Values{"List-Unsubscribe": {"One-Click"}}})
+	wantStatus(t, w, http.StatusNotFound)
+}
+
+func TestInboundEmailReply(t *testing.T) {
+	e := newTestEnv(t)
+	useTestMailer(MailConfig{BaseURL: "http://forum.test", ReplyDomain: "reply.forum.test", InboundSecret: "s3cret"})
+	author := e.addUser("author", RoleStudent)
+	replier := e.addUser("replier", RoleStudent)
+	post := e.addPost(author, "Question")
+
+	addr, err := replyAddress(replier, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := replyAddress(replier, post); again != addr {
+		t.Errorf("second reply address %q differs from first %q", again, addr)
+	}
+	other, _ := replyAddress(author, post)
+	if other == addr {
+		t.Error("two users were given the same reply address")
+	}
+
+	inbound := func(secret, to, text string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/email/inbound",
+			strings.NewReader(url.Values{"to": {to}, "text": {text}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if secret != "" {
+			r.Header.Set("X-Inbound-Secret", secret)
+		}
+		w := httptest.NewRecorder()
+		Handler(InboundEmailHandler).ServeHTTP(w, r)
+		return w
+	}
+	reply := "Thanks, that helps\n\nOn Mon, 2 Jun 2025 at 10:00, Forum <" + addr + "> wrote:\n> Question"
+
+	wantStatus(t, inbound("", addr, reply), http.StatusForbidden)
+	wantStatus(t, inbound("wrong", addr, reply), http.StatusForbidden)
+	wantStatus(t, inbound("s3cret", "reply+forged@reply.forum.test", reply), http.StatusNotFound)
+	wantStatus(t, inbound("s3cret", "Forum <"+addr+">", reply), http.StatusNoContent)
+
+	var content string
+	var authorID int64
+	err = db.QueryRow("SELECT content, author_id FROM comments WHERE post_id = ?", post).Scan(&content, &authorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "Thanks, that helps" || authorID != replier {
+		t.Errorf("comment %q by user %d, want %q by %d", content, authorID, "Thanks, that helps", replier)
+	}
+
+	// A muted user can't post by email either.
+	e.exec("INSERT INTO user_sanctions (user_id, kind, reason, created_by) VALUES (?, ?, 'Spam', ?)",
+		replier, SanctionMute, author)
+	wantStatus(t, inbound("s3cret", addr, "Another reply"), http.StatusForbidden)
+}
+
+func TestInboundEmailOffWithoutSecret(t *testing.T) {
+	e := newTestEnv(t)
+	useTestMailer(MailConfig{BaseURL: "http://forum.test", ReplyDomain: "reply.forum.test"})
+	author := e.addUser("author", RoleStudent)
+	addr, err := replyAddress(author, e.addPost(author, "Question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := e.do(Handler(InboundEmailHandler), request{method: http.MethodPost, target: "/email/inbound",
+		form: url.Values{"to": {addr}, "text": {"Reply"}}})
+	wantStatus(t, w, http.StatusForbidden)
+}
+
+func TestInboundEmailSurvivesNotificationFailure(t *testing.T) {
+	e := newTestEnv(t)
+	useTestMailer(MailConfig{BaseURL: "http://forum.test", ReplyDomain: "reply.forum.test", InboundSecret: "s3cret"})
+	author := e.addUser("author", RoleStudent)
+	replier := e.addUser("replier", RoleStudent)
+	post := e.addPost(author, "Question")
+	addr, err := replyAddress(replier, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakNotifications(e)
+
+	r := httptest.NewRequest(http.MethodPost, "/email/inbound",
+		strings.NewReader(url.Values{"to": {addr}, "text": {"Thanks"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Inbound-Secret", "s3cret")
+	w := httptest.NewRecorder()
+	Handler(InboundEmailHandler).ServeHTTP(w, r)
+
+	// Failing would have the webhook retry and post the reply twice.
+	wantStatus(t, w, http.StatusNoContent)
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE post_id = ?", post); n != 1 {
+		t.Errorf("%d comments saved, want 1", n)
+	}
+}
+
+func TestInboundEmailRefusesHiddenPost(t *testing.T) {
+	e := newTestEnv(t)
+	useTestMailer(MailConfig{BaseURL: "http://forum.test", ReplyDomain: "reply.forum.test", InboundSecret: "s3cret"})
+	author := e.addUser("author", RoleStudent)
+	replier := e.addUser("replier", RoleStudent)
+	post := e.addPost(author, "Question")
+	replierAddr, err := replyAddress(replier, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorAddr, err := replyAddress(author, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.exec("UPDATE posts SET is_hidden = 1 WHERE id = ?", post)
+
+	inbound := func(to string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/email/inbound",
+			strings.NewReader(url.Values{"to": {to}, "text": {"A reply"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Inbound-Secret", "s3cret")
+		w := httptest.NewRecorder()
+		Handler(InboundEmailHandler).ServeHTTP(w, r)
+		return w
+	}
+	wantStatus(t, inbound(replierAddr), http.StatusNotFound)
+	// The author can still reply to their own hidden post, as on the site.
+	wantStatus(t, inbound(authorAddr), http.StatusNoContent)
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE post_id = ?", post); n != 1 {
+		t.Errorf("%d comments saved, want 1", n)
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// EndorsePostHandler toggles the instructor endorsement on a post.
+func EndorsePostHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if !IsStaff(role) {
+		return newError(http.StatusForbidden, "Only instructors and moderators can endorse posts")
+	}
+
+	vars := mux.Vars(r)
+	postID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid post ID")
+	}
+
+	var endorsed bool
+	err = db.QueryRowContext(r.Context(), "SELECT endorsed_by IS NOT NULL FROM posts WHERE id = ?", postID).Scan(&endorsed)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	action, endorsedBy := endorsement(endorsed, userID)
+	err = auditedUpdate(userID, action, auditTarget{TargetPost, postID},
+		"UPDATE posts SET endorsed_by = ? WHERE id = ?", endorsedBy, postID)
+	if err != nil {
+		return internalError(err, "Error updating endorsement")
+	}
+	invalidatePost(postID)
+
+	http.Redirect(w, r, "/post/"+vars["id"], http.StatusSeeOther)
+	return nil
+}
+
+// EndorseCommentHandler toggles the instructor endorsement on a comment.
+func EndorseCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if !IsStaff(role) {
+		return newError(http.StatusForbidden, "Only instructors and moderators can endorse comments")
+	}
+
+	vars := mux.Vars(r)
+	commentID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid comment ID")
+	}
+
+	var postID int64
+	var endorsed bool
+	err = db.QueryRowContext(r.Context(), "SELECT post_id, endorsed_by IS NOT NULL FROM comments WHERE id = ?", commentID).
+		Scan(&postID, &endorsed)
+	if err != nil {
+		return newError(http.StatusNotFound, "Comment not found")
+	}
+
+	action, endorsedBy := endorsement(endorsed, userID)
+	err = auditedUpdate(userID, action, auditTarget{TargetComment, commentID},
+		"UPDATE comments SET endorsed_by = ? WHERE id = ?", endorsedBy, commentID)
+	if err != nil {
+		return internalError(err, "Error updating endorsement")
+	}
+	invalidateComments(postID)
+
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+	return nil
+}
+
+// endorsement returns the action toggling an endorsement by userID and the
+// new value of endorsed_by.
+func endorsement(endorsed bool, userID int64) (string, sql.NullInt64) {
+	if endorsed {
+		return ActionUnendorse, sql.NullInt64{}
+	}
+	return ActionEndorse, nullID(userID)
+}
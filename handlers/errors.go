@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// AppError is an error a handler returns to have an error page shown. The
+// message is shown to the user as is; the underlying error, if any, is only
+// ever logged.
+type AppError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error { return e.Err }
+
+// newError returns an error that shows message with the given status.
+func newError(status int, message string) error {
+	return &AppError{Status: status, Message: message}
+}
+
+// internalError wraps an unexpected error. The user sees message and an
+// error ID; err is logged under the same ID.
+func internalError(err error, message string) error {
+	return &AppError{Status: http.StatusInternalServerError, Message: message, Err: err}
+}
+
+// Handler is an HTTP handler that returns an error instead of writing one.
+// A handler that has already written its response returns nil.
+type Handler func(w http.ResponseWriter, r *http.Request) error
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := trackWrites(w)
+	if err := h(rw, r); err != nil {
+		serveError(rw, r, err)
+	}
+}
+
+// NotFoundHandler serves the 404 page for paths no route matches.
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) error {
+	return newError(http.StatusNotFound, "Page not found")
+}
+
+// MethodNotAllowedHandler serves the error page for a route requested with
+// the wrong method.
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) error {
+	return newError(http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// Recover turns a panic in a later handler into a 500 page, logging the
+// panic and its stack under the error ID shown to the user.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := trackWrites(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			serveError(rw, r, fmt.Errorf("panic: %v\n%s", v, debug.Stack()))
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ErrorPage is the page shown for a failed request.
+type ErrorPage struct {
+	Page
+	Status  int
+	Message string
+	ErrorID string
+}
+
+// StatusText is the standard name of the status, such as "Not Found".
+func (p ErrorPage) StatusText() string { return http.StatusText(p.Status) }
+
+// errorTemplates are the pages for particular statuses. Any other status
+// gets error.html.
+var errorTemplates = map[int]string{
+	http.StatusForbidden:           "403.html",
+	http.StatusNotFound:            "404.html",
+	http.StatusInternalServerError: "500.html",
+}
+
+// serveError writes the response for a handler's error. Server errors are
+// logged, and the request's ID is shown to the user so that a report of the
+// error can be matched to the log.
+func serveError(w *responseWriter, r *http.Request, err error) {
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		appErr = &AppError{Status: http.StatusInternalServerError, Message: "Something went wrong", Err: err}
+	}
+
+	var errorID string
+	if appErr.Status >= 500 {
+		log := logger(r.Context())
+		if errorID = requestID(r.Context()); errorID == "" {
+			errorID = randomID()
+			log = log.With("error_id", errorID)
+		}
+		log.Error("request failed", "method", r.Method, "path", r.URL.RequestURI(), "status", appErr.Status,
+			"error", err)
+	}
+	// Too late for an error page; all that can be done is to log it.
+	if w.wrote {
+		if errorID == "" {
+			logger(r.Context()).Warn("error after response started", "method", r.Method,
+				"path", r.URL.RequestURI(), "error", err)
+		}
+		return
+	}
+
+	switch accept := r.Header.Get("Accept"); {
+	case strings.Contains(accept, "text/html"):
+		name, ok := errorTemplates[appErr.Status]
+		if !ok {
+			name = "error.html"
+		}
+		page := ErrorPage{
+			Page:    newPage(w, r, "error", http.StatusText(appErr.Status)),
+			Status:  appErr.Status,
+			Message: appErr.Message,
+			ErrorID: errorID,
+		}
+		if render(w, name, page, appErr.Status) == nil {
+			return
+		}
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(appErr.Status)
+		json.NewEncoder(w).Encode(struct {
+			Error   string `json:"error"`
+			ErrorID string `json:"error_id,omitempty"`
+		}{appErr.Message, errorID})
+		return
+	}
+
+	message := appErr.Message
+	if errorID != "" {
+		message += " (error ID " + errorID + ")"
+	}
+	http.Error(w, message, appErr.Status)
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// responseWriter records whether anything has been written, so that an
+// error page is never appended to a response that has already started, and
+// the status and size of the response for the access log.
+type responseWriter struct {
+	http.ResponseWriter
+	wrote  bool
+	status int
+	bytes  int64
+}
+
+func trackWrites(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.wrote = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.wrote = true
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets the live event streams flush through the wrapper.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wrote {
+			w.wrote = true
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"university-forum/filter"
+)
+
+// Hold statuses stored in filter_holds.status.
+const (
+	HoldOpen     = "open"
+	HoldApproved = "approved"
+	HoldRejected = "rejected"
+)
+
+// ActionApprove is logged when a moderator publishes held content.
+const ActionApprove = "approve"
+
+const holdPageSize = 100
+
+// contentFilter checks posts and comments before they are saved. It allows
+// everything until InitFilters is called.
+var contentFilter filter.Filter = filter.Chain{}
+
+// InitFilters sets the filter new posts and comments are checked with.
+func InitFilters(f filter.Filter) {
+	contentFilter = f
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tokenStore keeps the spam classifier's word counts in spam_tokens and
+// spam_documents.
+type tokenStore struct {
+	q querier
+}
+
+// SpamTokens returns the store the spam classifier learns into from
+// moderator decisions.
+func SpamTokens(database *sql.DB) filter.TokenStore {
+	return tokenStore{database}
+}
+
+func (s tokenStore) Documents(ctx context.Context) (spam, ham int, err error) {
+	err = s.q.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE WHEN is_spam THEN documents END), 0),
+			COALESCE(SUM(CASE WHEN NOT is_spam THEN documents END), 0)
+		FROM spam_documents
+	`).Scan(&spam, &ham)
+	return spam, ham, err
+}
+
+func (s tokenStore) Counts(ctx context.Context, tokens []string) (map[string]filter.TokenCount, error) {
+	counts := make(map[string]filter.TokenCount)
+	if len(tokens) == 0 {
+		return counts, nil
+	}
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		args[i] = token
+	}
+	rows, err := s.q.QueryContext(ctx, `
+		SELECT token, spam, ham FROM spam_tokens
+		WHERE token IN (?`+strings.Repeat(", ?", len(tokens)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		var count filter.TokenCount
+		if err := rows.Scan(&token, &count.Spam, &count.Ham); err != nil {
+			return nil, err
+		}
+		counts[token] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s tokenStore) Add(ctx context.Context, tokens []string, spam bool) error {
+	_, err := s.q.ExecContext(ctx, `
+		INSERT INTO spam_documents (is_spam, documents) VALUES (?, 1)
+		ON CONFLICT (is_spam) DO UPDATE SET documents = documents + 1
+	`, spam)
+	if err != nil {
+		return err
+	}
+	column := "ham"
+	if spam {
+		column = "spam"
+	}
+	for _, token := range tokens {
+		_, err := s.q.ExecContext(ctx, `
+			INSERT INTO spam_tokens (token, `+column+`) VALUES (?, 1)
+			ON CONFLICT (token) DO UPDATE SET `+column+` = `+column+` + 1
+		`, token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecentContent returns the bodies of the posts and comments a user has
+// written since the given time, for duplicate detection.
+func RecentContent(ctx context.Context, authorID int64, since time.Time) ([]string, error) {
+	cutoff := since.UTC().Format(sqliteTime)
+	rows, err := db.QueryContext(ctx, `
+		SELECT content FROM posts WHERE author_id = ? AND created_at > ?
+		UNION ALL
+		SELECT content FROM comments WHERE author_id = ? AND created_at > ?
+	`, authorID, cutoff, authorID, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bodies []string
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, rows.Err()
+}
+
+// screenContent runs the content filter over a post or comment by userID.
+// Staff are trusted and never filtered.
+func screenContent(r *http.Request, userID int64, role, title, body string) (filter.Decision, error) {
+	if IsStaff(role) {
+		return filter.Decision{}, nil
+	}
+
+	var ageSeconds float64
+	err := db.QueryRowContext(r.Context(), "SELECT (julianday('now') - julianday(created_at)) * 86400 FROM users WHERE id = ?", userID).
+		Scan(&ageSeconds)
+	if err != nil {
+		return filter.Decision{}, err
+	}
+
+	return contentFilter.Check(r.Context(), filter.Content{
+		AuthorID:   userID,
+		AccountAge: time.Duration(ageSeconds) * time.Second,
+		Title:      title,
+		Body:       body,
+	})
+}
+
+// checkContent is screenContent for callers without a form to show the
+// rejection on, which is returned as an error instead.
+func checkContent(r *http.Request, userID int64, role, title, body string) (filter.Decision, error) {
+	decision, err := screenContent(r, userID, role, title, body)
+	if err != nil {
+		return filter.Decision{}, internalError(err, "Error checking content")
+	}
+	if decision.Verdict == filter.Reject {
+		return decision, newError(http.StatusBadRequest, rejection(decision))
+	}
+	return decision, nil
+}
+
+// rejection explains a rejected submission to its author.
+func rejection(d filter.Decision) string {
+	return "Your submission was not accepted: it " + d.Reason
+}
+
+// holdContent queues hidden content for review.
+func holdContent(tx *sql.Tx, c reportedContent, authorID int64, d filter.Decision) error {
+	_, err := tx.Exec(`
+		INSERT INTO filter_holds (post_id, comment_id, author_id, filter, reason) VALUES (?, ?, ?, ?, ?)
+	`, nullID(c.PostID), nullID(c.CommentID), authorID, d.Filter, d.Reason)
+	return err
+}
+
+// resolveHolds closes the open holds on content after a moderator has acted
+// on it some other way.
+func resolveHolds(tx *sql.Tx, c reportedContent, status string, actionID int64) error {
+	condition, contentID := c.where()
+	_, err := tx.Exec("UPDATE filter_holds SET status = ?, action_id = ? WHERE status = ? AND "+condition,
+		status, actionID, HoldOpen, contentID)
+	return err
+}
+
+// trainSpam teaches the classifier from a moderator's decision about text.
+func trainSpam(ctx context.Context, tx *sql.Tx, text string, spam bool) error {
+	return filter.Train(ctx, tokenStore{tx}, text, spam)
+}
+
+// heldContent is held content along with what is needed to train the
+// classifier on it and to announce it once approved. ThreadID is the post
+// itself or, for a comment, the post it is on.
+type heldContent struct {
+	reportedContent
+	ThreadID    int64
+	AuthorID    int64
+	Title       string
+	Content     string
+	IsAnonymous bool
+}
+
+// loadHeldContent fetches held content written by authorID.
+func loadHeldContent(ctx context.Context, c reportedContent, authorID int64) (heldContent, error) {
+	h := heldContent{reportedContent: c, AuthorID: authorID}
+	if c.CommentID != 0 {
+		err := db.QueryRowContext(ctx, "SELECT post_id, content, is_anonymous FROM comments WHERE id = ?", c.CommentID).
+			Scan(&h.ThreadID, &h.Content, &h.IsAnonymous)
+		return h, err
+	}
+	h.ThreadID = c.PostID
+	err := db.QueryRowContext(ctx, "SELECT title, content, is_anonymous FROM posts WHERE id = ?", c.PostID).
+		Scan(&h.Title, &h.Content, &h.IsAnonymous)
+	return h, err
+}
+
+// hasOpenHold reports whether content is held awaiting review.
+func hasOpenHold(ctx context.Context, c reportedContent) (bool, error) {
+	condition, contentID := c.where()
+	var held bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM filter_holds WHERE status = ? AND "+condition+")",
+		HoldOpen, contentID).Scan(&held)
+	return held, err
+}
+
+// decideHold closes the open holds on content with a moderator's decision,
+// as part of tx, and teaches the classifier from it. Approved content must
+// be announced with announce once tx commits.
+func decideHold(ctx context.Context, tx *sql.Tx, h heldContent, decision string, actionID int64) error {
+	if err := resolveHolds(tx, h.reportedContent, decision, actionID); err != nil {
+		return err
+	}
+	return trainSpam(ctx, tx, h.Title+"\n"+h.Content, decision == HoldRejected)
+}
+
+// announce notifies followers and live viewers of approved held content,
+// which was not announced when it was written.
+func (h heldContent) announce(r *http.Request) {
+	if h.CommentID != 0 {
+		logAnnounceError(r, notifyComment(h.ThreadID, h.CommentID, h.AuthorID, h.IsAnonymous, h.Content), "sending notifications")
+		logAnnounceError(r, publishComment(h.ThreadID, h.CommentID), "publishing comment")
+	} else {
+		logAnnounceError(r, notifyPost(h.PostID, h.AuthorID, h.IsAnonymous, h.Title, h.Content), "sending notifications")
+		logAnnounceError(r, publishPost(h.PostID), "publishing post")
+	}
+}
+
+// Hold is held content awaiting, or having had, a moderator's review. PostID
+// is set for held comments too, pointing at their thread.
+type Hold struct {
+	ID         int64
+	PostID     int64
+	CommentID  int64
+	Title      string
+	Content    string
+	AuthorName string
+	Filter     string
+	Reason     string
+	Status     string
+	CreatedAt  string
+	ReviewedBy string
+}
+
+// IsComment reports whether the held content is a comment.
+func (h Hold) IsComment() bool {
+	return h.CommentID != 0
+}
+
+func listHolds(status string) ([]Hold, error) {
+	rows, err := db.Query(`
+		SELECT h.id, COALESCE(p.id, c.post_id, 0), COALESCE(h.comment_id, 0),
+			COALESCE(p.title, cp.title, ''), COALESCE(p.content, c.content, a.snapshot, ''),
+			author.username, h.filter, h.reason, h.status, h.created_at, COALESCE(moderator.username, '')
+		FROM filter_holds h
+		JOIN users author ON h.author_id = author.id
+		LEFT JOIN posts p ON h.post_id = p.id
+		LEFT JOIN comments c ON h.comment_id = c.id
+		LEFT JOIN posts cp ON c.post_id = cp.id
+		LEFT JOIN moderation_actions a ON h.action_id = a.id
+		LEFT JOIN users moderator ON a.moderator_id = moderator.id
+		WHERE @status = '' OR h.status = @status
+		ORDER BY h.created_at DESC, h.id DESC
+		LIMIT @limit
+	`, sql.Named("status", status), sql.Named("limit", holdPageSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		var h Hold
+		err := rows.Scan(&h.ID, &h.PostID, &h.CommentID, &h.Title, &h.Content, &h.AuthorName, &h.Filter,
+			&h.Reason, &h.Status, &h.CreatedAt, &h.ReviewedBy)
+		if err != nil {
+			return nil, err
+		}
+		h.CreatedAt = formatDate(h.CreatedAt, "Jan 02, 2006 15:04")
+		if h.PostID == 0 {
+			h.Title = deletedContentLabel
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// HeldPage lists held content. Status is the filter from the query string:
+// empty for open holds or "all".
+type HeldPage struct {
+	Page
+	Holds  []Hold
+	Status string
+}
+
+// HeldContentHandler lists content held by the filter for moderators, open
+// holds by default or every hold with ?status=all.
+func HeldContentHandler(w http.ResponseWriter, r *http.Request) error {
+	_, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can review held content")
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = HoldOpen
+	case "all":
+		status = ""
+	}
+	holds, err := listHolds(status)
+	if err != nil {
+		return internalError(err, "Error fetching held content")
+	}
+
+	return templates.ExecuteTemplate(w, "held.html", HeldPage{
+		Page:   newPage(w, r, "held", "Held Content"),
+		Holds:  holds,
+		Status: r.URL.Query().Get("status"),
+	})
+}
+
+// DecideHoldHandler approves or rejects held content. Approving publishes it
+// and rejecting deletes it; either way the classifier learns from the
+// decision.
+func DecideHoldHandler(w http.ResponseWriter, r *http.Request) error {
+	moderatorID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can review held content")
+	}
+
+	holdID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid hold ID")
+	}
+	decision := r.FormValue("decision")
+	if decision != HoldApproved && decision != HoldRejected {
+		return newError(http.StatusBadRequest, "Invalid decision")
+	}
+
+	var c reportedContent
+	var postID, commentID sql.NullInt64
+	var authorID int64
+	err = db.QueryRowContext(r.Context(), "SELECT post_id, comment_id, author_id FROM filter_holds WHERE id = ? AND status = ?",
+		holdID, HoldOpen).Scan(&postID, &commentID, &authorID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Held content not found")
+	}
+	c.PostID, c.CommentID = postID.Int64, commentID.Int64
+
+	held, err := loadHeldContent(r.Context(), c, authorID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Held content not found")
+	}
+	snapshot := held.Content
+	if held.Title != "" {
+		snapshot = held.Title + "\n\n" + held.Content
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error reviewing held content")
+	}
+	defer tx.Rollback()
+
+	var deletedBlobs []string
+	action := ActionApprove
+	if decision == HoldRejected {
+		action = ActionDelete
+	}
+	err = audited(tx, moderatorID, action, c.auditTarget(), "", func() error {
+		var err error
+		if decision == HoldApproved {
+			err = setHidden(tx, c, false)
+		} else if c.CommentID != 0 {
+			deletedBlobs, err = deleteComment(tx, c.CommentID)
+		} else {
+			deletedBlobs, err = deletePost(tx, c.PostID)
+		}
+		return err
+	})
+	if err == nil {
+		var actionID int64
+		actionID, err = recordModeration(tx, moderatorID, action, nullID(authorID), c, "", snapshot)
+		if err == nil {
+			err = decideHold(r.Context(), tx, held, decision, actionID)
+		}
+	}
+	if err != nil {
+		return internalError(err, "Error reviewing held content")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error reviewing held content")
+	}
+	if c.CommentID != 0 {
+		invalidateComments(held.ThreadID)
+	} else {
+		invalidatePost(c.PostID)
+	}
+
+	for _, key := range deletedBlobs {
+		blobs.Delete(context.Background(), key)
+	}
+	if decision == HoldApproved {
+		held.announce(r)
+	}
+
+	http.Redirect(w, r, "/moderation/held", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestApprovedHoldShowsInCachedViews(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(author, "Held question")
+	e.exec("UPDATE posts SET is_hidden = 1 WHERE id = ?", post)
+	comment := e.addComment(post, author, "Held answer")
+	e.exec("UPDATE comments SET is_hidden = 1 WHERE id = ?", comment)
+	postHold := e.exec("INSERT INTO filter_holds (post_id, author_id, filter, reason) VALUES (?, ?, 'spam', 'Looks like spam')",
+		post, author)
+	commentHold := e.exec("INSERT INTO filter_holds (comment_id, author_id, filter, reason) VALUES (?, ?, 'spam', 'Looks like spam')",
+		comment, author)
+
+	id := strconv.FormatInt(post, 10)
+	view := func() *httptest.ResponseRecorder {
+		return e.do(Handler(ViewPostHandler), request{method: http.MethodGet, target: "/post/" + id, vars: map[string]string{"id": id}})
+	}
+	feed := func() string {
+		w := e.do(Handler(HomeHandler), request{method: http.MethodGet, target: "/"})
+		wantStatus(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+	decide := func(hold int64) {
+		t.Helper()
+		holdID := strconv.FormatInt(hold, 10)
+		w := e.do(Handler(DecideHoldHandler), request{
+			method: http.MethodPost,
+			target: "/moderation/held/" + holdID,
+			vars:   map[string]string{"id": holdID},
+			user:   moderator,
+			form:   url.Values{"decision": {HoldApproved}},
+		})
+		wantStatus(t, w, http.StatusSeeOther)
+	}
+
+	// Fill the caches while the post is held.
+	wantStatus(t, view(), http.StatusNotFound)
+	if strings.Contains(feed(), "Held question") {
+		t.Fatal("held post is listed in the feed")
+	}
+
+	decide(postHold)
+	w := view()
+	wantStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "Held answer") {
+		t.Error("held comment is shown before it is approved")
+	}
+	if !strings.Contains(feed(), "Held question") {
+		t.Error("approved post is missing from the feed")
+	}
+
+	decide(commentHold)
+	if w := view(); !strings.Contains(w.Body.String(), "Held answer") {
+		t.Error("approved comment is missing from the post")
+	}
+}
+
+func TestApproveHoldSurvivesNotificationFailure(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(author, "Question")
+	comment := e.addComment(post, author, "Held answer, @moderator")
+	e.exec("UPDATE comments SET is_hidden = 1 WHERE id = ?", comment)
+	hold := e.exec("INSERT INTO filter_holds (comment_id, author_id, filter, reason) VALUES (?, ?, 'spam', 'Looks like spam')",
+		comment, author)
+	breakNotifications(e)
+
+	holdID := strconv.FormatInt(hold, 10)
+	w := e.do(Handler(DecideHoldHandler), request{
+		method: http.MethodPost,
+		target: "/moderation/held/" + holdID,
+		vars:   map[string]string{"id": holdID},
+		user:   moderator,
+		form:   url.Values{"decision": {HoldApproved}},
+	})
+	wantStatus(t, w, http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE id = ? AND is_hidden = 0", comment); n != 1 {
+		t.Error("approved comment is still hidden")
+	}
+}
+
+func TestUnhidingHeldCommentApprovesIt(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(moderator, "Question")
+	comment := e.addComment(post, author, "Held answer")
+	e.exec("UPDATE comments SET is_hidden = 1 WHERE id = ?", comment)
+	hold := e.exec("INSERT INTO filter_holds (comment_id, author_id, filter, reason) VALUES (?, ?, 'spam', 'Looks like spam')",
+		comment, author)
+	live := e.subscribe(t, "/post/"+strconv.FormatInt(post, 10)+"/events", 0)
+
+	id := strconv.FormatInt(comment, 10)
+	w := e.do(Handler(HideCommentHandler), request{method: http.MethodPost, target: "/comment/" + id + "/hide",
+		vars: map[string]string{"id": id}, user: moderator})
+	wantStatus(t, w, http.StatusSeeOther)
+
+	if n := e.queryInt("SELECT COUNT(*) FROM filter_holds WHERE id = ? AND status = ?", hold, HoldApproved); n != 1 {
+		t.Error("hold not approved")
+	}
+	if n := e.queryInt("SELECT COALESCE(SUM(documents), 0) FROM spam_documents WHERE is_spam = 0"); n != 1 {
+		t.Errorf("classifier trained on %d ham documents, want 1", n)
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = ?", moderator, NotifyReply); n != 1 {
+		t.Errorf("post author notified %d times, want 1", n)
+	}
+	var c liveComment
+	live.next(&c)
+	if c.ID != comment {
+		t.Errorf("published comment %d, want %d", c.ID, comment)
+	}
+}
+
+func TestUnhidingModeratedCommentDoesNotTrain(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(moderator, "Question")
+	comment := e.addComment(post, author, "Hidden by a moderator")
+	e.exec("UPDATE comments SET is_hidden = 1 WHERE id = ?", comment)
+
+	id := strconv.FormatInt(comment, 10)
+	w := e.do(Handler(HideCommentHandler), request{method: http.MethodPost, target: "/comment/" + id + "/hide",
+		vars: map[string]string{"id": id}, user: moderator})
+	wantStatus(t, w, http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE id = ? AND is_hidden = 0", comment); n != 1 {
+		t.Error("comment still hidden")
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM spam_documents"); n != 0 {
+		t.Error("classifier trained on content that was never held")
+	}
+}
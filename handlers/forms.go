@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Flash kinds, named after the alert styles the layout shows them in.
+const (
+	FlashSuccess = "success"
+	FlashInfo    = "info"
+	FlashError   = "danger"
+)
+
+// Flash is a one-off message stored in the session by one request and shown
+// on the next page the user sees, typically after a redirect.
+type Flash struct {
+	Kind    string
+	Message string
+}
+
+func init() {
+	// Session values are gob encoded, so types stored in them must be
+	// registered.
+	gob.Register(Flash{})
+}
+
+// addFlash queues a message for the next page the user sees. Like any
+// session change it must be made before anything is written to w.
+func addFlash(w http.ResponseWriter, r *http.Request, kind, message string) {
+	session, _ := store.Get(r, "session-name")
+	session.AddFlash(Flash{Kind: kind, Message: message})
+	session.Save(r, w)
+}
+
+// formError is the key of an error about the form as a whole rather than
+// one of its fields.
+const formError = ""
+
+// Form holds the values submitted in a form and any problems found with
+// them, so that the form can be shown again with what the user typed and an
+// error next to each field that needs fixing.
+type Form struct {
+	Values url.Values
+	Errors map[string]string
+}
+
+// newForm copies the named fields from the submitted form. Only those fields
+// are ever shown back to the user, so passwords should not be among them.
+func newForm(r *http.Request, fields ...string) Form {
+	f := Form{Values: url.Values{}}
+	for _, field := range fields {
+		f.Values.Set(field, strings.TrimSpace(r.FormValue(field)))
+	}
+	return f
+}
+
+// Get returns the submitted value of field.
+func (f Form) Get(field string) string { return f.Values.Get(field) }
+
+// Checked reports whether the checkbox field was ticked.
+func (f Form) Checked(field string) bool { return f.Values.Get(field) == "on" }
+
+// Error returns the problem with field, if any. The empty field name gives
+// the error about the form as a whole.
+func (f Form) Error(field string) string { return f.Errors[field] }
+
+// Valid reports whether no errors have been recorded.
+func (f Form) Valid() bool { return len(f.Errors) == 0 }
+
+// Fail records message as the problem with field, keeping the first problem
+// found if there is more than one.
+func (f *Form) Fail(field, message string) {
+	if f.Errors == nil {
+		f.Errors = map[string]string{}
+	}
+	if _, ok := f.Errors[field]; !ok {
+		f.Errors[field] = message
+	}
+}
+
+// Required fails every named field that was left empty.
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		if f.Get(field) == "" {
+			f.Fail(field, "This field is required")
+		}
+	}
+}
+
+// MaxLength fails field if it is longer than n characters.
+func (f *Form) MaxLength(field string, n int) {
+	if utf8.RuneCountInString(f.Get(field)) > n {
+		f.Fail(field, fmt.Sprintf("Must be at most %d characters", n))
+	}
+}
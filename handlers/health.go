@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the readiness checks so a wedged database fails the
+// probe instead of hanging it.
+const readyTimeout = 2 * time.Second
+
+// HealthHandler reports that the process is up and serving. It checks
+// nothing else, so a liveness probe doesn't restart the forum just because
+// the database is briefly unavailable.
+func HealthHandler(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+// ReadyHandler reports whether the forum can serve traffic: the database
+// must answer and have every migration applied.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return &AppError{Status: http.StatusServiceUnavailable, Message: "Database unavailable", Err: err}
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return &AppError{Status: http.StatusServiceUnavailable, Message: "Database unavailable", Err: err}
+	}
+	if version < len(migrations) {
+		return newError(http.StatusServiceUnavailable,
+			fmt.Sprintf("Database schema out of date: %d of %d migrations applied", version, len(migrations)))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ready")
+	return nil
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	_ "github.com/mattn/go-sqlite3"
+
+	"university-forum/filter"
+	"university-forum/mailer"
+	"university-forum/sqlite"
+	"university-forum/storage"
+	"university-forum/views"
+)
+
+// baseTables are the tables main.go creates before migrating.
+var baseTables = []string{
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		email TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE posts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		content TEXT NOT NULL,
+		author_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (author_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		content TEXT NOT NULL,
+		post_id INTEGER NOT NULL,
+		author_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (post_id) REFERENCES posts(id),
+		FOREIGN KEY (author_id) REFERENCES users(id)
+	)`,
+}
+
+// testEnv is a forum with a fresh database for one test. The handlers keep
+// their services in package variables, so tests using it can't run in
+// parallel.
+type testEnv struct {
+	t   testing.TB
+	dir string
+}
+
+// openBaseDB opens a new database in dir holding just the base tables.
+func openBaseDB(t testing.TB, dir string) *sqlite.DB {
+	t.Helper()
+	database, err := sqlite.Open("sqlite3", filepath.Join(dir, "forum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	for _, query := range baseTables {
+		if _, err := database.Write.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return database
+}
+
+func newTestEnv(t testing.TB) *testEnv {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	dir := t.TempDir()
+
+	database := openBaseDB(t, dir)
+	if err := Migrate(database.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer, err := views.New(os.DirFS("../templates"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitHandlers(database.Read, database.Write, sessions.NewCookieStore([]byte("test-session-key")), renderer)
+	InitStorage(storage.NewLocalStore(filepath.Join(dir, "uploads")))
+	InitMail(mailer.NewFileMailer(filepath.Join(dir, "mail"), "forum@example.edu"), MailConfig{BaseURL: "http://forum.test"})
+	InitCache(100, time.Minute)
+	InitFilters(filter.Chain{})
+	return &testEnv{t: t, dir: dir}
+}
+
+// exec runs a statement on the database and returns the ID of the row it
+// inserted, if any.
+func (e *testEnv) exec(query string, args ...interface{}) int64 {
+	e.t.Helper()
+	result, err := writeDB.Exec(query, args...)
+	if err != nil {
+		e.t.Fatalf("%s: %v", query, err)
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+// queryInt returns the single integer a query selects.
+func (e *testEnv) queryInt(query string, args ...interface{}) int {
+	e.t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		e.t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func (e *testEnv) addUser(name, role string) int64 {
+	e.t.Helper()
+	return e.exec("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, '!', ?)",
+		name, name+"@example.edu", role)
+}
+
+func (e *testEnv) addPost(authorID int64, title string) int64 {
+	e.t.Helper()
+	return e.exec("INSERT INTO posts (title, content, author_id) VALUES (?, 'Body', ?)", title, authorID)
+}
+
+func (e *testEnv) addComment(postID, authorID int64, content string) int64 {
+	e.t.Helper()
+	return e.exec("INSERT INTO comments (content, post_id, author_id) VALUES (?, ?, ?)", content, postID, authorID)
+}
+
+// sessionCookies returns the cookies of a session logged in as userID.
+func sessionCookies(t testing.TB, userID int64) []*http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(r, "session-name")
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = userID
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+// request is a request to make of a single handler.
+type request struct {
+	method string
+	target string
+	vars   map[string]string // route variables, as mux would set them
+	user   int64             // logged-in user, or 0 for a guest
+	form   url.Values
+	// body and contentType are sent instead of form when set.
+	body        io.Reader
+	contentType string
+}
+
+// do serves req with h, behind the middleware the router puts in front of
+// every handler, returning the response. The CSRF check is left out, so
+// forms can be posted without first loading the page; csrf_test.go covers
+// it.
+func (e *testEnv) do(h Handler, req request) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var body io.Reader
+	if req.form != nil {
+		body = strings.NewReader(req.form.Encode())
+	}
+	contentType := "application/x-www-form-urlencoded"
+	if req.body != nil {
+		body, contentType = req.body, req.contentType
+	}
+	r := httptest.NewRequest(req.method, req.target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if req.user != 0 {
+		for _, c := range sessionCookies(e.t, req.user) {
+			r.AddCookie(c)
+		}
+	}
+	r = mux.SetURLVars(r, req.vars)
+	w := httptest.NewRecorder()
+	Observe(SanctionMiddleware(h)).ServeHTTP(w, r)
+	return w
+}
+
+// wantStatus fails the test unless w has the given status.
+func wantStatus(t testing.TB, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body: %.300s", w.Code, status, w.Body.String())
+	}
+}
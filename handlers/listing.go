@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const postsPerPage = 20
+
+// Pagination describes where a page sits in a paginated listing.
+type Pagination struct {
+	Total      int
+	Page       int
+	TotalPages int
+	PrevPage   int
+	NextPage   int
+}
+
+func (p Pagination) HasPrev() bool { return p.Page > 1 }
+func (p Pagination) HasNext() bool { return p.Page < p.TotalPages }
+
+// pageParam reads the 1-based "page" query parameter, defaulting to 1.
+func pageParam(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func newPagination(page, total, perPage int) Pagination {
+	totalPages := (total + perPage - 1) / perPage
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	return Pagination{
+		Total:      total,
+		Page:       page,
+		TotalPages: totalPages,
+		PrevPage:   page - 1,
+		NextPage:   page + 1,
+	}
+}
+
+// listPosts returns one page of post previews matching the given FROM/WHERE
+// clause, which may refer to posts as p and their authors as u. Arguments
+// must be named (sql.Named) since the author columns bind @staff and @viewer.
+func listPosts(viewerID int64, role, clause string, page int, args ...interface{}) ([]Post, Pagination, error) {
+	clause, args = withoutHidden(clause, role, args)
+	var total int
+	err := queryRowPrepared(context.Background(), "SELECT COUNT(DISTINCT p.id) "+clause, args...).Scan(&total)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+
+	posts, err := queryPosts(viewerID, role, clause, "p.created_at DESC", postsPerPage, (page-1)*postsPerPage, args...)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	return posts, newPagination(page, total, postsPerPage), nil
+}
+
+// pinnedPosts returns every pinned post matching clause, announcements first
+// and then the most recently pinned.
+func pinnedPosts(viewerID int64, role, clause string, args ...interface{}) ([]Post, error) {
+	clause, args = withoutHidden(clause, role, args)
+	return queryPosts(viewerID, role, clause, "p.is_announcement DESC, p.pinned_at DESC", -1, 0, args...)
+}
+
+// withoutHidden extends a post clause ending in a WHERE condition to leave
+// out hidden posts unless the viewer is a moderator.
+func withoutHidden(clause, role string, args []interface{}) (string, []interface{}) {
+	clause += " AND (p.is_hidden = 0 OR @moderator)"
+	return clause, append(args, sql.Named("moderator", IsModerator(role)))
+}
+
+func queryPosts(viewerID int64, role, clause, order string, limit, offset int, args ...interface{}) ([]Post, error) {
+	args = append(args, viewerArgs(viewerID, role)...)
+	args = append(args, sql.Named("limit", limit), sql.Named("offset", offset))
+	rows, err := queryPrepared(context.Background(), `
+		SELECT DISTINCT p.id, p.title, p.content, `+visibleAuthor("p")+`, p.created_at, p.is_anonymous,
+			COALESCE((SELECT name FROM categories WHERE id = p.category_id), ''),
+			COALESCE((SELECT slug FROM categories WHERE id = p.category_id), ''),
+			p.pin_scope, p.is_locked, p.is_announcement, p.is_hidden, p.author_id, u.username
+		`+clause+`
+		ORDER BY `+order+`
+		LIMIT @limit OFFSET @offset
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.AuthorID, &p.AuthorName, &p.CreatedAt, &p.IsAnonymous,
+			&p.Category, &p.CategorySlug, &p.PinScope, &p.IsLocked, &p.IsAnnouncement, &p.IsHidden,
+			&p.authorID, &p.authorName)
+		if err != nil {
+			return nil, err
+		}
+
+		p.CreatedAt = formatDate(p.CreatedAt, "Jan 02, 2006 at 3:04 PM")
+
+		// Truncate content for preview
+		if len(p.Content) > 150 {
+			p.Content = p.Content[:150] + "..."
+		}
+
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range posts {
+		posts[i].Tags, err = postTags(posts[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return posts, nil
+}
+
+// formatDate reformats a stored timestamp for display. The SQLite driver
+// returns DATETIME columns as RFC 3339, but values produced by expressions
+// come back in SQLite's own format, so both are accepted.
+func formatDate(value, layout string) string {
+	for _, format := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.Format(layout)
+		}
+	}
+	return value
+}
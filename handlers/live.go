@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"university-forum/events"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	feedTopic        = "feed"
+	eventTypePost    = "post"
+	eventTypeComment = "comment"
+	eventPing        = 30 * time.Second
+	eventRetry       = 5 * time.Second
+	// eventWriteTimeout is how long a stream waits on a client that has
+	// stopped reading.
+	eventWriteTimeout = 10 * time.Second
+)
+
+var hub = events.NewHub()
+
+// streamsClosed is closed when the server starts shutting down, to end the
+// live event streams. Clients reconnect after eventRetry, by which time a
+// new server should be listening.
+var (
+	streamsClosed = make(chan struct{})
+	closeStreams  sync.Once
+)
+
+// CloseStreams ends every live event stream, now and in future.
+func CloseStreams() {
+	closeStreams.Do(func() { close(streamsClosed) })
+}
+
+// livePost is the feed event for a new post. It carries no author, so
+// anonymous posts need no masking.
+type livePost struct {
+	ID       int64  `json:"id"`
+	Title    string `json:"title"`
+	Category string `json:"category,omitempty"`
+}
+
+// liveComment is the thread event for a new comment. Author fields are only
+// sent once they have been masked for the receiving viewer.
+type liveComment struct {
+	ID          int64         `json:"id"`
+	Content     string        `json:"content"`
+	ContentHTML template.HTML `json:"contentHtml"`
+	AuthorID    int64         `json:"authorId"`
+	AuthorName  string        `json:"authorName"`
+	IsAnonymous bool          `json:"isAnonymous"`
+	CreatedAt   string        `json:"createdAt"`
+}
+
+// visibleTo returns the comment as viewerID sees it, hiding an anonymous
+// author from other students the same way visibleAuthor does in queries.
+func (c liveComment) visibleTo(viewerID int64, role string) liveComment {
+	if c.IsAnonymous && !IsStaff(role) && c.AuthorID != viewerID {
+		c.AuthorID = 0
+		c.AuthorName = AnonymousAuthor
+	}
+	return c
+}
+
+func commentTopic(postID int64) string {
+	return "post:" + strconv.FormatInt(postID, 10)
+}
+
+// publishPost tells feed subscribers about a new post.
+func publishPost(postID int64) error {
+	var p livePost
+	err := db.QueryRow(`
+		SELECT p.id, p.title, COALESCE(c.slug, '')
+		FROM posts p
+		LEFT JOIN categories c ON p.category_id = c.id
+		WHERE p.id = ?
+	`, postID).Scan(&p.ID, &p.Title, &p.Category)
+	if err != nil {
+		return err
+	}
+	hub.Publish(feedTopic, events.Event{Type: eventTypePost, Data: p})
+	return nil
+}
+
+// publishComment tells the viewers of a thread about a new comment.
+func publishComment(postID, commentID int64) error {
+	var c liveComment
+	err := db.QueryRow(`
+		SELECT c.id, c.content, c.author_id, u.username, c.is_anonymous, c.created_at
+		FROM comments c
+		JOIN users u ON c.author_id = u.id
+		WHERE c.id = ?
+	`, commentID).Scan(&c.ID, &c.Content, &c.AuthorID, &c.AuthorName, &c.IsAnonymous, &c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	c.ContentHTML = linkMentions(c.Content)
+	c.CreatedAt = formatDate(c.CreatedAt, "Jan 02, 2006 15:04")
+	hub.Publish(commentTopic(postID), events.Event{Type: eventTypeComment, Data: c})
+	return nil
+}
+
+// streamEvents sends the events published on topic to the client as
+// Server-Sent Events until it disconnects. filter, if set, rewrites each event
+// for this client or drops it by returning false.
+func streamEvents(w http.ResponseWriter, r *http.Request, topic string, filter func(events.Event) (events.Event, bool)) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return newError(http.StatusInternalServerError, "Streaming not supported")
+	}
+
+	ch, unsubscribe := hub.Subscribe(topic)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	flusher.Flush()
+
+	ping := time.NewTicker(eventPing)
+	defer ping.Stop()
+
+	// Streams outlive the server's write timeout, so each write gets its
+	// own deadline instead.
+	rc := http.NewResponseController(w)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-streamsClosed:
+			return nil
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-ch:
+			if filter != nil {
+				if e, ok = filter(e); !ok {
+					continue
+				}
+			}
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		flusher.Flush()
+	}
+}
+
+// PostEventsHandler streams new comments on a post.
+func PostEventsHandler(w http.ResponseWriter, r *http.Request) error {
+	postID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid post ID")
+	}
+	viewerID, role := currentUser(r)
+	if !canViewPost(postID, viewerID, role) {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	return streamEvents(w, r, commentTopic(postID), func(e events.Event) (events.Event, bool) {
+		if c, ok := e.Data.(liveComment); ok {
+			e.Data = c.visibleTo(viewerID, role)
+		}
+		return e, true
+	})
+}
+
+// FeedEventsHandler streams new posts, optionally only those in the category
+// given by the "category" query parameter.
+func FeedEventsHandler(w http.ResponseWriter, r *http.Request) error {
+	category := r.URL.Query().Get("category")
+	return streamEvents(w, r, feedTopic, func(e events.Event) (events.Event, bool) {
+		if p, ok := e.Data.(livePost); ok && category != "" {
+			return e, p.Category == category
+		}
+		return e, true
+	})
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"university-forum/filter"
+)
+
+// eventStream is a client's connection to an event stream.
+type eventStream struct {
+	t      *testing.T
+	events chan sentEvent
+}
+
+// sentEvent is an event as read off the wire.
+type sentEvent struct {
+	Type string
+	Data string
+}
+
+// openStream requests the event stream at target as user (0 for a guest)
+// from a real server, since a stream that starts never returns. The stream
+// ends with the test.
+func (e *testEnv) openStream(t *testing.T, target string, user int64) *http.Response {
+	t.Helper()
+	router := mux.NewRouter()
+	router.Handle("/post/{id:[0-9]+}/events", Handler(PostEventsHandler))
+	router.Handle("/events/feed", Handler(FeedEventsHandler))
+	srv := httptest.NewServer(Observe(SanctionMiddleware(router)))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel) // runs before srv.Close, ending the stream
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != 0 {
+		for _, c := range sessionCookies(t, user) {
+			req.AddCookie(c)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// subscribe connects to the event stream at target as user and returns once
+// the stream has started, so events published from then on reach it.
+func (e *testEnv) subscribe(t *testing.T, target string, user int64) *eventStream {
+	t.Helper()
+	resp := e.openStream(t, target, user)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("%s: status = %d, want 200", target, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	s := &eventStream{t: t, events: make(chan sentEvent, 16)}
+	started := make(chan struct{})
+	go func() {
+		defer resp.Body.Close()
+		defer close(s.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sentEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "retry: "):
+				close(started)
+			case strings.HasPrefix(line, "event: "):
+				ev.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.Data = strings.TrimPrefix(line, "data: ")
+			case line == "" && ev.Type != "":
+				s.events <- ev
+				ev = sentEvent{}
+			}
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start")
+	}
+	return s
+}
+
+// next returns the next event on the stream, decoding its data into v.
+func (s *eventStream) next(v interface{}) string {
+	s.t.Helper()
+	select {
+	case ev, ok := <-s.events:
+		if !ok {
+			s.t.Fatal("stream ended")
+		}
+		if err := json.Unmarshal([]byte(ev.Data), v); err != nil {
+			s.t.Fatalf("event %s: %v", ev.Type, err)
+		}
+		return ev.Type
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no event received")
+	}
+	return ""
+}
+
+// wantNone fails the test if an event arrives on the stream shortly.
+func (s *eventStream) wantNone() {
+	s.t.Helper()
+	select {
+	case ev := <-s.events:
+		s.t.Errorf("unexpected %s event: %s", ev.Type, ev.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPostEventsStreamNewComments(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	commenter := e.addUser("commenter", RoleStudent)
+	classmate := e.addUser("classmate", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(author, "Question")
+	id := strconv.FormatInt(post, 10)
+
+	student := e.subscribe(t, "/post/"+id+"/events", classmate)
+	staff := e.subscribe(t, "/post/"+id+"/events", moderator)
+	self := e.subscribe(t, "/post/"+id+"/events", commenter)
+
+	w := e.do(Handler(AddCommentHandler), request{
+		method: http.MethodPost,
+		target: "/post/" + id + "/comment",
+		vars:   map[string]string{"id": id},
+		user:   commenter,
+		form:   url.Values{"content": {"Ask @author"}, "anonymous": {"on"}},
+	})
+	wantStatus(t, w, http.StatusSeeOther)
+
+	var c liveComment
+	if typ := student.next(&c); typ != eventTypeComment {
+		t.Fatalf("event type = %q, want %q", typ, eventTypeComment)
+	}
+	if c.Content != "Ask @author" || !strings.Contains(string(c.ContentHTML), `href="/user/author"`) {
+		t.Errorf("comment = %q, HTML %q", c.Content, c.ContentHTML)
+	}
+	if c.AuthorID != 0 || c.AuthorName != AnonymousAuthor {
+		t.Errorf("classmate saw author %d %q, want it hidden", c.AuthorID, c.AuthorName)
+	}
+	for name, s := range map[string]*eventStream{"moderator": staff, "commenter": self} {
+		var c liveComment
+		s.next(&c)
+		if c.AuthorID != commenter || c.AuthorName != "commenter" {
+			t.Errorf("%s saw author %d %q, want the commenter", name, c.AuthorID, c.AuthorName)
+		}
+	}
+}
+
+func TestPostEventsSkipHeldComments(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	post := e.addPost(author, "Question")
+	id := strconv.FormatInt(post, 10)
+	InitFilters(filter.Chain{filter.WordList{Hold: []string{"review"}}})
+
+	s := e.subscribe(t, "/post/"+id+"/events", 0)
+	w := e.do(Handler(AddCommentHandler), request{
+		method: http.MethodPost,
+		target: "/post/" + id + "/comment",
+		vars:   map[string]string{"id": id},
+		user:   author,
+		form:   url.Values{"content": {"Held for review"}},
+	})
+	wantStatus(t, w, http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE post_id = ? AND is_hidden = 1", post); n != 1 {
+		t.Fatalf("%d held comments, want 1", n)
+	}
+	s.wantNone()
+}
+
+func TestPostEventsUnknownPost(t *testing.T) {
+	e := newTestEnv(t)
+	w := e.do(Handler(PostEventsHandler), request{
+		method: http.MethodGet,
+		target: "/post/99/events",
+		vars:   map[string]string{"id": "99"},
+	})
+	wantStatus(t, w, http.StatusNotFound)
+}
+
+func TestPostEventsHiddenPost(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	classmate := e.addUser("classmate", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(author, "Held for review")
+	e.exec("UPDATE posts SET is_hidden = 1 WHERE id = ?", post)
+	id := strconv.FormatInt(post, 10)
+
+	for _, user := range []int64{0, classmate} {
+		resp := e.openStream(t, "/post/"+id+"/events", user)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("user %d: status = %d, want 404", user, resp.StatusCode)
+		}
+	}
+
+	// The author and moderators can still see the post, so they can follow it.
+	for _, user := range []int64{author, moderator} {
+		s := e.subscribe(t, "/post/"+id+"/events", user)
+		if err := publishComment(post, e.addComment(post, author, "Still here")); err != nil {
+			t.Fatal(err)
+		}
+		var c liveComment
+		s.next(&c)
+	}
+}
+
+func TestFeedEventsFilterByCategory(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	maths := e.exec("INSERT INTO categories (name, slug) VALUES ('Maths', 'maths')")
+	physics := e.exec("INSERT INTO categories (name, slug) VALUES ('Physics', 'physics')")
+
+	all := e.subscribe(t, "/events/feed", 0)
+	mathsOnly := e.subscribe(t, "/events/feed?category=maths", 0)
+
+	physicsPost := e.addPost(author, "Forces")
+	e.exec("UPDATE posts SET category_id = ? WHERE id = ?", physics, physicsPost)
+	mathsPost := e.addPost(author, "Limits")
+	e.exec("UPDATE posts SET category_id = ? WHERE id = ?", maths, mathsPost)
+	for _, id := range []int64{physicsPost, mathsPost} {
+		if err := publishPost(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []int64{physicsPost, mathsPost} {
+		var p livePost
+		if typ := all.next(&p); typ != eventTypePost || p.ID != want {
+			t.Errorf("feed got %s %d, want post %d", typ, p.ID, want)
+		}
+	}
+	var p livePost
+	mathsOnly.next(&p)
+	if p.ID != mathsPost || p.Category != "maths" {
+		t.Errorf("maths feed got post %d in %q, want post %d", p.ID, p.Category, mathsPost)
+	}
+	mathsOnly.wantNone()
+}
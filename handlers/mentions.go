@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxMentions           = 20
+	maxMentionSuggestions = 10
+)
+
+// mentionPattern matches @username where the @ does not follow a word
+// character, so email addresses are not treated as mentions.
+var mentionPattern = regexp.MustCompile(`\B@(\w[\w.-]*\w|\w)`)
+
+// MentionSuggestion is a user offered by the @mention autocomplete.
+type MentionSuggestion struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// mentionable is a condition on users aliased u: they may be mentioned by the
+// user bound to @other in the course bound to @category. Users who have
+// blocked or been blocked by the author are excluded, and in a course only
+// its members and staff can be mentioned. @category is NULL for posts
+// outside any course.
+func mentionable() string {
+	return notBlocked("u") + fmt.Sprintf(` AND (@category IS NULL
+		OR u.role IN ('%s', '%s', '%s')
+		OR EXISTS (SELECT 1 FROM category_members m WHERE m.category_id = @category AND m.user_id = u.id))`,
+		RoleInstructor, RoleModerator, RoleAdmin)
+}
+
+// mentionedUsers returns the IDs of the users @mentioned in text who may be
+// mentioned by authorID on the given post.
+func mentionedUsers(text string, authorID, postID int64) ([]int64, error) {
+	matches := mentionPattern.FindAllStringSubmatch(text, maxMentions)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	var categoryID sql.NullInt64
+	if err := db.QueryRow("SELECT category_id FROM posts WHERE id = ?", postID).Scan(&categoryID); err != nil {
+		return nil, err
+	}
+
+	placeholders := make([]string, len(matches))
+	args := []interface{}{sql.Named("other", authorID), sql.Named("category", categoryID)}
+	for i, m := range matches {
+		name := "u" + strconv.Itoa(i)
+		placeholders[i] = "@" + name
+		args = append(args, sql.Named(name, m[1]))
+	}
+	rows, err := db.Query(`
+		SELECT u.id FROM users u
+		WHERE u.username IN (`+strings.Join(placeholders, ", ")+`) AND `+mentionable(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// linkMentions escapes text for HTML and links each @username in it to that
+// user's profile.
+func linkMentions(text string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		name := text[m[2]:m[3]]
+		b.WriteString(html.EscapeString(text[last:m[0]]))
+		fmt.Fprintf(&b, `<a href="/user/%s" class="mention">@%s</a>`,
+			html.EscapeString(url.PathEscape(name)), html.EscapeString(name))
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// ContentHTML is the post body with @mentions linked.
+func (p Post) ContentHTML() template.HTML {
+	return linkMentions(p.Content)
+}
+
+// ContentHTML is the comment body with @mentions linked.
+func (c Comment) ContentHTML() template.HTML {
+	return linkMentions(c.Content)
+}
+
+// likePrefix returns a LIKE pattern for strings starting with prefix, taken
+// literally: the wildcards _ (which usernames may contain) and % are escaped
+// with \, so the pattern must be used with ESCAPE '\'.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// MentionAutocompleteHandler suggests users to @mention whose usernames start
+// with the "q" query parameter. Passing "post" (a post ID) or "category" (a
+// slug) limits suggestions to the users who can be mentioned there.
+func MentionAutocompleteHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	query := r.URL.Query()
+	var categoryID sql.NullInt64
+	if postID, err := strconv.ParseInt(query.Get("post"), 10, 64); err == nil {
+		if err := db.QueryRowContext(r.Context(), "SELECT category_id FROM posts WHERE id = ?", postID).Scan(&categoryID); err != nil {
+			return newError(http.StatusNotFound, "Post not found")
+		}
+	} else if slug := query.Get("category"); slug != "" {
+		category, err := categoryBySlug(slug, userID)
+		if err != nil {
+			return newError(http.StatusNotFound, "Category not found")
+		}
+		categoryID = sql.NullInt64{Int64: category.ID, Valid: true}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT u.username, COALESCE(pr.display_name, '')
+		FROM users u
+		LEFT JOIN user_profiles pr ON pr.user_id = u.id
+		WHERE u.username LIKE @prefix ESCAPE '\' AND u.id != @other AND `+mentionable()+`
+		ORDER BY u.username
+		LIMIT @limit
+	`, sql.Named("prefix", likePrefix(strings.TrimPrefix(query.Get("q"), "@"))), sql.Named("other", userID),
+		sql.Named("category", categoryID), sql.Named("limit", maxMentionSuggestions))
+	if err != nil {
+		return internalError(err, "Error fetching users")
+	}
+	defer rows.Close()
+
+	suggestions := []MentionSuggestion{}
+	for rows.Next() {
+		var s MentionSuggestion
+		if err := rows.Scan(&s.Username, &s.DisplayName); err != nil {
+			return internalError(err, "Error fetching users")
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+	return nil
+}
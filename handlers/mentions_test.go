@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMentionAutocompleteMatchesPrefixLiterally(t *testing.T) {
+	e := newTestEnv(t)
+	viewer := e.addUser("viewer", RoleStudent)
+	for _, name := range []string{"a_b", "axb", "a_c", "abc", `a\b`} {
+		e.addUser(name, RoleStudent)
+	}
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"a_", []string{"a_b", "a_c"}},
+		{"@a_b", []string{"a_b"}},
+		{"a%", []string{}},
+		{"%", []string{}},
+		{`a\`, []string{`a\b`}},
+		{"ab", []string{"abc"}},
+	}
+	for _, tt := range tests {
+		w := e.do(Handler(MentionAutocompleteHandler), request{
+			method: http.MethodGet,
+			target: "/users/autocomplete?" + url.Values{"q": {tt.q}}.Encode(),
+			user:   viewer,
+		})
+		wantStatus(t, w, http.StatusOK)
+		var suggestions []MentionSuggestion
+		if err := json.NewDecoder(w.Body).Decode(&suggestions); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, s := range suggestions {
+			got = append(got, s.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("q=%q: suggested %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxConversationMembers caps group conversations, including the sender.
+	maxConversationMembers = 8
+	maxMessageLength       = 5000
+	minJustificationLength = 20
+)
+
+// moderatorAccessWindow is how long a moderator may read a conversation
+// after recording why they need to.
+const moderatorAccessWindow = "-1 hour"
+
+// conversationAccess is how a viewer may see a conversation.
+type conversationAccess int
+
+const (
+	noAccess conversationAccess = iota
+	memberAccess
+	moderatorAccess
+)
+
+// Conversation is an entry in a user's inbox.
+type Conversation struct {
+	ID          int64
+	Subject     string
+	Members     string
+	LastMessage string
+	LastSender  string
+	UpdatedAt   string
+	Unread      int
+}
+
+// Message is a direct message in a conversation.
+type Message struct {
+	ID          int64
+	SenderID    int64
+	SenderName  string
+	Content     string
+	CreatedAt   string
+	Attachments []Attachment
+}
+
+// ContentHTML is the message body with @mentions linked.
+func (m Message) ContentHTML() template.HTML {
+	return linkMentions(m.Content)
+}
+
+// conversationAccessFor reports how a viewer may see a conversation: as a
+// member, or as a moderator who has recently recorded a justification for
+// reading it.
+func conversationAccessFor(conversationID, viewerID int64, role string) (conversationAccess, error) {
+	if viewerID == 0 {
+		return noAccess, nil
+	}
+
+	var isMember bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ?)
+	`, conversationID, viewerID).Scan(&isMember)
+	if err != nil {
+		return noAccess, err
+	}
+	if isMember {
+		return memberAccess, nil
+	}
+	if !IsModerator(role) {
+		return noAccess, nil
+	}
+
+	var granted bool
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM conversation_access_log
+			WHERE conversation_id = ? AND moderator_id = ? AND created_at >= datetime('now', ?)
+		)
+	`, conversationID, viewerID, moderatorAccessWindow).Scan(&granted)
+	if err != nil || !granted {
+		return noAccess, err
+	}
+	return moderatorAccess, nil
+}
+
+// unreadMessages returns how many messages from others a user has not read.
+func unreadMessages(userID int64) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM conversation_members cm
+		JOIN messages m ON m.conversation_id = cm.conversation_id
+		WHERE cm.user_id = ? AND m.id > cm.last_read_id AND m.sender_id != cm.user_id
+	`, userID).Scan(&count)
+	return count, err
+}
+
+func listConversations(userID int64) ([]Conversation, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.subject,
+			COALESCE((SELECT GROUP_CONCAT(u.username, ', ')
+				FROM conversation_members om
+				JOIN users u ON om.user_id = u.id
+				WHERE om.conversation_id = c.id AND om.user_id != cm.user_id), ''),
+			lm.content, lu.username, lm.created_at,
+			(SELECT COUNT(*) FROM messages m
+				WHERE m.conversation_id = c.id AND m.id > cm.last_read_id AND m.sender_id != cm.user_id)
+		FROM conversation_members cm
+		JOIN conversations c ON cm.conversation_id = c.id
+		JOIN messages lm ON lm.id = (SELECT MAX(id) FROM messages WHERE conversation_id = c.id)
+		JOIN users lu ON lm.sender_id = lu.id
+		WHERE cm.user_id = ?
+		ORDER BY lm.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var c Conversation
+		err := rows.Scan(&c.ID, &c.Subject, &c.Members, &c.LastMessage, &c.LastSender, &c.UpdatedAt, &c.Unread)
+		if err != nil {
+			return nil, err
+		}
+		c.UpdatedAt = formatDate(c.UpdatedAt, "Jan 02, 2006 15:04")
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// blockedUsers returns the usernames a user has blocked.
+func blockedUsers(userID int64) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT u.username FROM user_blocks b
+		JOIN users u ON b.blocked_id = u.id
+		WHERE b.blocker_id = ?
+		ORDER BY u.username
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// messageRecipients resolves the usernames in a comma or space separated list
+// to user IDs. The sender, unknown users and anyone on either side of a block
+// with the sender are refused with a problem to show the user.
+func messageRecipients(list string, senderID int64) (ids []int64, problem string, err error) {
+	seen := map[string]bool{}
+	for _, name := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name = strings.TrimPrefix(name, "@")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var id int64
+		var blocked bool
+		err := db.QueryRow(`
+			SELECT u.id, NOT (`+notBlocked("u")+`)
+			FROM users u WHERE u.username = @name
+		`, sql.Named("other", senderID), sql.Named("name", name)).Scan(&id, &blocked)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Sprintf("There is no user called %s", name), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if id == senderID {
+			return nil, "You can't send a message to yourself", nil
+		}
+		if blocked {
+			return nil, fmt.Sprintf("You can't message %s", name), nil
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return nil, "Choose at least one recipient", nil
+	}
+	if len(ids)+1 > maxConversationMembers {
+		return nil, fmt.Sprintf("Group conversations are limited to %d people", maxConversationMembers), nil
+	}
+	return ids, "", nil
+}
+
+// conversationWith returns the conversation userID should use to message
+// recipients: their existing one-to-one conversation when there is a single
+// recipient, and otherwise a new conversation with the given subject.
+func conversationWith(tx *sql.Tx, userID int64, recipients []int64, subject string) (int64, error) {
+	if len(recipients) == 1 {
+		var id int64
+		err := tx.QueryRow(`
+			SELECT cm.conversation_id
+			FROM conversation_members cm
+			JOIN conversation_members other ON other.conversation_id = cm.conversation_id AND other.user_id = ?
+			WHERE cm.user_id = ?
+				AND (SELECT COUNT(*) FROM conversation_members WHERE conversation_id = cm.conversation_id) = 2
+			LIMIT 1
+		`, recipients[0], userID).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, err
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO conversations (subject, created_by) VALUES (?, ?)", subject, userID)
+	if err != nil {
+		return 0, err
+	}
+	conversationID, _ := result.LastInsertId()
+	for _, memberID := range append([]int64{userID}, recipients...) {
+		_, err := tx.Exec("INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)",
+			conversationID, memberID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return conversationID, nil
+}
+
+// addMessage stores a message and its attachments in tx and marks it read
+// for the sender.
+func addMessage(tx *sql.Tx, r *http.Request, conversationID, senderID int64, content string) error {
+	result, err := tx.ExecContext(r.Context(), "INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, ?)",
+		conversationID, senderID, content)
+	if err != nil {
+		return err
+	}
+	messageID, _ := result.LastInsertId()
+
+	err = saveAttachments(r.Context(), tx, r, attachmentOwner{MessageID: messageID}, senderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(r.Context(), "UPDATE conversation_members SET last_read_id = ? WHERE conversation_id = ? AND user_id = ?",
+		messageID, conversationID, senderID)
+	return err
+}
+
+// messageContent reads the body of a message being sent, along with any
+// problem with it to show the user.
+func messageContent(r *http.Request) (content, problem string) {
+	content = strings.TrimSpace(r.FormValue("content"))
+	if content == "" {
+		return "", "Message content is required"
+	}
+	if len(content) > maxMessageLength {
+		return "", fmt.Sprintf("Messages are limited to %d characters", maxMessageLength)
+	}
+	return content, ""
+}
+
+// MessagesPage is the inbox. To prefills the recipients of a new message.
+type MessagesPage struct {
+	Page
+	Conversations []Conversation
+	BlockedUsers  []string
+	To            string
+}
+
+// MessagesHandler shows the logged-in user's inbox and starts new
+// conversations. Messaging a single user continues any existing one-to-one
+// conversation with them.
+func MessagesHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	if r.Method == "POST" {
+		if err := checkNotMuted(userID); err != nil {
+			return err
+		}
+		defer removeUploads(r)
+		if err := limitUploads(w, r); err != nil {
+			return uploadFailure(err, "Error reading upload")
+		}
+
+		recipients, problem, err := messageRecipients(r.FormValue("to"), userID)
+		if err != nil {
+			return internalError(err, "Error sending message")
+		}
+		if problem != "" {
+			return newError(http.StatusBadRequest, problem)
+		}
+		content, problem := messageContent(r)
+		if problem != "" {
+			return newError(http.StatusBadRequest, problem)
+		}
+
+		tx, err := writeDB.BeginTx(r.Context(), nil)
+		if err != nil {
+			return internalError(err, "Error sending message")
+		}
+		defer tx.Rollback()
+
+		subject := strings.TrimSpace(r.FormValue("subject"))
+		conversationID, err := conversationWith(tx, userID, recipients, subject)
+		if err != nil {
+			return internalError(err, "Error sending message")
+		}
+		if err := addMessage(tx, r, conversationID, userID, content); err != nil {
+			return uploadFailure(err, "Error sending message")
+		}
+		if err := tx.Commit(); err != nil {
+			return internalError(err, "Error sending message")
+		}
+
+		http.Redirect(w, r, "/messages/"+strconv.FormatInt(conversationID, 10), http.StatusSeeOther)
+		return nil
+	}
+
+	conversations, err := listConversations(userID)
+	if err != nil {
+		return internalError(err, "Error fetching messages")
+	}
+	blocked, err := blockedUsers(userID)
+	if err != nil {
+		return internalError(err, "Error fetching blocked users")
+	}
+
+	return templates.ExecuteTemplate(w, "messages.html", MessagesPage{
+		Page:          newPage(w, r, "messages", "Messages"),
+		Conversations: conversations,
+		BlockedUsers:  blocked,
+		To:            r.URL.Query().Get("to"),
+	})
+}
+
+// ConversationPage shows one conversation. Exactly one of IsMember,
+// ModeratorAccess and NeedsJustification is set; with NeedsJustification,
+// the subject and members are left out too.
+type ConversationPage struct {
+	Page
+	ConversationID         int64
+	Subject                string
+	Members                []string
+	Messages               []Message
+	IsMember               bool
+	ModeratorAccess        bool
+	NeedsJustification     bool
+	MinJustificationLength int
+}
+
+// ConversationHandler shows a conversation to its members and lets them
+// reply. Moderators who are not members must first record a justification,
+// after which they can read, but not reply to, the conversation for an hour.
+func ConversationHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	conversationID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid conversation ID")
+	}
+
+	var subject string
+	if err := db.QueryRowContext(r.Context(), "SELECT subject FROM conversations WHERE id = ?", conversationID).Scan(&subject); err != nil {
+		return newError(http.StatusNotFound, "Conversation not found")
+	}
+	access, err := conversationAccessFor(conversationID, userID, role)
+	if err != nil {
+		return internalError(err, "Error fetching conversation")
+	}
+	if access == noAccess && !IsModerator(role) {
+		return newError(http.StatusNotFound, "Conversation not found")
+	}
+
+	// Who is talking, and about what, is as private as what they say, so
+	// moderators only see it once they have recorded why they need to.
+	var members []string
+	if access == noAccess {
+		subject = ""
+	} else {
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT u.username FROM conversation_members cm
+			JOIN users u ON cm.user_id = u.id
+			WHERE cm.conversation_id = ?
+			ORDER BY u.username
+		`, conversationID)
+		if err != nil {
+			return internalError(err, "Error fetching conversation")
+		}
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err != nil {
+				rows.Close()
+				return internalError(err, "Error fetching conversation")
+			}
+			members = append(members, username)
+		}
+		rows.Close()
+	}
+
+	if r.Method == "POST" {
+		if access != memberAccess {
+			return newError(http.StatusForbidden, "Only members of a conversation can reply to it")
+		}
+		if err := checkNotMuted(userID); err != nil {
+			return err
+		}
+		defer removeUploads(r)
+		if err := limitUploads(w, r); err != nil {
+			return uploadFailure(err, "Error reading upload")
+		}
+		content, problem := messageContent(r)
+		if problem != "" {
+			return newError(http.StatusBadRequest, problem)
+		}
+
+		// A block ends a one-to-one conversation in both directions.
+		if len(members) == 2 {
+			var blocked bool
+			err := db.QueryRowContext(r.Context(), `
+				SELECT EXISTS (
+					SELECT 1 FROM conversation_members cm
+					JOIN user_blocks b ON (b.blocker_id = cm.user_id AND b.blocked_id = @other)
+						OR (b.blocker_id = @other AND b.blocked_id = cm.user_id)
+					WHERE cm.conversation_id = @conversation AND cm.user_id != @other
+				)
+			`, sql.Named("other", userID), sql.Named("conversation", conversationID)).Scan(&blocked)
+			if err != nil {
+				return internalError(err, "Error sending message")
+			}
+			if blocked {
+				return newError(http.StatusForbidden, "You can't message this user")
+			}
+		}
+
+		tx, err := writeDB.BeginTx(r.Context(), nil)
+		if err != nil {
+			return internalError(err, "Error sending message")
+		}
+		defer tx.Rollback()
+
+		if err := addMessage(tx, r, conversationID, userID, content); err != nil {
+			return uploadFailure(err, "Error sending message")
+		}
+		if err := tx.Commit(); err != nil {
+			return internalError(err, "Error sending message")
+		}
+
+		http.Redirect(w, r, "/messages/"+mux.Vars(r)["id"], http.StatusSeeOther)
+		return nil
+	}
+
+	var messages []Message
+	if access != noAccess {
+		messages, err = conversationMessages(conversationID)
+		if err != nil {
+			return internalError(err, "Error fetching messages")
+		}
+	}
+	if access == memberAccess && len(messages) > 0 {
+		_, err = writeDB.ExecContext(r.Context(), "UPDATE conversation_members SET last_read_id = ? WHERE conversation_id = ? AND user_id = ?",
+			messages[len(messages)-1].ID, conversationID, userID)
+		if err != nil {
+			return internalError(err, "Error updating conversation")
+		}
+	}
+
+	title := subject
+	if title == "" {
+		title = "Conversation"
+	}
+	return templates.ExecuteTemplate(w, "conversation.html", ConversationPage{
+		Page:                   newPage(w, r, "conversation", title),
+		ConversationID:         conversationID,
+		Subject:                subject,
+		Members:                members,
+		Messages:               messages,
+		IsMember:               access == memberAccess,
+		ModeratorAccess:        access == moderatorAccess,
+		NeedsJustification:     access == noAccess,
+		MinJustificationLength: minJustificationLength,
+	})
+}
+
+func conversationMessages(conversationID int64) ([]Message, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.sender_id, u.username, m.content, m.created_at
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.conversation_id = ?
+		ORDER BY m.id
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.SenderName, &m.Content, &m.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.CreatedAt = formatDate(m.CreatedAt, "Jan 02, 2006 15:04")
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		messages[i].Attachments, err = attachmentsFor(attachmentOwner{MessageID: messages[i].ID})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// ConversationAccessHandler records a moderator's justification for reading a
+// conversation they are not a member of, which grants them read access for
+// an hour.
+func ConversationAccessHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can access other users' conversations")
+	}
+
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid conversation ID")
+	}
+
+	justification := strings.TrimSpace(r.FormValue("justification"))
+	if len(justification) < minJustificationLength {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Please explain why you need access in at least %d characters", minJustificationLength))
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM conversations WHERE id = ?)", conversationID).Scan(&exists)
+	if err != nil || !exists {
+		return newError(http.StatusNotFound, "Conversation not found")
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error recording access")
+	}
+	defer tx.Rollback()
+
+	target := auditTarget{TargetConversation, conversationID}
+	err = audited(tx, userID, ActionReadConversation, target, justification, func() error {
+		_, err := tx.ExecContext(r.Context(), `
+			INSERT INTO conversation_access_log (conversation_id, moderator_id, justification) VALUES (?, ?, ?)
+		`, conversationID, userID, justification)
+		return err
+	})
+	if err != nil {
+		return internalError(err, "Error recording access")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error recording access")
+	}
+
+	http.Redirect(w, r, "/messages/"+vars["id"], http.StatusSeeOther)
+	return nil
+}
+
+// UnreadMessagesHandler returns the logged-in user's unread message count as
+// JSON for the navbar.
+func UnreadMessagesHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	unread, err := unreadMessages(userID)
+	if err != nil {
+		return internalError(err, "Error fetching messages")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+	return nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestModeratorSeesConversationOnlyAfterJustifying(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.addUser("alice", RoleStudent)
+	bob := e.addUser("bob", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	conversation := e.exec("INSERT INTO conversations (subject, created_by) VALUES ('Exam answers', ?)", alice)
+	e.exec("INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?), (?, ?)",
+		conversation, alice, conversation, bob)
+	e.exec("INSERT INTO messages (conversation_id, sender_id, content) VALUES (?, ?, 'Secret message')", conversation, alice)
+
+	id := strconv.FormatInt(conversation, 10)
+	view := func() string {
+		w := e.do(Handler(ConversationHandler), request{method: http.MethodGet, target: "/messages/" + id,
+			vars: map[string]string{"id": id}, user: moderator})
+		wantStatus(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+
+	body := view()
+	for _, private := range []string{"/user/alice", "/user/bob", "Exam answers", "Secret message"} {
+		if strings.Contains(body, private) {
+			t.Errorf("%q shown before a justification was recorded", private)
+		}
+	}
+	if !strings.Contains(body, `name="justification"`) {
+		t.Error("justification form not shown")
+	}
+
+	w := e.do(Handler(ConversationAccessHandler), request{method: http.MethodPost, target: "/messages/" + id + "/access",
+		vars: map[string]string{"id": id}, user: moderator,
+		form: url.Values{"justification": {"Reported for sharing exam answers"}}})
+	wantStatus(t, w, http.StatusSeeOther)
+
+	body = view()
+	for _, private := range []string{"/user/alice", "/user/bob", "Exam answers", "Secret message"} {
+		if !strings.Contains(body, private) {
+			t.Errorf("%q not shown after a justification was recorded", private)
+		}
+	}
+}
+
+func TestConversationHiddenFromOtherStudents(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.addUser("alice", RoleStudent)
+	mallory := e.addUser("mallory", RoleStudent)
+	conversation := e.exec("INSERT INTO conversations (subject, created_by) VALUES ('Private', ?)", alice)
+	e.exec("INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)", conversation, alice)
+
+	id := strconv.FormatInt(conversation, 10)
+	w := e.do(Handler(ConversationHandler), request{method: http.MethodGet, target: "/messages/" + id,
+		vars: map[string]string{"id": id}, user: mallory})
+	wantStatus(t, w, http.StatusNotFound)
+}
+
+func TestConversationAccessDeniedOnDatabaseError(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.addUser("alice", RoleStudent)
+	conversation := e.exec("INSERT INTO conversations (subject, created_by) VALUES ('Private', ?)", alice)
+	e.exec("INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)", conversation, alice)
+	db.Close()
+
+	access, err := conversationAccessFor(conversation, alice, RoleStudent)
+	if err == nil {
+		t.Fatal("no error from a closed database")
+	}
+	if access != noAccess {
+		t.Errorf("access = %v on error, want none", access)
+	}
+}
@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification types stored in notifications.type.
+const (
+	NotifyReply        = "reply"
+	NotifyMention      = "mention"
+	NotifyThread       = "thread"
+	NotifyAnnouncement = "announcement"
+)
+
+const notificationPageSize = 50
+
+// NotificationPreference is one user-configurable notification type.
+// Announcements are always delivered and are not listed.
+type NotificationPreference struct {
+	Type    string
+	Label   string
+	Enabled bool
+}
+
+var notificationPreferences = []NotificationPreference{
+	{Type: NotifyReply, Label: "Replies to my posts"},
+	{Type: NotifyMention, Label: "@mentions of me"},
+	{Type: NotifyThread, Label: "Activity on threads I follow"},
+}
+
+// Notification is an entry in a user's notification list. ActorName is empty
+// when the actor posted anonymously.
+type Notification struct {
+	ID        int64
+	Type      string
+	PostID    int64
+	PostTitle string
+	ActorName string
+	IsRead    bool
+	CreatedAt string
+}
+
+// notifier sends at most one notification per recipient for a single post or
+// comment, so a followed-thread author who is also mentioned only hears about
+// it once. The actor is never notified of their own activity.
+type notifier struct {
+	postID    int64
+	commentID sql.NullInt64
+	actorID   int64
+	actor     sql.NullInt64
+	sent      map[int64]bool
+}
+
+// newNotifier starts notifying about activity by actorID on a post. Anonymous
+// activity is recorded without an actor so the notification does not reveal
+// who wrote it.
+func newNotifier(postID, commentID, actorID int64, anonymous bool) *notifier {
+	n := &notifier{
+		postID:    postID,
+		commentID: nullID(commentID),
+		actorID:   actorID,
+		actor:     nullID(actorID),
+		sent:      map[int64]bool{actorID: true},
+	}
+	if anonymous {
+		n.actor = sql.NullInt64{}
+	}
+	return n
+}
+
+// send notifies a user unless they have already been notified or have turned
+// off notifications of this type.
+func (n *notifier) send(userID int64, kind string) error {
+	if n.sent[userID] {
+		return nil
+	}
+	n.sent[userID] = true
+
+	_, err := writeDB.Exec(`
+		INSERT INTO notifications (user_id, type, post_id, comment_id, actor_id)
+		SELECT ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notification_preferences
+			WHERE user_id = ? AND type = ? AND enabled = 0
+		)
+	`, userID, kind, n.postID, n.commentID, n.actor, userID, kind)
+	return err
+}
+
+func (n *notifier) mentions(text string) error {
+	ids, err := mentionedUsers(text, n.actorID, n.postID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := n.send(id, NotifyMention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyPost notifies the users @mentioned in a new post.
+func notifyPost(postID, actorID int64, anonymous bool, title, content string) error {
+	return newNotifier(postID, 0, actorID, anonymous).mentions(title + "\n" + content)
+}
+
+// notifyComment notifies the users @mentioned in a new comment, the author of
+// the post it replies to, and everyone following the thread.
+func notifyComment(postID, commentID, actorID int64, anonymous bool, content string) error {
+	n := newNotifier(postID, commentID, actorID, anonymous)
+	if err := n.mentions(content); err != nil {
+		return err
+	}
+
+	var authorID int64
+	if err := db.QueryRow("SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID); err != nil {
+		return err
+	}
+	if err := n.send(authorID, NotifyReply); err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT user_id FROM thread_follows WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+	var followers []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		followers = append(followers, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range followers {
+		if err := n.send(id, NotifyThread); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyAnnouncement notifies the course members of an announcement post:
+// the members of its category, or every user when it has no category. The
+// actor is never notified of their own announcement.
+func notifyAnnouncement(postID, actorID int64) error {
+	_, err := writeDB.Exec(`
+		INSERT INTO notifications (user_id, type, post_id, actor_id)
+		SELECT u.id, ?, p.id, ?
+		FROM posts p
+		JOIN users u ON p.category_id IS NULL
+			OR u.id IN (SELECT user_id FROM category_members WHERE category_id = p.category_id)
+		WHERE p.id = ? AND u.id != ?
+	`, NotifyAnnouncement, actorID, postID, actorID)
+	return err
+}
+
+// unreadNotifications returns how many unread notifications a user has.
+func unreadNotifications(userID int64) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// markPostNotificationsRead marks a user's notifications about a post as read,
+// for when they open the post itself. Most views have nothing to mark, so
+// it checks on the read pool first rather than queueing for the writer.
+func markPostNotificationsRead(userID, postID int64) error {
+	var unread bool
+	err := queryRowPrepared(context.Background(), `
+		SELECT EXISTS (SELECT 1 FROM notifications WHERE user_id = ? AND post_id = ? AND read_at IS NULL)
+	`, userID, postID).Scan(&unread)
+	if err != nil || !unread {
+		return err
+	}
+	_, err = writeDB.Exec(`
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND post_id = ? AND read_at IS NULL
+	`, userID, postID)
+	return err
+}
+
+func listNotifications(userID int64) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT n.id, n.type, n.post_id, COALESCE(p.title, ''), COALESCE(a.username, ''),
+			n.read_at IS NOT NULL, n.created_at
+		FROM notifications n
+		LEFT JOIN posts p ON n.post_id = p.id
+		LEFT JOIN users a ON n.actor_id = a.id
+		WHERE n.user_id = ?
+		ORDER BY n.created_at DESC, n.id DESC
+		LIMIT ?
+	`, userID, notificationPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		err := rows.Scan(&n.ID, &n.Type, &n.PostID, &n.PostTitle, &n.ActorName, &n.IsRead, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		n.CreatedAt = formatDate(n.CreatedAt, "Jan 02, 2006 15:04")
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func loadNotificationPreferences(userID int64) ([]NotificationPreference, error) {
+	disabled := map[string]bool{}
+	rows, err := db.Query("SELECT type FROM notification_preferences WHERE user_id = ? AND enabled = 0", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err != nil {
+			return nil, err
+		}
+		disabled[kind] = true
+	}
+
+	prefs := make([]NotificationPreference, len(notificationPreferences))
+	for i, p := range notificationPreferences {
+		p.Enabled = !disabled[p.Type]
+		prefs[i] = p
+	}
+	return prefs, rows.Err()
+}
+
+// NotificationsPage lists notifications alongside the preference forms.
+type NotificationsPage struct {
+	Page
+	Notifications    []Notification
+	Preferences      []NotificationPreference
+	Unread           int
+	EmailFrequency   string
+	EmailFrequencies []EmailFrequency
+}
+
+// NotificationsHandler lists the logged-in user's recent notifications along
+// with their notification preferences.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	notifications, err := listNotifications(userID)
+	if err != nil {
+		return internalError(err, "Error fetching notifications")
+	}
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		return internalError(err, "Error fetching notification preferences")
+	}
+	unread, err := unreadNotifications(userID)
+	if err != nil {
+		return internalError(err, "Error fetching notifications")
+	}
+	emailFrequency, _, err := emailSettings(userID)
+	if err != nil {
+		return internalError(err, "Error fetching email settings")
+	}
+
+	return templates.ExecuteTemplate(w, "notifications.html", NotificationsPage{
+		Page:             newPage(w, r, "notifications", "Notifications"),
+		Notifications:    notifications,
+		Preferences:      prefs,
+		Unread:           unread,
+		EmailFrequency:   emailFrequency,
+		EmailFrequencies: emailFrequencies,
+	})
+}
+
+// UnreadNotificationsHandler returns the logged-in user's unread notification
+// count as JSON for the notification bell.
+func UnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	unread, err := unreadNotifications(userID)
+	if err != nil {
+		return internalError(err, "Error fetching notifications")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+	return nil
+}
+
+// ReadNotificationHandler marks one notification as read and takes the user
+// to the post it is about.
+func ReadNotificationHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	notificationID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid notification ID")
+	}
+
+	var postID sql.NullInt64
+	err = db.QueryRowContext(r.Context(), "SELECT post_id FROM notifications WHERE id = ? AND user_id = ?", notificationID, userID).Scan(&postID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Notification not found")
+	}
+
+	_, err = writeDB.ExecContext(r.Context(), "UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE id = ? AND read_at IS NULL", notificationID)
+	if err != nil {
+		return internalError(err, "Error updating notification")
+	}
+
+	if postID.Valid {
+		http.Redirect(w, r, "/post/"+strconv.FormatInt(postID.Int64, 10), http.StatusSeeOther)
+		return nil
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
+
+// ReadAllNotificationsHandler marks all of the user's notifications as read.
+func ReadAllNotificationsHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	_, err := writeDB.ExecContext(r.Context(), "UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		return internalError(err, "Error updating notifications")
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
+
+// NotificationPreferencesHandler saves which notification types the user
+// wants to receive and how often they are emailed. Unchecked types are turned
+// off.
+func NotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	frequency := r.FormValue("email_frequency")
+	if !validEmailFrequency(frequency) {
+		return newError(http.StatusBadRequest, "Invalid email frequency")
+	}
+	current, _, err := emailSettings(userID)
+	if err != nil {
+		return internalError(err, "Error saving preferences")
+	}
+	if frequency != current {
+		if err := setEmailFrequency(userID, frequency); err != nil {
+			return internalError(err, "Error saving preferences")
+		}
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error saving preferences")
+	}
+	defer tx.Rollback()
+
+	for _, p := range notificationPreferences {
+		_, err := tx.ExecContext(r.Context(), `
+			INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, type) DO UPDATE SET enabled = excluded.enabled
+		`, userID, p.Type, r.FormValue(p.Type) == "on")
+		if err != nil {
+			return internalError(err, "Error saving preferences")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error saving preferences")
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
+
+// FollowPostHandler toggles whether the logged-in user follows a thread.
+// Followers are notified of every new comment on it.
+func FollowPostHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	vars := mux.Vars(r)
+	postID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid post ID")
+	}
+
+	following, err := isFollowingPost(userID, postID)
+	if err != nil {
+		return internalError(err, "Error updating follow")
+	}
+	if following {
+		_, err = writeDB.ExecContext(r.Context(), "DELETE FROM thread_follows WHERE user_id = ? AND post_id = ?", userID, postID)
+	} else {
+		_, err = writeDB.ExecContext(r.Context(), "INSERT INTO thread_follows (user_id, post_id) SELECT ?, id FROM posts WHERE id = ?", userID, postID)
+	}
+	if err != nil {
+		return internalError(err, "Error updating follow")
+	}
+
+	http.Redirect(w, r, "/post/"+vars["id"], http.StatusSeeOther)
+	return nil
+}
+
+func isFollowingPost(userID, postID int64) (bool, error) {
+	var following bool
+	err := queryRowPrepared(context.Background(), "SELECT EXISTS (SELECT 1 FROM thread_follows WHERE user_id = ? AND post_id = ?)",
+		userID, postID).Scan(&following)
+	return following, err
+}
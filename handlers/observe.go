@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"university-forum/telemetry"
+)
+
+// requestInfo is what the access log needs to know about a request. It is
+// created before routing and filled in by TraceRoute once a route matches
+// and by currentViewer once the user is looked up.
+type requestInfo struct {
+	id     string
+	route  string
+	viewer *viewer
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID returns the ID Observe gave the request, or "" outside it.
+func requestID(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// logger returns the default logger with the request's ID attached.
+func logger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// Observe gives each request an ID, traces it, and writes an access log line
+// once it has been served. The ID is taken from an X-Request-ID header set
+// by a proxy in front of the forum if there is one, and is sent back in the
+// response. It should wrap everything else, including Recover, so that
+// panics are logged against the request.
+func Observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if !validRequestID(info.id) {
+			info.id = randomID()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := telemetry.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+		ctx = context.WithValue(ctx, requestInfoKey{}, info)
+		r = r.WithContext(ctx)
+
+		rw := trackWrites(w)
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		userID, _ := currentUser(r)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if userID != 0 {
+			span.SetAttributes(semconv.EnduserID(strconv.FormatInt(userID, 10)))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		// Requests that matched no route are counted together, so that
+		// scanners probing random paths can't inflate the label set.
+		route := info.route
+		if route == "" {
+			route = "unmatched"
+		}
+		telemetry.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		telemetry.HTTPDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		if userID != 0 {
+			telemetry.SeenUser(userID)
+		}
+
+		logger(ctx).LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("route", info.route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int64("bytes", rw.bytes),
+			slog.Int64("user_id", userID),
+		)
+	})
+}
+
+// TraceRoute records the route template a request matched, such as
+// "/post/{id}", on its span and access log line. It is router middleware, so
+// it only runs once a route has matched.
+func TraceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				if info := requestInfoFrom(r.Context()); info != nil {
+					info.route = tmpl
+				}
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tmpl)
+				span.SetAttributes(semconv.HTTPRoute(tmpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID accepts IDs from other services as long as they are short
+// and can't be used to forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
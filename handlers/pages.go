@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Page is the data the layout needs on every page. Each page's view model
+// embeds it alongside the page's own fields.
+type Page struct {
+	PageID          string
+	Title           string
+	IsAuthenticated bool
+	UserID          int64
+	Username        string
+	Role            string
+	Flashes         []Flash
+	CSRFToken       string
+	ErrorMessage    string
+}
+
+func (p Page) IsStaff() bool     { return IsStaff(p.Role) }
+func (p Page) IsModerator() bool { return IsModerator(p.Role) }
+func (p Page) IsAdmin() bool     { return p.Role == RoleAdmin }
+
+// newPage builds the common page data for the current request: the logged-in
+// user, any flash messages waiting in the session and the session's CSRF
+// token. It saves the session when it changes, so it must be called before
+// anything is written to w.
+func newPage(w http.ResponseWriter, r *http.Request, id, title string) Page {
+	v := currentViewer(r)
+	page := Page{PageID: id, Title: title, UserID: v.id, Role: v.role, Username: v.username}
+	page.IsAuthenticated = v.id != 0
+
+	session, _ := store.Get(r, "session-name")
+	changed := false
+	for _, f := range session.Flashes() {
+		if flash, ok := f.(Flash); ok {
+			page.Flashes = append(page.Flashes, flash)
+		}
+		changed = true
+	}
+	var issued bool
+	if page.CSRFToken, issued = sessionCSRFToken(session); issued {
+		changed = true
+	}
+	if changed {
+		session.Save(r, w)
+	}
+	return page
+}
+
+// render writes the named page with the given status code. Nothing is
+// written if the page fails to render, so the caller can still return the
+// error to have an error page shown instead.
+func render(w http.ResponseWriter, name string, data interface{}, status int) error {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// renderCacheable writes the named page with an ETag and a Last-Modified
+// time, answering with 304 Not Modified when the client already has it.
+// Pages differ per user, so only the browser may keep them, and it must
+// check back each time.
+func renderCacheable(w http.ResponseWriter, r *http.Request, name string, data interface{}, modified time.Time) error {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+
+	// The CSRF token and flashes are part of the page, so hashing it keeps
+	// one user's ETag from matching another's. Last-Modified only tracks
+	// the cached data, so it is left off when newPage has just changed the
+	// session, by showing its flashes or issuing a token: the copy the
+	// browser has would be out of date.
+	if w.Header().Get("Set-Cookie") != "" {
+		modified = time.Time{}
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Cookie")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(buf.Bytes()))
+	return nil
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"university-forum/views"
+)
+
+// TestPagesRender renders every page in Pages with fixture data, once empty
+// for a logged-out visitor and once fully populated for an admin, so that a
+// field a template uses but its view model lacks is caught before it reaches
+// a user.
+func TestPagesRender(t *testing.T) {
+	renderer, err := views.New(os.DirFS("../templates"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, full := range []bool{false, true} {
+		fixtures := pageFixtures(full)
+		for _, name := range Pages {
+			data, ok := fixtures[name]
+			if !ok {
+				t.Errorf("%s: no fixture", name)
+				continue
+			}
+			if err := renderer.ExecuteTemplate(io.Discard, name, data); err != nil {
+				t.Errorf("full=%v: %v", full, err)
+			}
+		}
+	}
+}
+
+// pageFixtures returns view models for every page. Empty fixtures leave
+// everything at its zero value; full fixtures set every flag and fill every
+// list so that conditional sections are rendered too.
+func pageFixtures(full bool) map[string]interface{} {
+	page := Page{PageID: "fixture"}
+	if !full {
+		return map[string]interface{}{
+			"403.html":            ErrorPage{Page: page, Status: http.StatusForbidden},
+			"404.html":            ErrorPage{Page: page, Status: http.StatusNotFound},
+			"500.html":            ErrorPage{Page: page, Status: http.StatusInternalServerError},
+			"error.html":          ErrorPage{Page: page, Status: http.StatusBadRequest},
+			"account-status.html": AccountStatusPage{Page: page},
+			"admin.html":          AdminPage{Page: page, Stats: &SiteStats{}},
+			"appeals.html":        AppealsPage{Page: page},
+			"audit.html":          AuditPage{Page: page},
+			"categories.html":     CategoriesPage{Page: page},
+			"category.html":       CategoryPage{Page: page},
+			"conversation.html":   ConversationPage{Page: page},
+			"create-post.html":    CreatePostPage{Page: page},
+			"edit-profile.html":   EditProfilePage{Page: page},
+			"held.html":           HeldPage{Page: page},
+			"index.html":          HomePage{Page: page},
+			"login.html":          LoginPage{Page: page},
+			"messages.html":       MessagesPage{Page: page},
+			"moderation.html":     ModerationPage{Page: page},
+			"notifications.html":  NotificationsPage{Page: page},
+			"profile.html":        ProfilePage{Page: page},
+			"register.html":       RegisterPage{Page: page},
+			"search.html":         SearchPage{Page: page},
+			"tag.html":            TagPage{Page: page},
+			"unsubscribe.html":    UnsubscribePage{Page: page},
+			"view-post.html":      ViewPostPage{Page: page},
+		}
+	}
+
+	page = Page{
+		PageID:          "fixture",
+		Title:           "Fixture",
+		IsAuthenticated: true,
+		UserID:          1,
+		Username:        "admin",
+		Role:            RoleAdmin,
+		Flashes:         []Flash{{Kind: FlashSuccess, Message: "Saved"}},
+		ErrorMessage:    "Something went wrong",
+	}
+	attachments := []Attachment{
+		{ID: 1, Filename: "diagram.png", ContentType: "image/png", Size: 2048, HasThumbnail: true},
+		{ID: 2, Filename: "notes.pdf", ContentType: "application/pdf", Size: 4 << 20},
+	}
+	comment := Comment{ID: 2, Content: "Thanks @admin", AuthorID: 1, AuthorName: "admin", CreatedAt: "Jan 02, 2006",
+		IsAnonymous: true, EndorsedBy: "prof", IsHidden: true, Attachments: attachments}
+	post := Post{ID: 1, Title: "Question", Content: "How does this work?", AuthorID: 1, AuthorName: "admin",
+		CreatedAt: "Jan 02, 2006", IsAnonymous: true, EndorsedBy: "prof", Tags: []string{"exam"},
+		Category: "CS101", CategorySlug: "cs101", PinScope: PinGlobal, IsLocked: true, IsAnnouncement: true,
+		IsHidden: true, Attachments: attachments, Comments: []Comment{comment}}
+	posts := []Post{post}
+	// The comment form is only shown on posts that are not locked.
+	openPost := post
+	openPost.IsLocked = false
+	pagination := Pagination{Total: 30, Page: 2, TotalPages: 3, PrevPage: 1, NextPage: 3}
+	category := Category{ID: 1, Name: "CS101", Slug: "cs101", Description: "Intro", PostCount: 1, IsMember: true}
+	sanction := Sanction{ID: 1, UserID: 2, Kind: SanctionSuspension, Reason: "Spam", ExpiresAt: "Jan 09, 2006",
+		CreatedBy: "admin", CreatedAt: "Jan 02, 2006", LiftedBy: "admin", LiftedAt: "Jan 03, 2006",
+		LiftReason: "Appealed", IsActive: true, AppealStatus: "open", AppealResponse: "Under review"}
+	form := Form{Values: url.Values{}}
+	for _, field := range append(append(postFields, "username", "email"), profileFields...) {
+		form.Values.Set(field, "on")
+		form.Fail(field, "Not valid")
+	}
+	form.Values.Set("category", "cs101")
+	form.Fail(formError, "Not accepted")
+	trend := Trend{Points: []TrendPoint{{Label: "Jan 2", Users: 1, Posts: 2, Comments: 3}}, Max: 3}
+
+	errorPage := func(status int) ErrorPage {
+		return ErrorPage{Page: page, Status: status, Message: "Something went wrong", ErrorID: "0123456789abcdef"}
+	}
+
+	return map[string]interface{}{
+		"403.html":            errorPage(http.StatusForbidden),
+		"404.html":            errorPage(http.StatusNotFound),
+		"500.html":            errorPage(http.StatusInternalServerError),
+		"error.html":          errorPage(http.StatusBadRequest),
+		"account-status.html": AccountStatusPage{Page: page, Sanctions: []Sanction{sanction}},
+		"admin.html": AdminPage{
+			Page: page,
+			Stats: &SiteStats{
+				Daily:   trend,
+				Weekly:  trend,
+				Courses: []ActiveCourse{{Name: "CS101", Slug: "cs101", Posts: 1, Comments: 2, Unanswered: 1}},
+				Users:   []ActiveUser{{Username: "admin", Posts: 1, Comments: 2}},
+			},
+			ComputedAt: "Jan 2, 2006 15:04 UTC",
+			ActiveDays: 30,
+		},
+		"appeals.html": AppealsPage{Page: page, Appeals: []Appeal{{ID: 1, Sanction: sanction, Username: "bob",
+			Message: "Sorry", Status: "rejected", Response: "No", ReviewedBy: "admin", CreatedAt: "Jan 02, 2006"}}},
+		"audit.html": AuditPage{
+			Page: page,
+			Entries: []AuditEntry{{ID: 1, CreatedAt: "2006-01-02 15:04:05", ActorName: "admin", Action: ActionPin,
+				TargetType: TargetPost, TargetID: 1, TargetUser: "bob", Reason: "Useful", Before: "{}", After: "{}"}},
+			Filter:      auditFilter{Actor: "admin", Action: ActionPin, Type: TargetPost, User: "bob", From: "2006-01-01", To: "2006-01-31"},
+			Actions:     []string{ActionPin},
+			TargetTypes: auditTargetTypes(),
+			Pagination:  pagination,
+			Query:       "actor=admin",
+		},
+		"categories.html": CategoriesPage{Page: page, Categories: []Category{category}},
+		"category.html":   CategoryPage{Page: page, Category: category, Pinned: posts, Posts: posts, Pagination: pagination},
+		"conversation.html": ConversationPage{
+			Page:           page,
+			ConversationID: 1,
+			Subject:        "Project",
+			Members:        []string{"admin", "bob"},
+			Messages: []Message{{ID: 1, SenderID: 1, SenderName: "admin", Content: "Hi", CreatedAt: "Jan 02, 2006",
+				Attachments: attachments}},
+			IsMember:               true,
+			ModeratorAccess:        true,
+			NeedsJustification:     true,
+			MinJustificationLength: minJustificationLength,
+		},
+		"create-post.html": CreatePostPage{Page: page, Categories: []Category{category}, Form: form,
+			MaxTitleLength: maxTitleLength},
+		"edit-profile.html": EditProfilePage{Page: page, Form: form, HasAvatar: true, MaxBioLength: maxBioLength,
+			MaxProfileLength: maxProfileLength},
+		"held.html": HeldPage{Page: page, Status: "all", Holds: []Hold{{ID: 1, PostID: 1, CommentID: 2, Title: "Question",
+			Content: "Buy now", AuthorName: "bob", Filter: "words", Reason: "contains a blocked word", Status: HoldApproved,
+			CreatedAt: "Jan 02, 2006", ReviewedBy: "admin"}}},
+		"index.html": HomePage{Page: page, Pinned: posts, Posts: posts, Pagination: pagination},
+		"login.html": LoginPage{Page: page, Form: form},
+		"messages.html": MessagesPage{Page: page, BlockedUsers: []string{"carol"}, To: "bob",
+			Conversations: []Conversation{{ID: 1, Subject: "Project", Members: "admin, bob", LastMessage: "Hi",
+				LastSender: "bob", UpdatedAt: "Jan 02, 2006", Unread: 1}}},
+		"moderation.html": ModerationPage{
+			Page: page,
+			Reports: []Report{{ID: 1, Reason: "spam", ReasonLabel: "Spam or advertising", Details: "Ads",
+				ReporterName: "bob", Status: ReportOpen, CreatedAt: "Jan 02, 2006", PostID: 1, CommentID: 2,
+				Title: "Question", Content: "Buy now", AuthorName: "carol", IsHidden: true, Action: ActionHide,
+				ActionBy: "admin", ActionNote: "Spam", ActionAt: "Jan 03, 2006"}},
+			Status:        "all",
+			Reason:        "spam",
+			Type:          "post",
+			ReportReasons: reportReasons,
+			QueueActions:  queueActions,
+			Query:         "status=all",
+		},
+		"notifications.html": NotificationsPage{
+			Page: page,
+			Notifications: []Notification{{ID: 1, Type: "comment", PostID: 1, PostTitle: "Question",
+				ActorName: "bob", CreatedAt: "Jan 02, 2006"}},
+			Preferences:      []NotificationPreference{{Type: "comment", Label: "Comments", Enabled: true}},
+			Unread:           1,
+			EmailFrequency:   EmailDaily,
+			EmailFrequencies: emailFrequencies,
+		},
+		"profile.html": ProfilePage{
+			Page:              page,
+			User:              User{ID: 2, Username: "bob", Email: "bob@example.edu", CreatedAt: "Jan 02, 2006"},
+			Profile:           fixtureProfile(),
+			Posts:             posts,
+			Pagination:        pagination,
+			IsOwner:           true,
+			IsBlocked:         true,
+			UserRole:          RoleStudent,
+			Roles:             roles,
+			Sanctions:         []Sanction{sanction},
+			SanctionKinds:     sanctionKinds,
+			SanctionDurations: sanctionDurations,
+		},
+		"register.html":    RegisterPage{Page: page, Form: form, MinPasswordLength: minPasswordLength},
+		"search.html":      SearchPage{Page: page, Query: "exam", Tag: "exam", Posts: posts, Pagination: pagination},
+		"tag.html":         TagPage{Page: page, Tag: "exam", Posts: posts, Pagination: pagination},
+		"unsubscribe.html": UnsubscribePage{Page: page, Token: "token", Unsubscribed: true},
+		"view-post.html": ViewPostPage{Page: page, Post: openPost, IsFollowing: true, ReportReasons: reportReasons,
+			CommentForm: form},
+	}
+}
+
+func fixtureProfile() Profile {
+	return Profile{DisplayName: "Bob", Bio: "Hello", Department: "CS", Year: "2", Pronouns: "they/them",
+		HasAvatar: true, EmailPublic: true, BioPublic: true, DepartmentPublic: true, YearPublic: true,
+		PronounsPublic: true}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Pin scopes stored in posts.pin_scope. An empty scope means the post is not
+// pinned.
+const (
+	PinNone     = ""
+	PinGlobal   = "global"
+	PinCategory = "category"
+)
+
+// staffPostID checks that the current user is staff and parses the post ID
+// from the route, returning the current user's ID and the post ID.
+func staffPostID(r *http.Request) (int64, int64, error) {
+	userID, role := currentUser(r)
+	if !IsStaff(role) {
+		return 0, 0, newError(http.StatusForbidden, "Only instructors and moderators can do that")
+	}
+
+	postID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, 0, newError(http.StatusBadRequest, "Invalid post ID")
+	}
+	return userID, postID, nil
+}
+
+// PinPostHandler pins a post globally or within its category, or unpins it
+// when the scope is empty.
+func PinPostHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, postID, err := staffPostID(r)
+	if err != nil {
+		return err
+	}
+
+	scope := r.FormValue("scope")
+	if scope != PinNone && scope != PinGlobal && scope != PinCategory {
+		return newError(http.StatusBadRequest, "Invalid pin scope")
+	}
+
+	var categoryID sql.NullInt64
+	err = db.QueryRowContext(r.Context(), "SELECT category_id FROM posts WHERE id = ?", postID).Scan(&categoryID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+	if scope == PinCategory && !categoryID.Valid {
+		return newError(http.StatusBadRequest, "Only posts in a category can be pinned to it")
+	}
+
+	action := ActionPin
+	if scope == PinNone {
+		action = ActionUnpin
+	}
+	err = auditedUpdate(userID, action, auditTarget{TargetPost, postID}, `
+		UPDATE posts
+		SET pin_scope = ?, pinned_at = CASE WHEN ? = '' THEN NULL ELSE CURRENT_TIMESTAMP END
+		WHERE id = ?
+	`, scope, scope, postID)
+	if err != nil {
+		return internalError(err, "Error pinning post")
+	}
+	invalidatePost(postID)
+
+	http.Redirect(w, r, "/post/"+mux.Vars(r)["id"], http.StatusSeeOther)
+	return nil
+}
+
+// LockPostHandler toggles whether a post accepts new comments.
+func LockPostHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, postID, err := staffPostID(r)
+	if err != nil {
+		return err
+	}
+
+	var isLocked bool
+	err = db.QueryRowContext(r.Context(), "SELECT is_locked FROM posts WHERE id = ?", postID).Scan(&isLocked)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	action := ActionLock
+	if isLocked {
+		action = ActionUnlock
+	}
+	err = auditedUpdate(userID, action, auditTarget{TargetPost, postID},
+		"UPDATE posts SET is_locked = ? WHERE id = ?", !isLocked, postID)
+	if err != nil {
+		return internalError(err, "Error locking post")
+	}
+	invalidatePost(postID)
+
+	http.Redirect(w, r, "/post/"+mux.Vars(r)["id"], http.StatusSeeOther)
+	return nil
+}
+
+// AnnouncePostHandler toggles the announcement flag on a post. Turning it on
+// notifies every member of the post's category, or every user if the post
+// has no category.
+func AnnouncePostHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, postID, err := staffPostID(r)
+	if err != nil {
+		return err
+	}
+
+	var isAnnouncement bool
+	err = db.QueryRowContext(r.Context(), "SELECT is_announcement FROM posts WHERE id = ?", postID).Scan(&isAnnouncement)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	action := ActionAnnounce
+	if isAnnouncement {
+		action = ActionUnannounce
+	}
+	err = auditedUpdate(userID, action, auditTarget{TargetPost, postID},
+		"UPDATE posts SET is_announcement = ? WHERE id = ?", !isAnnouncement, postID)
+	if err != nil {
+		return internalError(err, "Error updating announcement")
+	}
+	invalidatePost(postID)
+
+	if !isAnnouncement {
+		logAnnounceError(r, notifyAnnouncement(postID, userID), "sending announcement")
+	}
+
+	http.Redirect(w, r, "/post/"+mux.Vars(r)["id"], http.StatusSeeOther)
+	return nil
+}
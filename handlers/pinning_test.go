@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// postAction makes a POST to one of a post's moderation routes, such as
+// "pin", as user.
+func (e *testEnv) postAction(h Handler, action string, postID, user int64, form url.Values) *httptest.ResponseRecorder {
+	e.t.Helper()
+	id := strconv.FormatInt(postID, 10)
+	if form == nil {
+		form = url.Values{}
+	}
+	return e.do(h, request{method: http.MethodPost, target: "/post/" + id + "/" + action,
+		vars: map[string]string{"id": id}, user: user, form: form})
+}
+
+func TestPinPost(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	instructor := e.addUser("instructor", RoleInstructor)
+	post := e.addPost(author, "Syllabus")
+	pin := func(user int64, scope string) *httptest.ResponseRecorder {
+		return e.postAction(Handler(PinPostHandler), "pin", post, user, url.Values{"scope": {scope}})
+	}
+
+	wantStatus(t, pin(author, PinGlobal), http.StatusForbidden)
+	wantStatus(t, pin(instructor, "everywhere"), http.StatusBadRequest)
+	wantStatus(t, pin(instructor, PinCategory), http.StatusBadRequest)
+
+	wantStatus(t, pin(instructor, PinGlobal), http.StatusSeeOther)
+	feed, err := loadFeed(RoleStudent, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.pinned) != 1 || feed.pinned[0].ID != post || len(feed.posts) != 0 {
+		t.Errorf("feed has %d pinned and %d other posts, want just the pinned post", len(feed.pinned), len(feed.posts))
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM audit_log WHERE action = ? AND target_id = ?", ActionPin, post); n != 1 {
+		t.Errorf("%d pin audit entries, want 1", n)
+	}
+
+	wantStatus(t, pin(instructor, PinNone), http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM posts WHERE id = ? AND pin_scope = '' AND pinned_at IS NULL", post); n != 1 {
+		t.Error("post still pinned after unpinning")
+	}
+}
+
+func TestLockPost(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	moderator := e.addUser("moderator", RoleModerator)
+	post := e.addPost(author, "Question")
+	comment := func() *httptest.ResponseRecorder {
+		return e.postAction(Handler(AddCommentHandler), "comment", post, author, url.Values{"content": {"More detail"}})
+	}
+
+	wantStatus(t, e.postAction(Handler(LockPostHandler), "lock", post, author, nil), http.StatusForbidden)
+	wantStatus(t, e.postAction(Handler(LockPostHandler), "lock", post, moderator, nil), http.StatusSeeOther)
+	wantStatus(t, comment(), http.StatusForbidden)
+
+	wantStatus(t, e.postAction(Handler(LockPostHandler), "lock", post, moderator, nil), http.StatusSeeOther)
+	wantStatus(t, comment(), http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM audit_log WHERE action IN (?, ?) AND target_id = ?", ActionLock, ActionUnlock, post); n != 2 {
+		t.Errorf("%d lock audit entries, want 2", n)
+	}
+}
+
+func TestAnnouncePostNotifiesCategoryMembers(t *testing.T) {
+	e := newTestEnv(t)
+	instructor := e.addUser("instructor", RoleInstructor)
+	member := e.addUser("member", RoleStudent)
+	outsider := e.addUser("outsider", RoleStudent)
+	category := e.exec("INSERT INTO categories (name, slug) VALUES ('Maths', 'maths')")
+	e.exec("INSERT INTO category_members (category_id, user_id) VALUES (?, ?), (?, ?)",
+		category, member, category, instructor)
+	post := e.addPost(instructor, "Exam moved")
+	e.exec("UPDATE posts SET category_id = ? WHERE id = ?", category, post)
+	notified := func(user int64) int {
+		return e.queryInt("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = ? AND post_id = ?",
+			user, NotifyAnnouncement, post)
+	}
+
+	wantStatus(t, e.postAction(Handler(AnnouncePostHandler), "announce", post, member, nil), http.StatusForbidden)
+	wantStatus(t, e.postAction(Handler(AnnouncePostHandler), "announce", post, instructor, nil), http.StatusSeeOther)
+	if notified(member) != 1 || notified(outsider) != 0 || notified(instructor) != 0 {
+		t.Errorf("notified member %d, outsider %d, instructor %d times; want only the member once",
+			notified(member), notified(outsider), notified(instructor))
+	}
+
+	// Withdrawing the announcement doesn't notify anyone again.
+	wantStatus(t, e.postAction(Handler(AnnouncePostHandler), "announce", post, instructor, nil), http.StatusSeeOther)
+	if e.queryInt("SELECT is_announcement FROM posts WHERE id = ?", post) != 0 {
+		t.Error("post still an announcement")
+	}
+	if n := notified(member); n != 1 {
+		t.Errorf("member notified %d times, want 1", n)
+	}
+}
+
+func TestAnnouncePostSurvivesNotificationFailure(t *testing.T) {
+	e := newTestEnv(t)
+	instructor := e.addUser("instructor", RoleInstructor)
+	e.addUser("student", RoleStudent)
+	post := e.addPost(instructor, "Exam moved")
+	breakNotifications(e)
+
+	w := e.postAction(Handler(AnnouncePostHandler), "announce", post, instructor, nil)
+	wantStatus(t, w, http.StatusSeeOther)
+	if e.queryInt("SELECT is_announcement FROM posts WHERE id = ?", post) != 1 {
+		t.Error("announcement not saved")
+	}
+}
@@ -1,159 +1,454 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+
+	"university-forum/filter"
+	"university-forum/telemetry"
 )
 
 type Post struct {
-	ID         int64
-	Title      string
-	Content    string
-	AuthorID   int64
-	AuthorName string
-	CreatedAt  string
-	Comments   []Comment
+	ID             int64
+	Title          string
+	Content        string
+	AuthorID       int64
+	AuthorName     string
+	CreatedAt      string
+	IsAnonymous    bool
+	EndorsedBy     string
+	Tags           []string
+	Category       string
+	CategorySlug   string
+	PinScope       string
+	IsLocked       bool
+	IsAnnouncement bool
+	IsHidden       bool
+	Attachments    []Attachment
+	Comments       []Comment
+
+	// authorID and authorName are who really wrote the post, even when it
+	// is anonymous. They are never shown: cached pages are built for no
+	// viewer in particular and use them to unmask a post for its author.
+	authorID   int64
+	authorName string
 }
 
 type Comment struct {
-	ID         int64
-	Content    string
-	AuthorID   int64
-	AuthorName string
-	CreatedAt  string
+	ID          int64
+	Content     string
+	AuthorID    int64
+	AuthorName  string
+	CreatedAt   string
+	IsAnonymous bool
+	EndorsedBy  string
+	IsHidden    bool
+	Attachments []Attachment
+
+	// authorID and authorName are as for Post.
+	authorID   int64
+	authorName string
+}
+
+// maxTitleLength caps post titles so they fit on one line in listings.
+const maxTitleLength = 200
+
+// postFields are the new post form's fields that are shown again when it
+// has errors.
+var postFields = []string{"title", "content", "category", "tags", "anonymous", "announcement"}
+
+// CreatePostPage is the new post form.
+type CreatePostPage struct {
+	Page
+	Categories     []Category
+	Form           Form
+	MaxTitleLength int
 }
 
-func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
+func CreatePostHandler(w http.ResponseWriter, r *http.Request) error {
 	session, _ := store.Get(r, "session-name")
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
+		return nil
 	}
 
-	if r.Method == "POST" {
-		title := r.FormValue("title")
-		content := r.FormValue("content")
-		userID := session.Values["user_id"].(int64)
+	if r.Method != "POST" {
+		return renderCreatePost(w, r, Form{}, http.StatusOK)
+	}
 
-		if title == "" || content == "" {
-			http.Error(w, "Title and content are required", http.StatusBadRequest)
-			return
+	userID, role := currentUser(r)
+	defer removeUploads(r)
+	if err := limitUploads(w, r); err != nil {
+		form := newForm(r, postFields...)
+		if err := failUpload(err, &form, "Error reading upload"); err != nil {
+			return err
 		}
+		return renderCreatePost(w, r, form, http.StatusBadRequest)
+	}
+	if err := checkNotMuted(userID); err != nil {
+		return err
+	}
+
+	form := newForm(r, postFields...)
+	title, content := form.Get("title"), form.Get("content")
+	isAnonymous := form.Checked("anonymous")
+	isAnnouncement := form.Checked("announcement")
+	tags := parseTags(form.Get("tags"))
+
+	form.Required("title", "content")
+	form.MaxLength("title", maxTitleLength)
+
+	if isAnnouncement && !IsStaff(role) {
+		return newError(http.StatusForbidden, "Only instructors and moderators can post announcements")
+	}
 
-		_, err := db.Exec("INSERT INTO posts (title, content, author_id) VALUES (?, ?, ?)",
-			title, content, userID)
+	var categoryID sql.NullInt64
+	if slug := form.Get("category"); slug != "" {
+		category, err := categoryBySlug(slug, userID)
 		if err != nil {
-			http.Error(w, "Error creating post", http.StatusInternalServerError)
-			return
+			form.Fail("category", "Choose one of the listed categories")
+		} else {
+			categoryID = sql.NullInt64{Int64: category.ID, Valid: true}
 		}
+	}
+	if !form.Valid() {
+		return renderCreatePost(w, r, form, http.StatusBadRequest)
+	}
 
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	decision, err := screenContent(r, userID, role, title, content)
+	if err != nil {
+		return internalError(err, "Error checking content")
 	}
+	if decision.Verdict == filter.Reject {
+		form.Fail(formError, rejection(decision))
+		return renderCreatePost(w, r, form, http.StatusBadRequest)
+	}
+	held := decision.Verdict == filter.Hold
 
-	isAuthenticated, _ := session.Values["authenticated"].(bool)
-	err := templates.ExecuteTemplate(w, "create-post.html", map[string]interface{}{
-		"IsAuthenticated": isAuthenticated,
-		"PageID":          "create-post",
-	})
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error creating post")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `
+		INSERT INTO posts (title, content, author_id, is_anonymous, category_id, is_announcement, is_hidden)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, title, content, userID, isAnonymous, categoryID, isAnnouncement, held)
+	if err != nil {
+		return internalError(err, "Error creating post")
+	}
+	postID, _ := result.LastInsertId()
+	if held {
+		if err := holdContent(tx, reportedContent{PostID: postID}, userID, decision); err != nil {
+			return internalError(err, "Error creating post")
+		}
+	}
+	if err := setPostTags(tx, postID, tags); err != nil {
+		return internalError(err, "Error creating post")
+	}
+	err = saveAttachments(r.Context(), tx, r, attachmentOwner{PostID: postID}, userID)
+	if err != nil {
+		if err := failUpload(err, &form, "Error saving attachments"); err != nil {
+			return err
+		}
+		tx.Rollback()
+		return renderCreatePost(w, r, form, http.StatusBadRequest)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error creating post")
+	}
+	telemetry.PostsCreated.Inc()
+	invalidatePost(postID)
 
+	// Held posts are announced once a moderator approves them.
+	if held {
+		addFlash(w, r, FlashInfo, "Your post will appear once a moderator has reviewed it.")
+		http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+		return nil
+	}
+	if isAnnouncement {
+		logAnnounceError(r, notifyAnnouncement(postID, userID), "sending announcement")
+	}
+	logAnnounceError(r, notifyPost(postID, userID, isAnonymous, title, content), "sending notifications")
+	logAnnounceError(r, publishPost(postID), "publishing post")
+
+	addFlash(w, r, FlashSuccess, "Your post has been published.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+func renderCreatePost(w http.ResponseWriter, r *http.Request, form Form, status int) error {
+	viewerID, _ := currentUser(r)
+	categories, err := listCategories(viewerID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return internalError(err, "Error fetching categories")
 	}
+
+	return render(w, "create-post.html", CreatePostPage{
+		Page:           newPage(w, r, "create-post", "Create Post"),
+		Categories:     categories,
+		Form:           form,
+		MaxTitleLength: maxTitleLength,
+	}, status)
 }
 
-func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session-name")
-	isAuthenticated, _ := session.Values["authenticated"].(bool)
+// ViewPostPage is a post with its comments.
+type ViewPostPage struct {
+	Page
+	Post          Post
+	IsFollowing   bool
+	ReportReasons []ReportReason
+	CommentForm   Form
+}
 
-	vars := mux.Vars(r)
-	postID, err := strconv.ParseInt(vars["id"], 10, 64)
+func ViewPostHandler(w http.ResponseWriter, r *http.Request) error {
+	postID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
-		return
+		return newError(http.StatusBadRequest, "Invalid post ID")
 	}
+	return renderPost(w, r, postID, Form{}, http.StatusOK)
+}
+
+// renderPost shows a post and its comments, with commentForm filled in when
+// a comment is being shown again with errors.
+func renderPost(w http.ResponseWriter, r *http.Request, postID int64, commentForm Form, status int) error {
+	viewerID, role := currentUser(r)
+
+	view, err := postCache.Load(postKey(postID, role), func() (postView, error) {
+		return loadPost(r.Context(), postID, role)
+	})
+	if err != nil {
+		return err
+	}
+	post, ok := view.forViewer(viewerID, role)
+	if !ok {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	var isFollowing bool
+	if viewerID != 0 {
+		isFollowing, err = isFollowingPost(viewerID, post.ID)
+		if err != nil {
+			return internalError(err, "Error fetching post")
+		}
+		if err := markPostNotificationsRead(viewerID, post.ID); err != nil {
+			return internalError(err, "Error updating notifications")
+		}
+	}
+
+	page := ViewPostPage{
+		Page:          newPage(w, r, "view-post", post.Title),
+		Post:          post,
+		IsFollowing:   isFollowing,
+		ReportReasons: reportReasons,
+		CommentForm:   commentForm,
+	}
+	if status != http.StatusOK {
+		return render(w, "view-post.html", page, status)
+	}
+	return renderCacheable(w, r, "view-post.html", page, view.built)
+}
+
+// loadPost fetches a post and its comments as a viewer with the given role
+// and no ID sees them, except that hidden content is included for
+// postView.forViewer to filter.
+func loadPost(ctx context.Context, postID int64, role string) (postView, error) {
+	args := append(viewerArgs(0, role), sql.Named("post", postID))
 
 	var post Post
-	err = db.QueryRow(`
-		SELECT p.id, p.title, p.content, p.author_id, u.username, p.created_at
+	err := queryRowPrepared(ctx, `
+		SELECT p.id, p.title, p.content, `+visibleAuthor("p")+`, p.created_at,
+			p.is_anonymous, COALESCE(e.username, ''), COALESCE(cat.name, ''), COALESCE(cat.slug, ''),
+			p.pin_scope, p.is_locked, p.is_announcement, p.is_hidden, p.author_id, u.username
 		FROM posts p
 		JOIN users u ON p.author_id = u.id
-		WHERE p.id = ?
-	`, postID).Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.AuthorName, &post.CreatedAt)
+		LEFT JOIN users e ON p.endorsed_by = e.id
+		LEFT JOIN categories cat ON p.category_id = cat.id
+		WHERE p.id = @post
+	`, args...).Scan(
+		&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.AuthorName, &post.CreatedAt, &post.IsAnonymous,
+		&post.EndorsedBy, &post.Category, &post.CategorySlug, &post.PinScope, &post.IsLocked, &post.IsAnnouncement,
+		&post.IsHidden, &post.authorID, &post.authorName)
 	if err != nil {
-		http.Error(w, "Post not found", http.StatusNotFound)
-		return
+		return postView{}, newError(http.StatusNotFound, "Post not found")
+	}
+
+	post.Tags, err = postTags(post.ID)
+	if err != nil {
+		return postView{}, internalError(err, "Error fetching tags")
+	}
+
+	post.Attachments, err = attachmentsFor(attachmentOwner{PostID: post.ID})
+	if err != nil {
+		return postView{}, internalError(err, "Error fetching attachments")
 	}
 
 	// Get comments
-	rows, err := db.Query(`
-		SELECT c.id, c.content, c.author_id, u.username, c.created_at
+	rows, err := queryPrepared(ctx, `
+		SELECT c.id, c.content, `+visibleAuthor("c")+`, c.created_at,
+			c.is_anonymous, COALESCE(e.username, ''), c.is_hidden, c.author_id, u.username
 		FROM comments c
 		JOIN users u ON c.author_id = u.id
-		WHERE c.post_id = ?
+		LEFT JOIN users e ON c.endorsed_by = e.id
+		WHERE c.post_id = @post
 		ORDER BY c.created_at DESC
-	`, postID)
+	`, args...)
 	if err != nil {
-		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
-		return
+		return postView{}, internalError(err, "Error fetching comments")
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var comment Comment
-		err := rows.Scan(&comment.ID, &comment.Content, &comment.AuthorID, &comment.AuthorName, &comment.CreatedAt)
+		err := rows.Scan(&comment.ID, &comment.Content, &comment.AuthorID, &comment.AuthorName, &comment.CreatedAt,
+			&comment.IsAnonymous, &comment.EndorsedBy, &comment.IsHidden, &comment.authorID, &comment.authorName)
 		if err != nil {
 			continue
 		}
 		post.Comments = append(post.Comments, comment)
 	}
 
-	err = templates.ExecuteTemplate(w, "view-post.html", map[string]interface{}{
-		"IsAuthenticated": isAuthenticated,
-		"PageID":          "view-post",
-		"ID":              post.ID,
-		"Title":           post.Title,
-		"Content":         post.Content,
-		"AuthorID":        post.AuthorID,
-		"AuthorName":      post.AuthorName,
-		"CreatedAt":       post.CreatedAt,
-		"Comments":        post.Comments,
-	})
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	for i := range post.Comments {
+		post.Comments[i].Attachments, err = attachmentsFor(attachmentOwner{CommentID: post.Comments[i].ID})
+		if err != nil {
+			return postView{}, internalError(err, "Error fetching attachments")
+		}
 	}
+
+	return postView{post: post, built: time.Now()}, nil
 }
 
-func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
+// commentFields are the comment form's fields that are shown again when it
+// has errors.
+var commentFields = []string{"content", "anonymous"}
+
+func AddCommentHandler(w http.ResponseWriter, r *http.Request) error {
 	session, _ := store.Get(r, "session-name")
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return newError(http.StatusUnauthorized, "Unauthorized")
 	}
 
 	vars := mux.Vars(r)
 	postID, err := strconv.ParseInt(vars["id"], 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
-		return
+		return newError(http.StatusBadRequest, "Invalid post ID")
 	}
 
-	content := r.FormValue("content")
-	if content == "" {
-		http.Error(w, "Comment content is required", http.StatusBadRequest)
-		return
+	userID, role := currentUser(r)
+	var isLocked bool
+	err = db.QueryRowContext(r.Context(), "SELECT is_locked FROM posts WHERE id = ? AND (is_hidden = 0 OR ? OR author_id = ?)",
+		postID, IsModerator(role), userID).Scan(&isLocked)
+	if err != nil {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+	if isLocked {
+		return newError(http.StatusForbidden, "This discussion has been locked by an instructor and is no longer accepting comments")
+	}
+
+	defer removeUploads(r)
+	if err := limitUploads(w, r); err != nil {
+		form := newForm(r, commentFields...)
+		if err := failUpload(err, &form, "Error reading upload"); err != nil {
+			return err
+		}
+		return renderPost(w, r, postID, form, http.StatusBadRequest)
+	}
+	if err := checkNotMuted(userID); err != nil {
+		return err
 	}
 
-	userID := session.Values["user_id"].(int64)
-	_, err = db.Exec("INSERT INTO comments (content, post_id, author_id) VALUES (?, ?, ?)",
-		content, postID, userID)
+	form := newForm(r, commentFields...)
+	content := form.Get("content")
+	isAnonymous := form.Checked("anonymous")
+	form.Required("content")
+	if !form.Valid() {
+		return renderPost(w, r, postID, form, http.StatusBadRequest)
+	}
+
+	decision, err := screenContent(r, userID, role, "", content)
 	if err != nil {
-		http.Error(w, "Error adding comment", http.StatusInternalServerError)
-		return
+		return internalError(err, "Error checking content")
+	}
+	if decision.Verdict == filter.Reject {
+		form.Fail(formError, rejection(decision))
+		return renderPost(w, r, postID, form, http.StatusBadRequest)
 	}
+	held := decision.Verdict == filter.Hold
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `
+		INSERT INTO comments (content, post_id, author_id, is_anonymous, is_hidden) VALUES (?, ?, ?, ?, ?)
+	`, content, postID, userID, isAnonymous, held)
+	if err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	commentID, _ := result.LastInsertId()
+	if held {
+		if err := holdContent(tx, reportedContent{CommentID: commentID}, userID, decision); err != nil {
+			return internalError(err, "Error adding comment")
+		}
+	}
+	err = saveAttachments(r.Context(), tx, r, attachmentOwner{CommentID: commentID}, userID)
+	if err != nil {
+		if err := failUpload(err, &form, "Error saving attachments"); err != nil {
+			return err
+		}
+		tx.Rollback()
+		return renderPost(w, r, postID, form, http.StatusBadRequest)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error adding comment")
+	}
+	telemetry.CommentsCreated.Inc()
+	invalidateComments(postID)
+
+	// Held comments are announced once a moderator approves them.
+	if held {
+		addFlash(w, r, FlashInfo, "Your comment will appear once a moderator has reviewed it.")
+		http.Redirect(w, r, "/post/"+vars["id"], http.StatusSeeOther)
+		return nil
+	}
+	logAnnounceError(r, notifyComment(postID, commentID, userID, isAnonymous, content), "sending notifications")
+	logAnnounceError(r, publishComment(postID, commentID), "publishing comment")
 
 	http.Redirect(w, r, "/post/"+vars["id"], http.StatusSeeOther)
+	return nil
+}
+
+// logAnnounceError logs a failure to notify or publish new content. These
+// steps run once the content has been saved, so they don't fail the request:
+// showing the author an error would only tempt them to post it again.
+func logAnnounceError(r *http.Request, err error, msg string) {
+	if err != nil {
+		logger(r.Context()).Error(msg, "error", err)
+	}
+}
+
+// AnonymousAuthor is the name students see in place of an anonymous author.
+const AnonymousAuthor = "Anonymous"
+
+// visibleAuthor returns the select columns for the author ID and name of the
+// post or comment aliased as alias, which must be joined to users as u.
+// Anonymous authors are only revealed to staff and to the author themselves,
+// so queries using it must bind the named arguments from viewerArgs.
+func visibleAuthor(alias string) string {
+	hidden := fmt.Sprintf("%s.is_anonymous = 1 AND @staff = 0 AND %s.author_id != @viewer", alias, alias)
+	return fmt.Sprintf("CASE WHEN %s THEN 0 ELSE %s.author_id END, CASE WHEN %s THEN '%s' ELSE u.username END",
+		hidden, alias, hidden, AnonymousAuthor)
+}
+
+func viewerArgs(viewerID int64, role string) []interface{} {
+	return []interface{}{sql.Named("staff", IsStaff(role)), sql.Named("viewer", viewerID)}
 }
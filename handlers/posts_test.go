@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// breakNotifications makes every attempt to notify a user fail.
+func breakNotifications(e *testEnv) {
+	e.exec("DROP TABLE notifications")
+}
+
+func TestCreatePostSurvivesNotificationFailure(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	e.addUser("bob", RoleStudent)
+	breakNotifications(e)
+
+	w := e.do(Handler(CreatePostHandler), request{
+		method: http.MethodPost,
+		target: "/create-post",
+		user:   author,
+		form:   url.Values{"title": {"Question"}, "content": {"What do you think, @bob?"}},
+	})
+	wantStatus(t, w, http.StatusSeeOther)
+	if n := e.queryInt("SELECT COUNT(*) FROM posts WHERE author_id = ?", author); n != 1 {
+		t.Errorf("%d posts saved, want 1", n)
+	}
+}
+
+func TestAddCommentSurvivesNotificationFailure(t *testing.T) {
+	e := newTestEnv(t)
+	author := e.addUser("author", RoleStudent)
+	commenter := e.addUser("commenter", RoleStudent)
+	post := e.addPost(author, "Question")
+	breakNotifications(e)
+
+	id := strconv.FormatInt(post, 10)
+	w := e.do(Handler(AddCommentHandler), request{
+		method: http.MethodPost,
+		target: "/post/" + id + "/comment",
+		vars:   map[string]string{"id": id},
+		user:   commenter,
+		form:   url.Values{"content": {"An answer, @author"}},
+	})
+	wantStatus(t, w, http.StatusSeeOther)
+	if got := w.Header().Get("Location"); got != "/post/"+id {
+		t.Errorf("redirected to %q, want the post", got)
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM comments WHERE post_id = ?", post); n != 1 {
+		t.Errorf("%d comments saved, want 1", n)
+	}
+}
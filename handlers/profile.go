@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"university-forum/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	avatarSize       = 256
+	maxAvatarSize    = 5 << 20
+	maxBioLength     = 1000
+	maxProfileLength = 100
+)
+
+// User is the account shown on a profile page. Email is only filled in when
+// the viewer is allowed to see it.
+type User struct {
+	ID        int64
+	Username  string
+	Email     string
+	CreatedAt string
+}
+
+// Profile holds a user's editable profile fields and which of them are public.
+type Profile struct {
+	DisplayName      string
+	Bio              string
+	Department       string
+	Year             string
+	Pronouns         string
+	HasAvatar        bool
+	EmailPublic      bool
+	BioPublic        bool
+	DepartmentPublic bool
+	YearPublic       bool
+	PronounsPublic   bool
+}
+
+// visibleTo returns a copy of the profile with private fields cleared, unless
+// the viewer is the owner.
+func (p Profile) visibleTo(isOwner bool) Profile {
+	if isOwner {
+		return p
+	}
+	if !p.BioPublic {
+		p.Bio = ""
+	}
+	if !p.DepartmentPublic {
+		p.Department = ""
+	}
+	if !p.YearPublic {
+		p.Year = ""
+	}
+	if !p.PronounsPublic {
+		p.Pronouns = ""
+	}
+	return p
+}
+
+// loadProfile returns the user and profile for a username. Users who have
+// never edited their profile get the defaults: everything public but email.
+func loadProfile(username string) (User, Profile, error) {
+	var u User
+	var p Profile
+	var avatarKey sql.NullString
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.email, u.created_at,
+			COALESCE(pr.display_name, ''), COALESCE(pr.bio, ''), COALESCE(pr.department, ''),
+			COALESCE(pr.year, ''), COALESCE(pr.pronouns, ''), pr.avatar_key,
+			COALESCE(pr.email_public, 0), COALESCE(pr.bio_public, 1), COALESCE(pr.department_public, 1),
+			COALESCE(pr.year_public, 1), COALESCE(pr.pronouns_public, 1)
+		FROM users u
+		LEFT JOIN user_profiles pr ON pr.user_id = u.id
+		WHERE u.username = ?
+	`, username).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt,
+		&p.DisplayName, &p.Bio, &p.Department, &p.Year, &p.Pronouns, &avatarKey,
+		&p.EmailPublic, &p.BioPublic, &p.DepartmentPublic, &p.YearPublic, &p.PronounsPublic)
+	p.HasAvatar = avatarKey.Valid
+	return u, p, err
+}
+
+// ProfilePage is a user's profile. UserRole and the sanction fields are only
+// filled in for moderators.
+type ProfilePage struct {
+	Page
+	User              User
+	Profile           Profile
+	Posts             []Post
+	Pagination        Pagination
+	IsOwner           bool
+	IsBlocked         bool
+	UserRole          string
+	Roles             []string
+	Sanctions         []Sanction
+	SanctionKinds     []SanctionKind
+	SanctionDurations []SanctionDuration
+}
+
+// UserProfileHandler shows a user's public profile and posts. Fields the user
+// has marked private, including their email by default, are only shown to
+// the user themselves.
+func UserProfileHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+
+	user, profile, err := loadProfile(mux.Vars(r)["username"])
+	if err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+
+	isOwner := viewerID != 0 && viewerID == user.ID
+	if !isOwner && !profile.EmailPublic {
+		user.Email = ""
+	}
+	profile = profile.visibleTo(isOwner)
+	user.CreatedAt = formatDate(user.CreatedAt, "Jan 02, 2006")
+
+	// Anonymous posts stay anonymous on the author's profile.
+	posts, pagination, err := listPosts(viewerID, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		WHERE p.author_id = @author AND (p.is_anonymous = 0 OR @reveal)
+	`, pageParam(r), sql.Named("author", user.ID), sql.Named("reveal", isOwner || IsStaff(role)))
+	if err != nil {
+		return internalError(err, "Error fetching posts")
+	}
+
+	var sanctions []Sanction
+	var userRole string
+	if IsModerator(role) {
+		sanctions, err = userSanctions(user.ID, false)
+		if err != nil {
+			return internalError(err, "Error fetching sanctions")
+		}
+		if err := db.QueryRowContext(r.Context(), "SELECT role FROM users WHERE id = ?", user.ID).Scan(&userRole); err != nil {
+			return internalError(err, "Error fetching user")
+		}
+	}
+
+	var isBlocked bool
+	if viewerID != 0 {
+		isBlocked, err = hasBlocked(viewerID, user.ID)
+		if err != nil {
+			return internalError(err, "Error fetching user")
+		}
+	}
+
+	return templates.ExecuteTemplate(w, "profile.html", ProfilePage{
+		Page:              newPage(w, r, "profile", user.Username),
+		User:              user,
+		Profile:           profile,
+		Posts:             posts,
+		Pagination:        pagination,
+		IsOwner:           isOwner,
+		IsBlocked:         isBlocked,
+		UserRole:          userRole,
+		Roles:             roles,
+		Sanctions:         sanctions,
+		SanctionKinds:     sanctionKinds,
+		SanctionDurations: sanctionDurations,
+	})
+}
+
+// EditProfilePage is the profile form.
+type EditProfilePage struct {
+	Page
+	Form             Form
+	HasAvatar        bool
+	MaxBioLength     int
+	MaxProfileLength int
+}
+
+// profileFields are the profile form's fields, including the privacy
+// checkboxes.
+var profileFields = []string{"display_name", "bio", "department", "year", "pronouns",
+	"email_public", "bio_public", "department_public", "year_public", "pronouns_public"}
+
+// profileForm fills in the profile form with a user's current profile.
+func profileForm(p Profile) Form {
+	f := Form{Values: url.Values{}}
+	f.Values.Set("display_name", p.DisplayName)
+	f.Values.Set("bio", p.Bio)
+	f.Values.Set("department", p.Department)
+	f.Values.Set("year", p.Year)
+	f.Values.Set("pronouns", p.Pronouns)
+	for field, public := range map[string]bool{
+		"email_public":      p.EmailPublic,
+		"bio_public":        p.BioPublic,
+		"department_public": p.DepartmentPublic,
+		"year_public":       p.YearPublic,
+		"pronouns_public":   p.PronounsPublic,
+	} {
+		if public {
+			f.Values.Set(field, "on")
+		}
+	}
+	return f
+}
+
+// EditProfileHandler lets the logged-in user edit their own profile, privacy
+// settings and avatar.
+func EditProfileHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	var username string
+	if err := db.QueryRowContext(r.Context(), "SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+	_, profile, err := loadProfile(username)
+	if err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+	if r.Method != "POST" {
+		return renderEditProfile(w, r, profileForm(profile), profile.HasAvatar, http.StatusOK)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<20)
+	defer removeUploads(r)
+	if err := r.ParseMultipartForm(maxAvatarSize); err != nil && err != http.ErrNotMultipart {
+		form := newForm(r, profileFields...)
+		form.Fail("avatar", "Avatar images are limited to 5 MB")
+		return renderEditProfile(w, r, form, profile.HasAvatar, http.StatusBadRequest)
+	}
+
+	form := newForm(r, profileFields...)
+	form.MaxLength("display_name", maxProfileLength)
+	form.MaxLength("bio", maxBioLength)
+	form.MaxLength("department", maxProfileLength)
+	form.MaxLength("year", maxProfileLength)
+	form.MaxLength("pronouns", maxProfileLength)
+
+	// The avatar is checked before anything is saved, so a bad image
+	// doesn't leave the rest of the profile half updated.
+	removeAvatar := r.FormValue("remove_avatar") == "on"
+	var avatar []byte
+	if file, _, err := r.FormFile("avatar"); err == nil && !removeAvatar {
+		defer file.Close()
+		if avatar, err = storage.Avatar(file, avatarSize); err != nil {
+			form.Fail("avatar", "Avatar must be a PNG, JPEG or GIF image")
+		}
+	}
+	if !form.Valid() {
+		return renderEditProfile(w, r, form, profile.HasAvatar, http.StatusBadRequest)
+	}
+
+	_, err = writeDB.ExecContext(r.Context(), `
+		INSERT INTO user_profiles (user_id, display_name, bio, department, year, pronouns,
+			email_public, bio_public, department_public, year_public, pronouns_public)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			display_name = excluded.display_name,
+			bio = excluded.bio,
+			department = excluded.department,
+			year = excluded.year,
+			pronouns = excluded.pronouns,
+			email_public = excluded.email_public,
+			bio_public = excluded.bio_public,
+			department_public = excluded.department_public,
+			year_public = excluded.year_public,
+			pronouns_public = excluded.pronouns_public
+	`, userID, form.Get("display_name"), form.Get("bio"),
+		form.Get("department"), form.Get("year"), form.Get("pronouns"),
+		form.Checked("email_public"), form.Checked("bio_public"), form.Checked("department_public"),
+		form.Checked("year_public"), form.Checked("pronouns_public"))
+	if err != nil {
+		return internalError(err, "Error saving profile")
+	}
+
+	if removeAvatar {
+		if err := setAvatar(r, userID, nil); err != nil {
+			return internalError(err, "Error removing avatar")
+		}
+	} else if avatar != nil {
+		if err := setAvatar(r, userID, avatar); err != nil {
+			return internalError(err, "Error saving avatar")
+		}
+	}
+
+	http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+	return nil
+}
+
+func renderEditProfile(w http.ResponseWriter, r *http.Request, form Form, hasAvatar bool, status int) error {
+	return render(w, "edit-profile.html", EditProfilePage{
+		Page:             newPage(w, r, "edit-profile", "Edit Profile"),
+		Form:             form,
+		HasAvatar:        hasAvatar,
+		MaxBioLength:     maxBioLength,
+		MaxProfileLength: maxProfileLength,
+	}, status)
+}
+
+// setAvatar stores a new avatar image for a user, or removes the current one
+// when avatar is nil.
+func setAvatar(r *http.Request, userID int64, avatar []byte) error {
+	var oldKey sql.NullString
+	db.QueryRowContext(r.Context(), "SELECT avatar_key FROM user_profiles WHERE user_id = ?", userID).Scan(&oldKey)
+
+	var newKey sql.NullString
+	if avatar != nil {
+		key, err := newBlobKey()
+		if err != nil {
+			return err
+		}
+		newKey = sql.NullString{String: strings.Replace(key, "attachments/", "avatars/", 1), Valid: true}
+		err = blobs.Put(r.Context(), newKey.String, bytes.NewReader(avatar), int64(len(avatar)), "image/png")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := writeDB.ExecContext(r.Context(), "UPDATE user_profiles SET avatar_key = ? WHERE user_id = ?", newKey, userID)
+	if err != nil {
+		return err
+	}
+	if oldKey.Valid {
+		blobs.Delete(r.Context(), oldKey.String)
+	}
+	return nil
+}
+
+// AvatarHandler serves a user's avatar image, falling back to a generated
+// placeholder for users without one.
+func AvatarHandler(w http.ResponseWriter, r *http.Request) error {
+	username := mux.Vars(r)["username"]
+
+	var key sql.NullString
+	db.QueryRowContext(r.Context(), `
+		SELECT pr.avatar_key
+		FROM users u
+		JOIN user_profiles pr ON pr.user_id = u.id
+		WHERE u.username = ?
+	`, username).Scan(&key)
+	if !key.Valid {
+		http.Redirect(w, r, "https://ui-avatars.com/api/?size=150&background=random&name="+url.QueryEscape(username), http.StatusFound)
+		return nil
+	}
+
+	body, err := blobs.Get(r.Context(), key.String)
+	if err != nil {
+		return newError(http.StatusNotFound, "Avatar not found")
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	io.Copy(w, body)
+	return nil
+}
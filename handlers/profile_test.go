@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestProfileVisibleTo(t *testing.T) {
+	p := Profile{Bio: "Hello", Department: "CS", Year: "2", Pronouns: "they/them", DepartmentPublic: true}
+	if got := p.visibleTo(true); got != p {
+		t.Errorf("owner sees %+v, want everything", got)
+	}
+	got := p.visibleTo(false)
+	if got.Bio != "" || got.Year != "" || got.Pronouns != "" {
+		t.Errorf("others see private fields: %+v", got)
+	}
+	if got.Department != "CS" {
+		t.Errorf("others don't see the public department: %+v", got)
+	}
+}
+
+func TestProfilePrivacy(t *testing.T) {
+	e := newTestEnv(t)
+	owner := e.addUser("owner", RoleStudent)
+	viewer := e.addUser("viewer", RoleStudent)
+	e.exec(`INSERT INTO user_profiles (user_id, bio, department, email_public, bio_public, department_public)
+		VALUES (?, 'Secret bio', 'Physics', 0, 0, 1)`, owner)
+
+	view := func(user int64) string {
+		t.Helper()
+		w := e.do(Handler(UserProfileHandler), request{method: http.MethodGet, target: "/user/owner",
+			vars: map[string]string{"username": "owner"}, user: user})
+		wantStatus(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+
+	for name, user := range map[string]int64{"guest": 0, "other user": viewer} {
+		body := view(user)
+		if strings.Contains(body, "owner@example.edu") || strings.Contains(body, "Secret bio") {
+			t.Errorf("%s sees the private email or bio", name)
+		}
+		if !strings.Contains(body, "Physics") {
+			t.Errorf("%s doesn't see the public department", name)
+		}
+	}
+	body := view(owner)
+	if !strings.Contains(body, "owner@example.edu") || !strings.Contains(body, "Secret bio") {
+		t.Error("owner doesn't see their own private fields")
+	}
+
+	e.exec("UPDATE user_profiles SET email_public = 1 WHERE user_id = ?", owner)
+	if !strings.Contains(view(viewer), "owner@example.edu") {
+		t.Error("public email not shown")
+	}
+}
+
+// editProfile submits the profile form as user, with an avatar if one is
+// given.
+func (e *testEnv) editProfile(user int64, fields url.Values, avatar []byte) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, v := range values {
+			mw.WriteField(name, v)
+		}
+	}
+	if avatar != nil {
+		part, err := mw.CreateFormFile("avatar", "me.png")
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		part.Write(avatar)
+	}
+	mw.Close()
+	return e.do(Handler(EditProfileHandler), request{method: http.MethodPost, target: "/user/edit", user: user,
+		body: &body, contentType: mw.FormDataContentType()})
+}
+
+func TestEditProfileLengthLimits(t *testing.T) {
+	e := newTestEnv(t)
+	user := e.addUser("user", RoleStudent)
+
+	// Limits count characters, not bytes.
+	name := strings.Repeat("é", maxProfileLength)
+	w := e.editProfile(user, url.Values{"display_name": {name}, "bio_public": {"on"}}, nil)
+	wantStatus(t, w, http.StatusSeeOther)
+	var saved string
+	if err := db.QueryRow("SELECT display_name FROM user_profiles WHERE user_id = ?", user).Scan(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved != name || !utf8.ValidString(saved) {
+		t.Errorf("saved display name %q, want %q", saved, name)
+	}
+	w = e.do(Handler(EditProfileHandler), request{method: http.MethodGet, target: "/user/edit", user: user})
+	wantStatus(t, w, http.StatusOK)
+	if body := w.Body.String(); !strings.Contains(body, name) || !strings.Contains(body, `id="bio_public" name="bio_public" checked`) {
+		t.Error("form doesn't show the saved profile")
+	}
+
+	// Too long is refused with the form shown again, not cut short.
+	bio := strings.Repeat("ü", maxBioLength+1)
+	w = e.editProfile(user, url.Values{"display_name": {"New name"}, "bio": {bio}}, nil)
+	wantStatus(t, w, http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "Must be at most 1000 characters") {
+		t.Error("form shown without an error on the bio")
+	}
+	if !strings.Contains(w.Body.String(), "New name") {
+		t.Error("form shown without what the user typed")
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM user_profiles WHERE user_id = ? AND display_name = ?", user, name); n != 1 {
+		t.Error("profile changed despite the error")
+	}
+}
+
+func TestEditProfileAvatar(t *testing.T) {
+	e := newTestEnv(t)
+	user := e.addUser("user", RoleStudent)
+	avatar := func() *httptest.ResponseRecorder {
+		return e.do(Handler(AvatarHandler), request{method: http.MethodGet, target: "/user/user/avatar",
+			vars: map[string]string{"username": "user"}})
+	}
+	wantStatus(t, avatar(), http.StatusFound)
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 300))); err != nil {
+		t.Fatal(err)
+	}
+	wantStatus(t, e.editProfile(user, url.Values{"display_name": {"Me"}}, img.Bytes()), http.StatusSeeOther)
+	w := avatar()
+	wantStatus(t, w, http.StatusOK)
+	served, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := served.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+		t.Errorf("avatar is %dx%d, want %dx%d", b.Dx(), b.Dy(), avatarSize, avatarSize)
+	}
+
+	// A file that isn't an image is refused without saving anything else.
+	w = e.editProfile(user, url.Values{"display_name": {"Changed"}}, []byte("not an image"))
+	wantStatus(t, w, http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "Avatar must be a PNG, JPEG or GIF image") {
+		t.Error("form shown without an error on the avatar")
+	}
+	if n := e.queryInt("SELECT COUNT(*) FROM user_profiles WHERE user_id = ? AND display_name = 'Me'", user); n != 1 {
+		t.Error("profile changed despite the bad avatar")
+	}
+
+	wantStatus(t, e.editProfile(user, url.Values{"remove_avatar": {"on"}}, nil), http.StatusSeeOther)
+	wantStatus(t, avatar(), http.StatusFound)
+}
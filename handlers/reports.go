@@ -0,0 +1,682 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Report statuses stored in reports.status.
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// Moderation actions stored in moderation_actions.action.
+const (
+	ActionDismiss = "dismiss"
+	ActionHide    = "hide"
+	ActionUnhide  = "unhide"
+	ActionDelete  = "delete"
+	ActionWarn    = "warn"
+)
+
+const (
+	reportPageSize      = 100
+	maxReportDetails    = 1000
+	maxModerationNote   = 1000
+	warningSubject      = "Moderator warning"
+	deletedContentLabel = "[deleted]"
+)
+
+// ReportReason is a category users choose from when reporting content.
+type ReportReason struct {
+	Value string
+	Label string
+}
+
+var reportReasons = []ReportReason{
+	{"spam", "Spam or advertising"},
+	{"harassment", "Harassment or bullying"},
+	{"hate", "Hate speech"},
+	{"inappropriate", "Inappropriate or explicit content"},
+	{"academic-integrity", "Academic integrity violation"},
+	{"other", "Something else"},
+}
+
+// QueueAction is a bulk action offered on the moderation queue.
+type QueueAction struct {
+	Value string
+	Label string
+}
+
+var queueActions = []QueueAction{
+	{ActionDismiss, "Dismiss"},
+	{ActionHide, "Hide content"},
+	{ActionDelete, "Delete content"},
+	{ActionWarn, "Warn author"},
+}
+
+func reportReasonLabel(value string) string {
+	for _, r := range reportReasons {
+		if r.Value == value {
+			return r.Label
+		}
+	}
+	return ""
+}
+
+// Report is an entry in the moderation queue. PostID is set for reported
+// comments too, pointing at the thread they belong to; both are 0 once the
+// content has been deleted. The Action fields describe how the report was
+// resolved.
+type Report struct {
+	ID           int64
+	Reason       string
+	ReasonLabel  string
+	Details      string
+	ReporterName string
+	Status       string
+	CreatedAt    string
+	PostID       int64
+	CommentID    int64
+	Title        string
+	Content      string
+	AuthorName   string
+	IsHidden     bool
+	Action       string
+	ActionBy     string
+	ActionNote   string
+	ActionAt     string
+}
+
+// IsComment reports whether the report is about a comment rather than a post.
+func (r Report) IsComment() bool {
+	return r.CommentID != 0
+}
+
+// reportedContent identifies a reported post or comment. Exactly one of the
+// IDs is set.
+type reportedContent struct {
+	PostID    int64
+	CommentID int64
+}
+
+// where returns a condition matching reports about the content.
+func (c reportedContent) where() (string, int64) {
+	if c.CommentID != 0 {
+		return "comment_id = ?", c.CommentID
+	}
+	return "post_id = ?", c.PostID
+}
+
+// ReportPostHandler reports a post to the moderators.
+func ReportPostHandler(w http.ResponseWriter, r *http.Request) error {
+	postID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid post ID")
+	}
+
+	var exists bool
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM posts WHERE id = ?)", postID).Scan(&exists)
+	if err != nil || !exists {
+		return newError(http.StatusNotFound, "Post not found")
+	}
+
+	return submitReport(w, r, reportedContent{PostID: postID}, postID)
+}
+
+// ReportCommentHandler reports a comment to the moderators.
+func ReportCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	commentID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid comment ID")
+	}
+
+	var postID int64
+	err = db.QueryRowContext(r.Context(), "SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Comment not found")
+	}
+
+	return submitReport(w, r, reportedContent{CommentID: commentID}, postID)
+}
+
+// submitReport records a report from the logged-in user and takes them back
+// to the thread. A user's repeated reports of the same content while it is
+// still open are ignored.
+func submitReport(w http.ResponseWriter, r *http.Request, content reportedContent, postID int64) error {
+	userID, _ := currentUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	reason := r.FormValue("reason")
+	if reportReasonLabel(reason) == "" {
+		return newError(http.StatusBadRequest, "Please choose a reason for your report")
+	}
+	details := strings.TrimSpace(r.FormValue("details"))
+	if len(details) > maxReportDetails {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Report details are limited to %d characters", maxReportDetails))
+	}
+
+	condition, contentID := content.where()
+	_, err := writeDB.ExecContext(r.Context(), `
+		INSERT INTO reports (reporter_id, post_id, comment_id, reason, details)
+		SELECT ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM reports WHERE reporter_id = ? AND status = ? AND `+condition+`
+		)
+	`, userID, nullID(content.PostID), nullID(content.CommentID), reason, details, userID, ReportOpen, contentID)
+	if err != nil {
+		return internalError(err, "Error saving report")
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+	return nil
+}
+
+func listReports(status, reason, kind string) ([]Report, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.reason, r.details, reporter.username, r.status, r.created_at,
+			COALESCE(p.id, c.post_id, 0), COALESCE(r.comment_id, 0),
+			COALESCE(p.title, cp.title, ''), COALESCE(p.content, c.content, ''),
+			COALESCE(author.username, ''), COALESCE(p.is_hidden, c.is_hidden, 0),
+			COALESCE(a.action, ''), COALESCE(moderator.username, ''), COALESCE(a.note, ''), COALESCE(a.created_at, '')
+		FROM reports r
+		JOIN users reporter ON r.reporter_id = reporter.id
+		LEFT JOIN posts p ON r.post_id = p.id
+		LEFT JOIN comments c ON r.comment_id = c.id
+		LEFT JOIN posts cp ON c.post_id = cp.id
+		LEFT JOIN users author ON author.id = COALESCE(p.author_id, c.author_id)
+		LEFT JOIN moderation_actions a ON r.action_id = a.id
+		LEFT JOIN users moderator ON a.moderator_id = moderator.id
+		WHERE (@status = '' OR r.status = @status)
+			AND (@reason = '' OR r.reason = @reason)
+			AND (@kind = '' OR (@kind = 'post' AND r.post_id IS NOT NULL) OR (@kind = 'comment' AND r.comment_id IS NOT NULL))
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT @limit
+	`, sql.Named("status", status), sql.Named("reason", reason), sql.Named("kind", kind),
+		sql.Named("limit", reportPageSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []Report
+	for rows.Next() {
+		var rep Report
+		err := rows.Scan(&rep.ID, &rep.Reason, &rep.Details, &rep.ReporterName, &rep.Status, &rep.CreatedAt,
+			&rep.PostID, &rep.CommentID, &rep.Title, &rep.Content, &rep.AuthorName, &rep.IsHidden,
+			&rep.Action, &rep.ActionBy, &rep.ActionNote, &rep.ActionAt)
+		if err != nil {
+			return nil, err
+		}
+		rep.ReasonLabel = reportReasonLabel(rep.Reason)
+		rep.CreatedAt = formatDate(rep.CreatedAt, "Jan 02, 2006 15:04")
+		if rep.ActionAt != "" {
+			rep.ActionAt = formatDate(rep.ActionAt, "Jan 02, 2006 15:04")
+		}
+		if rep.PostID == 0 {
+			rep.Title = deletedContentLabel
+		}
+		reports = append(reports, rep)
+	}
+	return reports, rows.Err()
+}
+
+// ModerationPage is the report queue. Status, Reason and Type are the
+// filters from the query string.
+type ModerationPage struct {
+	Page
+	Reports       []Report
+	Status        string
+	Reason        string
+	Type          string
+	ReportReasons []ReportReason
+	QueueActions  []QueueAction
+	Query         template.URL
+}
+
+// ModerationQueueHandler lists reports for moderators, filtered by the
+// "status" (open by default, or "all"), "reason" and "type" query parameters,
+// and applies a bulk action to the selected reports.
+func ModerationQueueHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can review reports")
+	}
+
+	if r.Method == "POST" {
+		return moderateReports(w, r, userID)
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "":
+		status = ReportOpen
+	case "all":
+		status = ""
+	}
+	reports, err := listReports(status, query.Get("reason"), query.Get("type"))
+	if err != nil {
+		return internalError(err, "Error fetching reports")
+	}
+
+	return templates.ExecuteTemplate(w, "moderation.html", ModerationPage{
+		Page:          newPage(w, r, "moderation", "Moderation Queue"),
+		Reports:       reports,
+		Status:        query.Get("status"),
+		Reason:        query.Get("reason"),
+		Type:          query.Get("type"),
+		ReportReasons: reportReasons,
+		QueueActions:  queueActions,
+		Query:         template.URL(query.Encode()),
+	})
+}
+
+// moderateReports applies the chosen action once to each piece of content
+// behind the selected open reports. Every open report on that content is
+// resolved with a link to the action taken.
+func moderateReports(w http.ResponseWriter, r *http.Request, moderatorID int64) error {
+	if err := r.ParseForm(); err != nil {
+		return newError(http.StatusBadRequest, "Invalid form")
+	}
+
+	action := r.PostForm.Get("action")
+	valid := false
+	for _, a := range queueActions {
+		valid = valid || a.Value == action
+	}
+	if !valid {
+		return newError(http.StatusBadRequest, "Invalid moderation action")
+	}
+	note := strings.TrimSpace(r.PostForm.Get("note"))
+	if len(note) > maxModerationNote {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Notes are limited to %d characters", maxModerationNote))
+	}
+	if action == ActionWarn && note == "" {
+		return newError(http.StatusBadRequest, "Please write the warning to send to the author")
+	}
+
+	var contents []reportedContent
+	seen := map[reportedContent]bool{}
+	for _, value := range r.PostForm["report"] {
+		reportID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return newError(http.StatusBadRequest, "Invalid report ID")
+		}
+		var c reportedContent
+		var postID, commentID sql.NullInt64
+		err = db.QueryRowContext(r.Context(), "SELECT post_id, comment_id FROM reports WHERE id = ? AND status = ?", reportID, ReportOpen).
+			Scan(&postID, &commentID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return internalError(err, "Error fetching reports")
+		}
+		c.PostID, c.CommentID = postID.Int64, commentID.Int64
+		if !seen[c] {
+			seen[c] = true
+			contents = append(contents, c)
+		}
+	}
+	if len(contents) == 0 {
+		return newError(http.StatusBadRequest, "Select at least one open report")
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error applying moderation action")
+	}
+	defer tx.Rollback()
+
+	var deletedBlobs []string
+	warned := map[int64]bool{}
+	for _, c := range contents {
+		keys, err := moderateContent(tx, r, moderatorID, action, note, c, warned)
+		if err != nil {
+			return internalError(err, "Error applying moderation action")
+		}
+		deletedBlobs = append(deletedBlobs, keys...)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error applying moderation action")
+	}
+	invalidatePosts()
+
+	for _, key := range deletedBlobs {
+		blobs.Delete(context.Background(), key)
+	}
+
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	return nil
+}
+
+// moderateContent applies action to one post or comment in tx, records it and
+// resolves the open reports about it. It returns the blob keys to delete once
+// the transaction commits. Authors already in warned are not warned twice.
+func moderateContent(tx *sql.Tx, r *http.Request, moderatorID int64, action, note string, c reportedContent, warned map[int64]bool) ([]string, error) {
+	var authorID sql.NullInt64
+	var snapshot string
+	if c.CommentID != 0 {
+		err := tx.QueryRowContext(r.Context(), "SELECT author_id, content FROM comments WHERE id = ?", c.CommentID).Scan(&authorID, &snapshot)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	} else {
+		var title string
+		err := tx.QueryRowContext(r.Context(), "SELECT author_id, title, content FROM posts WHERE id = ?", c.PostID).Scan(&authorID, &title, &snapshot)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if authorID.Valid {
+			snapshot = title + "\n\n" + snapshot
+		}
+	}
+
+	// Content deleted in the meantime can only have its reports dismissed.
+	if !authorID.Valid {
+		action = ActionDismiss
+	}
+
+	// Decisions on content reported as spam teach the spam classifier.
+	var reportedSpam bool
+	condition, contentID := c.where()
+	err := tx.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM reports WHERE status = ? AND reason = 'spam' AND "+condition+")",
+		ReportOpen, contentID).Scan(&reportedSpam)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = audited(tx, moderatorID, action, c.auditTarget(), note, func() error {
+		var err error
+		switch action {
+		case ActionHide:
+			err = setHidden(tx, c, true)
+		case ActionDelete:
+			if c.CommentID != 0 {
+				keys, err = deleteComment(tx, c.CommentID)
+			} else {
+				keys, err = deletePost(tx, c.PostID)
+			}
+		case ActionWarn:
+			if !warned[authorID.Int64] {
+				warned[authorID.Int64] = true
+				err = sendWarning(tx, r, moderatorID, authorID.Int64, note, c)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	actionID, err := recordModeration(tx, moderatorID, action, authorID, c, note, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	if reportedSpam && action != ActionWarn {
+		if err := trainSpam(r.Context(), tx, snapshot, action != ActionDismiss); err != nil {
+			return nil, err
+		}
+	}
+	if action == ActionDelete {
+		if err := resolveHolds(tx, c, HoldRejected, actionID); err != nil {
+			return nil, err
+		}
+	}
+
+	status := ReportActioned
+	if action == ActionDismiss {
+		status = ReportDismissed
+	}
+	_, err = tx.ExecContext(r.Context(), "UPDATE reports SET status = ?, action_id = ? WHERE status = ? AND "+condition,
+		status, actionID, ReportOpen, contentID)
+	return keys, err
+}
+
+// recordModeration writes a moderation action to the log and returns its ID.
+func recordModeration(tx *sql.Tx, moderatorID int64, action string, userID sql.NullInt64, c reportedContent, note, snapshot string) (int64, error) {
+	result, err := tx.Exec(`
+		INSERT INTO moderation_actions (moderator_id, action, user_id, post_id, comment_id, note, snapshot)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, moderatorID, action, userID, nullID(c.PostID), nullID(c.CommentID), note, snapshot)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func setHidden(tx *sql.Tx, c reportedContent, hidden bool) error {
+	var err error
+	if c.CommentID != 0 {
+		_, err = tx.Exec("UPDATE comments SET is_hidden = ? WHERE id = ?", hidden, c.CommentID)
+	} else {
+		_, err = tx.Exec("UPDATE posts SET is_hidden = ? WHERE id = ?", hidden, c.PostID)
+	}
+	return err
+}
+
+// sendWarning sends a moderator's warning to a user as a direct message
+// quoting the content it is about. Warnings are delivered even if the user
+// has blocked the moderator.
+func sendWarning(tx *sql.Tx, r *http.Request, moderatorID, userID int64, note string, c reportedContent) error {
+	conversationID, err := conversationWith(tx, moderatorID, []int64{userID}, warningSubject)
+	if err != nil {
+		return err
+	}
+
+	about := "your post"
+	postID := c.PostID
+	if c.CommentID != 0 {
+		about = "your comment on"
+		if err := tx.QueryRowContext(r.Context(), "SELECT post_id FROM comments WHERE id = ?", c.CommentID).Scan(&postID); err != nil {
+			return err
+		}
+	}
+	var title string
+	if err := tx.QueryRowContext(r.Context(), "SELECT title FROM posts WHERE id = ?", postID).Scan(&title); err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("A moderator has warned you about %s %q:\n\n%s", about, title, note)
+	return addMessage(tx, r, conversationID, moderatorID, content)
+}
+
+// deleteComment removes a comment along with its attachments and
+// notifications, returning the attachment blobs to delete.
+func deleteComment(tx *sql.Tx, commentID int64) ([]string, error) {
+	keys, err := attachmentBlobs(tx, "comment_id = ?", commentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		"DELETE FROM attachments WHERE comment_id = ?",
+		"DELETE FROM notifications WHERE comment_id = ?",
+		"DELETE FROM comments WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, commentID); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// deletePost removes a post and everything attached to it, returning the
+// attachment blobs to delete. Open reports on its comments are dismissed
+// along with it since there is nothing left to review.
+func deletePost(tx *sql.Tx, postID int64) ([]string, error) {
+	keys, err := attachmentBlobs(tx, "post_id = ? OR comment_id IN (SELECT id FROM comments WHERE post_id = ?)", postID, postID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE reports SET status = ?
+		WHERE status = ? AND comment_id IN (SELECT id FROM comments WHERE post_id = ?)
+	`, ReportDismissed, ReportOpen, postID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE filter_holds SET status = ?
+		WHERE status = ? AND comment_id IN (SELECT id FROM comments WHERE post_id = ?)
+	`, HoldRejected, HoldOpen, postID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM attachments WHERE post_id = ? OR comment_id IN (SELECT id FROM comments WHERE post_id = ?)",
+		postID, postID)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		"DELETE FROM notifications WHERE post_id = ?",
+		"DELETE FROM thread_follows WHERE post_id = ?",
+		"DELETE FROM reply_tokens WHERE post_id = ?",
+		"DELETE FROM post_tags WHERE post_id = ?",
+		"DELETE FROM comments WHERE post_id = ?",
+		"DELETE FROM posts WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, postID); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// attachmentBlobs returns the storage keys of the attachments matching
+// condition, including thumbnails.
+func attachmentBlobs(tx *sql.Tx, condition string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query("SELECT storage_key, thumbnail_key FROM attachments WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumbKey sql.NullString
+		if err := rows.Scan(&key, &thumbKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if thumbKey.Valid {
+			keys = append(keys, thumbKey.String)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// HidePostHandler toggles whether a post is hidden from everyone but
+// moderators.
+func HidePostHandler(w http.ResponseWriter, r *http.Request) error {
+	postID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid post ID")
+	}
+	return toggleHidden(w, r, reportedContent{PostID: postID}, postID)
+}
+
+// HideCommentHandler toggles whether a comment is hidden from everyone but
+// moderators.
+func HideCommentHandler(w http.ResponseWriter, r *http.Request) error {
+	commentID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid comment ID")
+	}
+
+	var postID int64
+	err = db.QueryRowContext(r.Context(), "SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Comment not found")
+	}
+	return toggleHidden(w, r, reportedContent{CommentID: commentID}, postID)
+}
+
+// toggleHidden hides or unhides content outside the queue, logging the
+// action and resolving any open reports when hiding.
+func toggleHidden(w http.ResponseWriter, r *http.Request, c reportedContent, postID int64) error {
+	userID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can hide content")
+	}
+
+	table, id := "posts", c.PostID
+	if c.CommentID != 0 {
+		table, id = "comments", c.CommentID
+	}
+	var hidden bool
+	var authorID sql.NullInt64
+	err := db.QueryRowContext(r.Context(), "SELECT is_hidden, author_id FROM "+table+" WHERE id = ?", id).Scan(&hidden, &authorID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Content not found")
+	}
+
+	// Unhiding content the filters held approves it, just as reviewing the
+	// hold would.
+	var held *heldContent
+	if hidden {
+		isHeld, err := hasOpenHold(r.Context(), c)
+		if err != nil {
+			return internalError(err, "Error updating content")
+		}
+		if isHeld {
+			h, err := loadHeldContent(r.Context(), c, authorID.Int64)
+			if err != nil {
+				return internalError(err, "Error updating content")
+			}
+			held = &h
+		}
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error updating content")
+	}
+	defer tx.Rollback()
+
+	if hidden {
+		err = audited(tx, userID, ActionUnhide, c.auditTarget(), "", func() error {
+			return setHidden(tx, c, false)
+		})
+		var actionID int64
+		if err == nil {
+			actionID, err = recordModeration(tx, userID, ActionUnhide, authorID, c, "", "")
+		}
+		if err == nil && held != nil {
+			err = decideHold(r.Context(), tx, *held, HoldApproved, actionID)
+		}
+	} else {
+		_, err = moderateContent(tx, r, userID, ActionHide, "", c, nil)
+	}
+	if err != nil {
+		return internalError(err, "Error updating content")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error updating content")
+	}
+	if c.CommentID != 0 {
+		invalidateComments(postID)
+	} else {
+		invalidatePost(postID)
+	}
+	if held != nil {
+		held.announce(r)
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+	return nil
+}
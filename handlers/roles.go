@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	RoleStudent    = "student"
+	RoleInstructor = "instructor"
+	RoleModerator  = "moderator"
+	RoleAdmin      = "admin"
+)
+
+var roles = []string{RoleStudent, RoleInstructor, RoleModerator, RoleAdmin}
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether a role may see anonymous authors and endorse
+// answers.
+func IsStaff(role string) bool {
+	return role == RoleInstructor || role == RoleModerator || role == RoleAdmin
+}
+
+// IsModerator reports whether a role may moderate content site-wide.
+func IsModerator(role string) bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// viewer is the user a request was made by.
+type viewer struct {
+	id       int64
+	role     string
+	username string
+}
+
+// currentUser returns the logged-in user's ID and role. Anonymous visitors get
+// an ID of 0 and an empty role.
+func currentUser(r *http.Request) (int64, string) {
+	v := currentViewer(r)
+	return v.id, v.role
+}
+
+// currentViewer returns the user who made the request. Most requests need
+// them several times over, in the sanction check, the handler, the page
+// header and the access log, so under Observe they are looked up once and
+// remembered for the rest of the request.
+func currentViewer(r *http.Request) viewer {
+	info := requestInfoFrom(r.Context())
+	if info != nil && info.viewer != nil {
+		return *info.viewer
+	}
+	v := lookupViewer(r)
+	if info != nil {
+		info.viewer = &v
+	}
+	return v
+}
+
+func lookupViewer(r *http.Request) viewer {
+	session, _ := store.Get(r, "session-name")
+	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		return viewer{}
+	}
+	userID, ok := session.Values["user_id"].(int64)
+	if !ok {
+		return viewer{}
+	}
+
+	v := viewer{id: userID}
+	err := queryRowPrepared(r.Context(), "SELECT role, username FROM users WHERE id = ?", userID).Scan(&v.role, &v.username)
+	if err != nil {
+		return viewer{}
+	}
+	return v
+}
+
+// ChangeRoleHandler lets an admin change another user's role.
+func ChangeRoleHandler(w http.ResponseWriter, r *http.Request) error {
+	adminID, role := currentUser(r)
+	if role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can change roles")
+	}
+
+	username := mux.Vars(r)["username"]
+	var userID int64
+	var oldRole string
+	err := db.QueryRowContext(r.Context(), "SELECT id, role FROM users WHERE username = ?", username).Scan(&userID, &oldRole)
+	if err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+	if userID == adminID {
+		return newError(http.StatusBadRequest, "You cannot change your own role")
+	}
+
+	newRole := r.FormValue("role")
+	if !validRole(newRole) {
+		return newError(http.StatusBadRequest, "Invalid role")
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if len(reason) > maxSanctionReason {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Reasons are limited to %d characters", maxSanctionReason))
+	}
+	if newRole == oldRole {
+		http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+		return nil
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error changing role")
+	}
+	defer tx.Rollback()
+
+	err = audited(tx, adminID, ActionChangeRole, auditTarget{TargetUser, userID}, reason, func() error {
+		_, err := tx.ExecContext(r.Context(), "UPDATE users SET role = ? WHERE id = ?", newRole, userID)
+		return err
+	})
+	if err != nil {
+		return internalError(err, "Error changing role")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error changing role")
+	}
+
+	http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+	return nil
+}
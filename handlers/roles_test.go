@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCurrentUserIsLookedUpOncePerRequest(t *testing.T) {
+	e := newTestEnv(t)
+	user := e.addUser("alice", RoleModerator)
+
+	var before, after viewer
+	w := e.do(func(w http.ResponseWriter, r *http.Request) error {
+		before = currentViewer(r)
+		// A lookup now would see the change.
+		e.exec("UPDATE users SET role = ?, username = 'renamed' WHERE id = ?", RoleStudent, user)
+		after = currentViewer(r)
+		return nil
+	}, request{method: http.MethodGet, target: "/", user: user})
+	wantStatus(t, w, http.StatusOK)
+
+	want := viewer{id: user, role: RoleModerator, username: "alice"}
+	if before != want || after != want {
+		t.Errorf("viewer = %+v then %+v, want %+v both times", before, after, want)
+	}
+
+	// The next request sees the change.
+	w = e.do(func(w http.ResponseWriter, r *http.Request) error {
+		after = currentViewer(r)
+		return nil
+	}, request{method: http.MethodGet, target: "/", user: user})
+	if want.role, want.username = RoleStudent, "renamed"; after != want {
+		t.Errorf("viewer = %+v on the next request, want %+v", after, want)
+	}
+}
+
+func TestCurrentUserGuest(t *testing.T) {
+	e := newTestEnv(t)
+	var got viewer
+	e.do(func(w http.ResponseWriter, r *http.Request) error {
+		got = currentViewer(r)
+		return nil
+	}, request{method: http.MethodGet, target: "/"})
+	if got != (viewer{}) {
+		t.Errorf("guest viewer = %+v, want none", got)
+	}
+}
@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Sanction kinds stored in user_sanctions.kind. Suspended and banned users
+// cannot log in; muted users can log in but not post.
+const (
+	SanctionSuspension = "suspension"
+	SanctionBan        = "ban"
+	SanctionMute       = "mute"
+)
+
+// Appeal statuses stored in sanction_appeals.status.
+const (
+	AppealOpen     = "open"
+	AppealAccepted = "accepted"
+	AppealRejected = "rejected"
+)
+
+// Moderation actions for lifting sanctions and deciding appeals. Applying a
+// sanction is logged with its kind as the action.
+const (
+	ActionLift         = "lift"
+	ActionAcceptAppeal = "accept-appeal"
+	ActionRejectAppeal = "reject-appeal"
+)
+
+const (
+	maxSanctionReason = 1000
+	maxAppealLength   = 2000
+	appealPageSize    = 100
+)
+
+// activeSanction is the condition for a sanction aliased s being in force.
+const activeSanction = "s.lifted_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > datetime('now'))"
+
+// SanctionKind is a sanction moderators can apply.
+type SanctionKind struct {
+	Value string
+	Label string
+}
+
+var sanctionKinds = []SanctionKind{
+	{SanctionMute, "Mute (read-only)"},
+	{SanctionSuspension, "Suspend"},
+	{SanctionBan, "Ban permanently"},
+}
+
+// SanctionDuration is a length offered for mutes and suspensions. Zero days
+// means permanent.
+type SanctionDuration struct {
+	Days  int
+	Label string
+}
+
+var sanctionDurations = []SanctionDuration{
+	{1, "1 day"},
+	{3, "3 days"},
+	{7, "1 week"},
+	{30, "30 days"},
+	{0, "Permanent"},
+}
+
+// Sanction is a suspension, ban or mute applied to a user, along with how it
+// was lifted and the outcome of any appeal.
+type Sanction struct {
+	ID             int64
+	UserID         int64
+	Kind           string
+	Reason         string
+	ExpiresAt      string
+	CreatedBy      string
+	CreatedAt      string
+	LiftedBy       string
+	LiftedAt       string
+	LiftReason     string
+	IsActive       bool
+	AppealStatus   string
+	AppealResponse string
+}
+
+// Description is how the sanction is described to the user it applies to.
+func (s Sanction) Description() string {
+	switch s.Kind {
+	case SanctionBan:
+		return "Your account has been banned"
+	case SanctionSuspension:
+		if s.ExpiresAt == "" {
+			return "Your account has been suspended"
+		}
+		return "Your account is suspended until " + s.ExpiresAt
+	case SanctionMute:
+		if s.ExpiresAt == "" {
+			return "Your account is read-only"
+		}
+		return "Your account is read-only until " + s.ExpiresAt
+	}
+	return ""
+}
+
+// CanAppeal reports whether the user may still appeal the sanction. Each
+// sanction can be appealed once.
+func (s Sanction) CanAppeal() bool {
+	return s.IsActive && s.AppealStatus == ""
+}
+
+// Appeal is a user's appeal against a sanction, as listed for moderators.
+type Appeal struct {
+	ID         int64
+	Sanction   Sanction
+	Username   string
+	Message    string
+	Status     string
+	Response   string
+	ReviewedBy string
+	CreatedAt  string
+}
+
+func validSanctionKind(kind string) bool {
+	for _, k := range sanctionKinds {
+		if k.Value == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func validSanctionDuration(days int) bool {
+	for _, d := range sanctionDurations {
+		if d.Days == days {
+			return true
+		}
+	}
+	return false
+}
+
+// sanctionColumns and sanctionJoins select a Sanction aliased s for
+// scanSanction. Each sanction has at most one appeal, joined as ap.
+const sanctionColumns = `
+	s.id, s.user_id, s.kind, s.reason, COALESCE(s.expires_at, ''), creator.username, s.created_at,
+	COALESCE(lifter.username, ''), COALESCE(s.lifted_at, ''), s.lift_reason, ` + activeSanction + `,
+	COALESCE(ap.status, ''), COALESCE(ap.response, '')`
+
+const sanctionJoins = `
+	JOIN users creator ON s.created_by = creator.id
+	LEFT JOIN users lifter ON s.lifted_by = lifter.id
+	LEFT JOIN sanction_appeals ap ON ap.sanction_id = s.id`
+
+func scanSanction(row interface{ Scan(...interface{}) error }) (Sanction, error) {
+	var s Sanction
+	err := row.Scan(&s.ID, &s.UserID, &s.Kind, &s.Reason, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt,
+		&s.LiftedBy, &s.LiftedAt, &s.LiftReason, &s.IsActive, &s.AppealStatus, &s.AppealResponse)
+	if err != nil {
+		return s, err
+	}
+	for _, date := range []*string{&s.ExpiresAt, &s.CreatedAt, &s.LiftedAt} {
+		if *date != "" {
+			*date = formatDate(*date, "Jan 02, 2006 15:04")
+		}
+	}
+	return s, nil
+}
+
+// userSanctions returns a user's sanctions, newest first. With activeOnly,
+// only those still in force are returned.
+func userSanctions(userID int64, activeOnly bool) ([]Sanction, error) {
+	rows, err := db.Query(`
+		SELECT `+sanctionColumns+`
+		FROM user_sanctions s `+sanctionJoins+`
+		WHERE s.user_id = ? AND (? = 0 OR `+activeSanction+`)
+		ORDER BY s.created_at DESC, s.id DESC
+	`, userID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sanctions []Sanction
+	for rows.Next() {
+		s, err := scanSanction(rows)
+		if err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, s)
+	}
+	return sanctions, rows.Err()
+}
+
+// sanctionInForce returns the most severe active sanction of the given kinds
+// on a user, if there is one: bans first, then whichever lasts longest.
+func sanctionInForce(userID int64, kinds ...string) (Sanction, bool, error) {
+	placeholders := make([]string, len(kinds))
+	args := []interface{}{userID}
+	for i, kind := range kinds {
+		placeholders[i] = "?"
+		args = append(args, kind)
+	}
+
+	s, err := scanSanction(queryRowPrepared(context.Background(), `
+		SELECT `+sanctionColumns+`
+		FROM user_sanctions s `+sanctionJoins+`
+		WHERE s.user_id = ? AND s.kind IN (`+strings.Join(placeholders, ", ")+`) AND `+activeSanction+`
+		ORDER BY s.kind = 'ban' DESC, s.expires_at IS NULL DESC, s.expires_at DESC
+		LIMIT 1
+	`, args...))
+	if err == sql.ErrNoRows {
+		return Sanction{}, false, nil
+	}
+	return s, err == nil, err
+}
+
+// checkNotMuted returns a 403 error if the user is muted, for handlers that
+// create content.
+func checkNotMuted(userID int64) error {
+	s, muted, err := sanctionInForce(userID, SanctionMute)
+	if err != nil {
+		return internalError(err, "Error checking account status")
+	}
+	if !muted {
+		return nil
+	}
+	return newError(http.StatusForbidden, fmt.Sprintf("%s: %s. You can appeal at /account/status", s.Description(), s.Reason))
+}
+
+// lockOut ends a suspended or banned user's session and sends them to the
+// account status page, which explains why and lets them appeal.
+func lockOut(w http.ResponseWriter, r *http.Request, userID int64) {
+	session, _ := store.Get(r, "session-name")
+	session.Values["authenticated"] = false
+	session.Values["user_id"] = nil
+	session.Values["sanctioned_user_id"] = userID
+	session.Save(r, w)
+	http.Redirect(w, r, "/account/status", http.StatusSeeOther)
+}
+
+// SanctionMiddleware logs out users who have been suspended or banned since
+// they logged in.
+func SanctionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID, _ := currentUser(r); userID != 0 {
+			_, locked, err := sanctionInForce(userID, SanctionSuspension, SanctionBan)
+			if err != nil {
+				serveError(trackWrites(w), r, internalError(err, "Error checking account status"))
+				return
+			}
+			if locked {
+				lockOut(w, r, userID)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accountStatusUser returns the user whose account status is being viewed:
+// the logged-in user, or the user who was just refused login.
+func accountStatusUser(r *http.Request) int64 {
+	if userID, _ := currentUser(r); userID != 0 {
+		return userID
+	}
+	session, _ := store.Get(r, "session-name")
+	userID, _ := session.Values["sanctioned_user_id"].(int64)
+	return userID
+}
+
+// AccountStatusPage lists the sanctions on the viewer's account.
+type AccountStatusPage struct {
+	Page
+	Sanctions []Sanction
+}
+
+// AccountStatusHandler shows a user the sanctions on their account, with the
+// reasons given and a form to appeal each one.
+func AccountStatusHandler(w http.ResponseWriter, r *http.Request) error {
+	userID := accountStatusUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	sanctions, err := userSanctions(userID, true)
+	if err != nil {
+		return internalError(err, "Error fetching account status")
+	}
+
+	return templates.ExecuteTemplate(w, "account-status.html", AccountStatusPage{
+		Page:      newPage(w, r, "account-status", "Account Status"),
+		Sanctions: sanctions,
+	})
+}
+
+// AppealHandler submits an appeal against one of the user's active
+// sanctions.
+func AppealHandler(w http.ResponseWriter, r *http.Request) error {
+	userID := accountStatusUser(r)
+	if userID == 0 {
+		return newError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	sanctionID, err := strconv.ParseInt(r.FormValue("sanction"), 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid sanction ID")
+	}
+	message := strings.TrimSpace(r.FormValue("message"))
+	if message == "" {
+		return newError(http.StatusBadRequest, "Please explain why the decision should be reversed")
+	}
+	if len(message) > maxAppealLength {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Appeals are limited to %d characters", maxAppealLength))
+	}
+
+	result, err := writeDB.ExecContext(r.Context(), `
+		INSERT INTO sanction_appeals (sanction_id, message)
+		SELECT s.id, ? FROM user_sanctions s
+		WHERE s.id = ? AND s.user_id = ? AND `+activeSanction+`
+			AND NOT EXISTS (SELECT 1 FROM sanction_appeals WHERE sanction_id = s.id)
+	`, message, sanctionID, userID)
+	if err != nil {
+		return internalError(err, "Error submitting appeal")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return newError(http.StatusBadRequest, "This decision can no longer be appealed")
+	}
+
+	http.Redirect(w, r, "/account/status", http.StatusSeeOther)
+	return nil
+}
+
+// SanctionUserHandler lets a moderator mute, suspend or ban a user. Only
+// admins can sanction moderators, and nobody can sanction themselves.
+func SanctionUserHandler(w http.ResponseWriter, r *http.Request) error {
+	moderatorID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can sanction users")
+	}
+
+	username := mux.Vars(r)["username"]
+	var userID int64
+	var targetRole string
+	err := db.QueryRowContext(r.Context(), "SELECT id, role FROM users WHERE username = ?", username).Scan(&userID, &targetRole)
+	if err != nil {
+		return newError(http.StatusNotFound, "User not found")
+	}
+	if userID == moderatorID {
+		return newError(http.StatusBadRequest, "You cannot sanction yourself")
+	}
+	if IsModerator(targetRole) && role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can sanction moderators")
+	}
+
+	kind := r.FormValue("kind")
+	if !validSanctionKind(kind) {
+		return newError(http.StatusBadRequest, "Invalid sanction")
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || !validSanctionDuration(days) {
+		return newError(http.StatusBadRequest, "Invalid duration")
+	}
+	if kind == SanctionBan {
+		days = 0
+	} else if kind == SanctionSuspension && days == 0 {
+		return newError(http.StatusBadRequest, "Suspensions must have an end date. Ban the user to remove them permanently.")
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		return newError(http.StatusBadRequest, "A reason is required. It is shown to the user.")
+	}
+	if len(reason) > maxSanctionReason {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Reasons are limited to %d characters", maxSanctionReason))
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error applying sanction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `
+		INSERT INTO user_sanctions (user_id, kind, reason, expires_at, created_by)
+		VALUES (?, ?, ?, CASE WHEN ? > 0 THEN datetime('now', '+' || ? || ' days') END, ?)
+	`, userID, kind, reason, days, days, moderatorID)
+	if err != nil {
+		return internalError(err, "Error applying sanction")
+	}
+	sanctionID, _ := result.LastInsertId()
+	_, err = recordModeration(tx, moderatorID, kind, nullID(userID), reportedContent{}, reason, "")
+	if err == nil {
+		err = auditCreated(tx, moderatorID, kind, auditTarget{TargetSanction, sanctionID}, reason)
+	}
+	if err != nil {
+		return internalError(err, "Error applying sanction")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error applying sanction")
+	}
+
+	http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+	return nil
+}
+
+// liftSanction ends an active sanction early and logs who lifted it and why.
+func liftSanction(tx *sql.Tx, sanctionID, moderatorID int64, reason string) error {
+	var userID int64
+	err := tx.QueryRow("SELECT s.user_id FROM user_sanctions s WHERE s.id = ? AND "+activeSanction, sanctionID).
+		Scan(&userID)
+	if err != nil {
+		return err
+	}
+
+	err = audited(tx, moderatorID, ActionLift, auditTarget{TargetSanction, sanctionID}, reason, func() error {
+		_, err := tx.Exec(`
+			UPDATE user_sanctions SET lifted_by = ?, lifted_at = CURRENT_TIMESTAMP, lift_reason = ?
+			WHERE id = ?
+		`, moderatorID, reason, sanctionID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = recordModeration(tx, moderatorID, ActionLift, nullID(userID), reportedContent{}, reason, "")
+	return err
+}
+
+// checkSanctionReviewer returns a 403 error unless the moderator may undo a
+// sanction on the user, by the same rules as imposing one: nobody may review
+// their own, and only admins may review a moderator's.
+func checkSanctionReviewer(moderatorID int64, role string, userID int64, targetRole string) error {
+	if userID == moderatorID {
+		return newError(http.StatusForbidden, "You cannot review a sanction on your own account")
+	}
+	if IsModerator(targetRole) && role != RoleAdmin {
+		return newError(http.StatusForbidden, "Only admins can review sanctions on moderators")
+	}
+	return nil
+}
+
+// LiftSanctionHandler lets a moderator end a sanction early.
+func LiftSanctionHandler(w http.ResponseWriter, r *http.Request) error {
+	moderatorID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can lift sanctions")
+	}
+
+	sanctionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid sanction ID")
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if len(reason) > maxSanctionReason {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Reasons are limited to %d characters", maxSanctionReason))
+	}
+
+	var userID int64
+	var username, targetRole string
+	err = db.QueryRowContext(r.Context(), `
+		SELECT u.id, u.username, u.role FROM user_sanctions s JOIN users u ON s.user_id = u.id WHERE s.id = ?
+	`, sanctionID).Scan(&userID, &username, &targetRole)
+	if err != nil {
+		return newError(http.StatusNotFound, "Sanction not found")
+	}
+	if err := checkSanctionReviewer(moderatorID, role, userID, targetRole); err != nil {
+		return err
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error lifting sanction")
+	}
+	defer tx.Rollback()
+
+	err = liftSanction(tx, sanctionID, moderatorID, reason)
+	if err == sql.ErrNoRows {
+		return newError(http.StatusBadRequest, "This sanction is no longer in force")
+	}
+	if err != nil {
+		return internalError(err, "Error lifting sanction")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error lifting sanction")
+	}
+
+	http.Redirect(w, r, "/user/"+username, http.StatusSeeOther)
+	return nil
+}
+
+func listAppeals() ([]Appeal, error) {
+	rows, err := db.Query(`
+		SELECT a.id, u.username, a.message, a.status, a.response, COALESCE(reviewer.username, ''), a.created_at,
+			`+sanctionColumns+`
+		FROM sanction_appeals a
+		JOIN user_sanctions s ON a.sanction_id = s.id
+		JOIN users u ON s.user_id = u.id
+		LEFT JOIN users reviewer ON a.reviewed_by = reviewer.id
+		`+sanctionJoins+`
+		ORDER BY a.status = ? DESC, a.created_at DESC, a.id DESC
+		LIMIT ?
+	`, AppealOpen, appealPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appeals []Appeal
+	for rows.Next() {
+		var a Appeal
+		var s Sanction
+		err := rows.Scan(&a.ID, &a.Username, &a.Message, &a.Status, &a.Response, &a.ReviewedBy, &a.CreatedAt,
+			&s.ID, &s.UserID, &s.Kind, &s.Reason, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt,
+			&s.LiftedBy, &s.LiftedAt, &s.LiftReason, &s.IsActive, &s.AppealStatus, &s.AppealResponse)
+		if err != nil {
+			return nil, err
+		}
+		a.CreatedAt = formatDate(a.CreatedAt, "Jan 02, 2006 15:04")
+		if s.ExpiresAt != "" {
+			s.ExpiresAt = formatDate(s.ExpiresAt, "Jan 02, 2006 15:04")
+		}
+		a.Sanction = s
+		appeals = append(appeals, a)
+	}
+	return appeals, rows.Err()
+}
+
+// AppealsPage lists appeals for moderators.
+type AppealsPage struct {
+	Page
+	Appeals []Appeal
+}
+
+// AppealsHandler lists appeals for moderators, open ones first.
+func AppealsHandler(w http.ResponseWriter, r *http.Request) error {
+	_, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can review appeals")
+	}
+
+	appeals, err := listAppeals()
+	if err != nil {
+		return internalError(err, "Error fetching appeals")
+	}
+
+	return templates.ExecuteTemplate(w, "appeals.html", AppealsPage{
+		Page:    newPage(w, r, "appeals", "Appeals"),
+		Appeals: appeals,
+	})
+}
+
+// DecideAppealHandler accepts or rejects an open appeal. Accepting it lifts
+// the sanction.
+func DecideAppealHandler(w http.ResponseWriter, r *http.Request) error {
+	moderatorID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can review appeals")
+	}
+
+	appealID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, "Invalid appeal ID")
+	}
+	decision := r.FormValue("decision")
+	if decision != AppealAccepted && decision != AppealRejected {
+		return newError(http.StatusBadRequest, "Invalid decision")
+	}
+	response := strings.TrimSpace(r.FormValue("response"))
+	if len(response) > maxSanctionReason {
+		return newError(http.StatusBadRequest, fmt.Sprintf("Responses are limited to %d characters", maxSanctionReason))
+	}
+
+	var sanctionID, userID int64
+	var targetRole string
+	err = db.QueryRowContext(r.Context(), `
+		SELECT s.id, s.user_id, u.role FROM sanction_appeals a
+		JOIN user_sanctions s ON a.sanction_id = s.id
+		JOIN users u ON s.user_id = u.id
+		WHERE a.id = ? AND a.status = ?
+	`, appealID, AppealOpen).Scan(&sanctionID, &userID, &targetRole)
+	if err != nil {
+		return newError(http.StatusNotFound, "Appeal not found")
+	}
+	if err := checkSanctionReviewer(moderatorID, role, userID, targetRole); err != nil {
+		return err
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error deciding appeal")
+	}
+	defer tx.Rollback()
+
+	action := ActionRejectAppeal
+	if decision == AppealAccepted {
+		action = ActionAcceptAppeal
+	}
+	err = audited(tx, moderatorID, action, auditTarget{TargetAppeal, appealID}, response, func() error {
+		_, err := tx.ExecContext(r.Context(), `
+			UPDATE sanction_appeals SET status = ?, response = ?, reviewed_by = ?, reviewed_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, decision, response, moderatorID, appealID)
+		return err
+	})
+	if err != nil {
+		return internalError(err, "Error deciding appeal")
+	}
+
+	if decision == AppealAccepted {
+		err = liftSanction(tx, sanctionID, moderatorID, "Appeal accepted: "+response)
+		if err == sql.ErrNoRows {
+			// The sanction ended while the appeal was open.
+			err = nil
+		}
+	} else {
+		_, err = recordModeration(tx, moderatorID, ActionRejectAppeal, nullID(userID), reportedContent{}, response, "")
+	}
+	if err != nil {
+		return internalError(err, "Error deciding appeal")
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error deciding appeal")
+	}
+
+	http.Redirect(w, r, "/moderation/appeals", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestLiftSanctionAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		liftedBy   string // role of the user lifting the sanction, or "self"
+		targetRole string
+		want       int
+	}{
+		{"moderator lifts student", RoleModerator, RoleStudent, http.StatusSeeOther},
+		{"moderator lifts own", "self", RoleModerator, http.StatusForbidden},
+		{"admin lifts own", "self", RoleAdmin, http.StatusForbidden},
+		{"moderator lifts moderator", RoleModerator, RoleModerator, http.StatusForbidden},
+		{"admin lifts moderator", RoleAdmin, RoleModerator, http.StatusSeeOther},
+		{"student lifts student", RoleStudent, RoleStudent, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			target := e.addUser("target", tt.targetRole)
+			admin := e.addUser("admin", RoleAdmin)
+			lifter := target
+			if tt.liftedBy != "self" {
+				lifter = e.addUser("lifter", tt.liftedBy)
+			}
+			sanction := e.exec("INSERT INTO user_sanctions (user_id, kind, reason, created_by) VALUES (?, ?, 'Spam', ?)",
+				target, SanctionMute, admin)
+
+			w := e.do(Handler(LiftSanctionHandler), request{
+				method: http.MethodPost,
+				target: "/sanctions/" + strconv.FormatInt(sanction, 10) + "/lift",
+				vars:   map[string]string{"id": strconv.FormatInt(sanction, 10)},
+				user:   lifter,
+				form:   url.Values{"reason": {"Resolved"}},
+			})
+			wantStatus(t, w, tt.want)
+
+			lifted := e.queryInt("SELECT COUNT(*) FROM user_sanctions WHERE id = ? AND lifted_at IS NOT NULL", sanction)
+			if want := tt.want == http.StatusSeeOther; (lifted == 1) != want {
+				t.Errorf("sanction lifted = %v, want %v", lifted == 1, want)
+			}
+		})
+	}
+}
+
+func TestDecideAppealAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		decidedBy  string // role of the user deciding the appeal, or "self"
+		targetRole string
+		want       int
+	}{
+		{"moderator decides student's", RoleModerator, RoleStudent, http.StatusSeeOther},
+		{"moderator decides own", "self", RoleModerator, http.StatusForbidden},
+		{"moderator decides moderator's", RoleModerator, RoleModerator, http.StatusForbidden},
+		{"admin decides moderator's", RoleAdmin, RoleModerator, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			target := e.addUser("target", tt.targetRole)
+			admin := e.addUser("admin", RoleAdmin)
+			decider := target
+			if tt.decidedBy != "self" {
+				decider = e.addUser("decider", tt.decidedBy)
+			}
+			sanction := e.exec("INSERT INTO user_sanctions (user_id, kind, reason, created_by) VALUES (?, ?, 'Spam', ?)",
+				target, SanctionMute, admin)
+			appeal := e.exec("INSERT INTO sanction_appeals (sanction_id, message) VALUES (?, 'It was not spam')", sanction)
+
+			w := e.do(Handler(DecideAppealHandler), request{
+				method: http.MethodPost,
+				target: "/moderation/appeals/" + strconv.FormatInt(appeal, 10),
+				vars:   map[string]string{"id": strconv.FormatInt(appeal, 10)},
+				user:   decider,
+				form:   url.Values{"decision": {AppealAccepted}, "response": {"Agreed"}},
+			})
+			wantStatus(t, w, tt.want)
+
+			open := e.queryInt("SELECT COUNT(*) FROM sanction_appeals WHERE id = ? AND status = ?", appeal, AppealOpen)
+			if want := tt.want != http.StatusSeeOther; (open == 1) != want {
+				t.Errorf("appeal still open = %v, want %v", open == 1, want)
+			}
+		})
+	}
+}
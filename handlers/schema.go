@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations holds schema changes layered on top of the base users, posts and
+// comments tables. Entries are applied in order and recorded in
+// schema_migrations, so new changes must only ever be appended.
+var migrations = []string{
+	// 1: user roles
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'student'`,
+	// 2-5: anonymous posting and instructor endorsements
+	`ALTER TABLE posts ADD COLUMN is_anonymous INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE comments ADD COLUMN is_anonymous INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE posts ADD COLUMN endorsed_by INTEGER REFERENCES users(id)`,
+	`ALTER TABLE comments ADD COLUMN endorsed_by INTEGER REFERENCES users(id)`,
+	// 6-7: tags
+	`CREATE TABLE tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE post_tags (
+		post_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (post_id, tag_id),
+		FOREIGN KEY (post_id) REFERENCES posts(id),
+		FOREIGN KEY (tag_id) REFERENCES tags(id)
+	)`,
+	// 8-14: categories, pinned, locked and announcement posts
+	`CREATE TABLE categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		slug TEXT UNIQUE NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE category_members (
+		category_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (category_id, user_id),
+		FOREIGN KEY (category_id) REFERENCES categories(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`ALTER TABLE posts ADD COLUMN category_id INTEGER REFERENCES categories(id)`,
+	`ALTER TABLE posts ADD COLUMN pin_scope TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE posts ADD COLUMN pinned_at DATETIME`,
+	`ALTER TABLE posts ADD COLUMN is_locked INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE posts ADD COLUMN is_announcement INTEGER NOT NULL DEFAULT 0`,
+	// 15: notifications
+	`CREATE TABLE notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		post_id INTEGER,
+		actor_id INTEGER,
+		read_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (post_id) REFERENCES posts(id),
+		FOREIGN KEY (actor_id) REFERENCES users(id)
+	)`,
+	// 16: attachments
+	`CREATE TABLE attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER,
+		comment_id INTEGER,
+		uploader_id INTEGER NOT NULL,
+		storage_key TEXT NOT NULL,
+		thumbnail_key TEXT,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (post_id) REFERENCES posts(id),
+		FOREIGN KEY (comment_id) REFERENCES comments(id),
+		FOREIGN KEY (uploader_id) REFERENCES users(id)
+	)`,
+	// 17: profiles
+	`CREATE TABLE user_profiles (
+		user_id INTEGER PRIMARY KEY,
+		display_name TEXT NOT NULL DEFAULT '',
+		bio TEXT NOT NULL DEFAULT '',
+		department TEXT NOT NULL DEFAULT '',
+		year TEXT NOT NULL DEFAULT '',
+		pronouns TEXT NOT NULL DEFAULT '',
+		avatar_key TEXT,
+		email_public INTEGER NOT NULL DEFAULT 0,
+		bio_public INTEGER NOT NULL DEFAULT 1,
+		department_public INTEGER NOT NULL DEFAULT 1,
+		year_public INTEGER NOT NULL DEFAULT 1,
+		pronouns_public INTEGER NOT NULL DEFAULT 1,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	// 18-20: reply, mention and followed-thread notifications
+	`ALTER TABLE notifications ADD COLUMN comment_id INTEGER REFERENCES comments(id)`,
+	`CREATE TABLE thread_follows (
+		user_id INTEGER NOT NULL,
+		post_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, post_id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (post_id) REFERENCES posts(id)
+	)`,
+	`CREATE TABLE notification_preferences (
+		user_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		enabled INTEGER NOT NULL,
+		PRIMARY KEY (user_id, type),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	// 21-23: email notifications and digests
+	`ALTER TABLE notifications ADD COLUMN emailed_at DATETIME`,
+	`CREATE TABLE email_settings (
+		user_id INTEGER PRIMARY KEY,
+		frequency TEXT NOT NULL DEFAULT 'daily',
+		unsubscribe_token TEXT UNIQUE NOT NULL,
+		last_digest_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE reply_tokens (
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		post_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, post_id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (post_id) REFERENCES posts(id)
+	)`,
+	// 24: blocked users
+	`CREATE TABLE user_blocks (
+		blocker_id INTEGER NOT NULL,
+		blocked_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id),
+		FOREIGN KEY (blocker_id) REFERENCES users(id),
+		FOREIGN KEY (blocked_id) REFERENCES users(id)
+	)`,
+	// 25-29: direct messages
+	`CREATE TABLE conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		subject TEXT NOT NULL DEFAULT '',
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	)`,
+	`CREATE TABLE conversation_members (
+		conversation_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		last_read_id INTEGER NOT NULL DEFAULT 0,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (conversation_id, user_id),
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		sender_id INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+		FOREIGN KEY (sender_id) REFERENCES users(id)
+	)`,
+	`ALTER TABLE attachments ADD COLUMN message_id INTEGER REFERENCES messages(id)`,
+	`CREATE TABLE conversation_access_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		moderator_id INTEGER NOT NULL,
+		justification TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+		FOREIGN KEY (moderator_id) REFERENCES users(id)
+	)`,
+	// 30-33: content reports and the moderation queue
+	`ALTER TABLE posts ADD COLUMN is_hidden INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE comments ADD COLUMN is_hidden INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE moderation_actions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		moderator_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		user_id INTEGER,
+		post_id INTEGER,
+		comment_id INTEGER,
+		note TEXT NOT NULL DEFAULT '',
+		snapshot TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (moderator_id) REFERENCES users(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)`,
+	`CREATE TABLE reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id INTEGER NOT NULL,
+		post_id INTEGER,
+		comment_id INTEGER,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		action_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (reporter_id) REFERENCES users(id),
+		FOREIGN KEY (action_id) REFERENCES moderation_actions(id)
+	)`,
+	// 34-35: suspensions, bans, mutes and appeals
+	`CREATE TABLE user_sanctions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		expires_at DATETIME,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		lifted_by INTEGER,
+		lifted_at DATETIME,
+		lift_reason TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		FOREIGN KEY (lifted_by) REFERENCES users(id)
+	)`,
+	`CREATE TABLE sanction_appeals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sanction_id INTEGER NOT NULL,
+		message TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		response TEXT NOT NULL DEFAULT '',
+		reviewed_by INTEGER,
+		reviewed_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (sanction_id) REFERENCES user_sanctions(id),
+		FOREIGN KEY (reviewed_by) REFERENCES users(id)
+	)`,
+	// 36-38: content filter holds and the spam classifier
+	`CREATE TABLE filter_holds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		post_id INTEGER,
+		comment_id INTEGER,
+		author_id INTEGER NOT NULL,
+		filter TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		action_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (author_id) REFERENCES users(id),
+		FOREIGN KEY (action_id) REFERENCES moderation_actions(id)
+	)`,
+	`CREATE TABLE spam_tokens (
+		token TEXT PRIMARY KEY,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE spam_documents (
+		is_spam INTEGER PRIMARY KEY,
+		documents INTEGER NOT NULL DEFAULT 0
+	)`,
+	// 39-42: append-only audit log, seeded from the moderation and
+	// conversation access logs
+	`CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id INTEGER NOT NULL,
+		target_user_id INTEGER,
+		before TEXT,
+		after TEXT,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (actor_id) REFERENCES users(id),
+		FOREIGN KEY (target_user_id) REFERENCES users(id)
+	)`,
+	`INSERT INTO audit_log (actor_id, action, target_type, target_id, target_user_id, before, reason, created_at)
+		SELECT actor_id, action, target_type, target_id, target_user_id, before, reason, created_at FROM (
+			SELECT moderator_id AS actor_id, action,
+				CASE WHEN comment_id IS NOT NULL THEN 'comment' WHEN post_id IS NOT NULL THEN 'post' ELSE 'user' END AS target_type,
+				COALESCE(comment_id, post_id, user_id, 0) AS target_id, user_id AS target_user_id,
+				CASE WHEN snapshot != '' THEN json_object('content', snapshot) END AS before,
+				note AS reason, created_at
+			FROM moderation_actions
+			UNION ALL
+			SELECT moderator_id, 'read-conversation', 'conversation', conversation_id, NULL, NULL,
+				justification, created_at
+			FROM conversation_access_log
+		)
+		ORDER BY created_at`,
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+	`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+	// 43-50: indexes for the feed, post pages, profiles and duplicate
+	// detection, which otherwise scan whole tables
+	`CREATE INDEX idx_posts_created_at ON posts (created_at)`,
+	`CREATE INDEX idx_posts_author_id ON posts (author_id, created_at)`,
+	`CREATE INDEX idx_comments_post_id ON comments (post_id, created_at)`,
+	`CREATE INDEX idx_comments_author_id ON comments (author_id, created_at)`,
+	`CREATE INDEX idx_attachments_post_id ON attachments (post_id)`,
+	`CREATE INDEX idx_attachments_comment_id ON attachments (comment_id)`,
+	`CREATE INDEX idx_attachments_message_id ON attachments (message_id)`,
+	`CREATE INDEX idx_notifications_user_id ON notifications (user_id, read_at)`,
+	// 51-52: the thumbnail's own content type, which for earlier uploads
+	// followed the original's
+	`ALTER TABLE attachments ADD COLUMN thumbnail_type TEXT`,
+	`UPDATE attachments
+		SET thumbnail_type = CASE WHEN content_type = 'image/jpeg' THEN 'image/jpeg' ELSE 'image/png' END
+		WHERE thumbnail_key IS NOT NULL`,
+}
+
+// Migrate brings the database schema up to date. The base tables must already
+// exist.
+func Migrate(database *sql.DB) error {
+	_, err := database.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(context.Background(), database)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the number of migrations applied to the database.
+func schemaVersion(ctx context.Context, database *sql.DB) (int, error) {
+	var version int
+	err := database.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+// TestMigrationChain upgrades a database from every earlier schema version,
+// with content written under the old schema, to the latest, as an existing
+// forum would be upgraded.
+func TestMigrationChain(t *testing.T) {
+	all := migrations
+	t.Cleanup(func() { migrations = all })
+
+	for from := 0; from <= len(all); from++ {
+		database := openBaseDB(t, t.TempDir())
+		migrations = all[:from]
+		if err := Migrate(database.Write); err != nil {
+			t.Fatalf("migrating to version %d: %v", from, err)
+		}
+		for _, query := range []string{
+			"INSERT INTO users (username, email, password_hash) VALUES ('alice', 'alice@example.edu', '!')",
+			"INSERT INTO posts (title, content, author_id) VALUES ('Question', 'Body', 1)",
+			"INSERT INTO comments (content, post_id, author_id) VALUES ('Answer', 1, 1)",
+		} {
+			if _, err := database.Write.Exec(query); err != nil {
+				t.Fatalf("version %d: %s: %v", from, query, err)
+			}
+		}
+
+		migrations = all
+		if err := Migrate(database.Write); err != nil {
+			t.Fatalf("upgrading from version %d: %v", from, err)
+		}
+		// Migrating an up-to-date database does nothing.
+		if err := Migrate(database.Write); err != nil {
+			t.Fatalf("migrating again from version %d: %v", from, err)
+		}
+
+		version, err := schemaVersion(context.Background(), database.Read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != len(all) {
+			t.Errorf("upgraded from version %d to %d, want %d", from, version, len(all))
+		}
+		var comments int
+		err = database.Read.QueryRow(`
+			SELECT COUNT(*) FROM comments c JOIN posts p ON c.post_id = p.id JOIN users u ON p.author_id = u.id
+		`).Scan(&comments)
+		if err != nil || comments != 1 {
+			t.Errorf("upgrading from version %d: %d comments with their post and author (%v), want 1", from, comments, err)
+		}
+		if n, err := database.ForeignKeyViolations(context.Background()); err != nil || n != 0 {
+			t.Errorf("upgrading from version %d: %d foreign key violations (%v)", from, n, err)
+		}
+		database.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// SearchPage is one page of search results.
+type SearchPage struct {
+	Page
+	Query      string
+	Tag        string
+	Posts      []Post
+	Pagination Pagination
+}
+
+// SearchHandler finds posts whose title or content matches the "q" query
+// parameter, optionally restricted to a tag.
+func SearchHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+
+	query := r.URL.Query().Get("q")
+	tag := normalizeTag(r.URL.Query().Get("tag"))
+
+	var posts []Post
+	var pagination Pagination
+	if query != "" || tag != "" {
+		clause := `
+			FROM posts p
+			JOIN users u ON p.author_id = u.id
+			WHERE (p.title LIKE @query OR p.content LIKE @query)
+		`
+		args := []interface{}{sql.Named("query", "%"+query+"%")}
+		if tag != "" {
+			clause += `
+			AND p.id IN (
+				SELECT pt.post_id FROM post_tags pt
+				JOIN tags t ON t.id = pt.tag_id
+				WHERE t.name = @tag
+			)`
+			args = append(args, sql.Named("tag", tag))
+		}
+
+		var err error
+		posts, pagination, err = listPosts(viewerID, role, clause, pageParam(r), args...)
+		if err != nil {
+			return internalError(err, "Error searching posts")
+		}
+	}
+
+	return templates.ExecuteTemplate(w, "search.html", SearchPage{
+		Page:       newPage(w, r, "search", "Search"),
+		Query:      query,
+		Tag:        tag,
+		Posts:      posts,
+		Pagination: pagination,
+	})
+}
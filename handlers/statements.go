@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// The queries behind every page view, such as the viewer's role and the feed
+// and post queries, run through statements prepared once and kept, so SQLite
+// parses and plans them once per connection rather than on every request.
+// database/sql prepares a *sql.Stmt again on each connection it runs on and
+// keeps it there for as long as the connection lives.
+var (
+	statementsMu sync.Mutex
+	statements   = map[string]*sql.Stmt{}
+)
+
+// prepared returns the statement for query on the read pool, preparing it
+// the first time. Queries built at run time may be passed too, as long as
+// they come from a small set of variations.
+func prepared(ctx context.Context, query string) (*sql.Stmt, error) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	if stmt, ok := statements[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	statements[query] = stmt
+	return stmt, nil
+}
+
+// queryPrepared is db.QueryContext through a kept statement.
+func queryPrepared(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := prepared(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// queryRowPrepared is db.QueryRowContext through a kept statement.
+func queryRowPrepared(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := prepared(ctx, query)
+	if err != nil {
+		// Running the query unprepared reports the same error from Scan.
+		return db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// resetStatements closes the kept statements, for when the database they
+// were prepared on is replaced.
+func resetStatements() {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	for query, stmt := range statements {
+		stmt.Close()
+		delete(statements, query)
+	}
+}
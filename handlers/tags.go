@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxTagsPerPost = 5
+	maxTagLength   = 32
+)
+
+// Tag is a tag name with the number of posts carrying it.
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// normalizeTag lowercases a tag and reduces it to letters, digits and single
+// dashes, so "Homework 3" and "homework-3" are the same tag. It returns "" if
+// nothing usable is left.
+func normalizeTag(raw string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(raw)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case r == '-' || r == '_' || r == ' ':
+			if !dash && b.Len() > 0 {
+				b.WriteRune('-')
+				dash = true
+			}
+		}
+	}
+	tag := strings.TrimRight(b.String(), "-")
+	if len(tag) > maxTagLength {
+		tag = strings.TrimRight(tag[:maxTagLength], "-")
+	}
+	return tag
+}
+
+// parseTags splits a comma-separated tag field into unique normalized tags.
+func parseTags(field string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, raw := range strings.Split(field, ",") {
+		tag := normalizeTag(raw)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTagsPerPost {
+			break
+		}
+	}
+	return tags
+}
+
+// setPostTags attaches tags to a post, creating any that don't exist yet.
+func setPostTags(tx *sql.Tx, postID int64, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+			SELECT ?, id FROM tags WHERE name = ?
+		`, postID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func postTags(postID int64) ([]string, error) {
+	rows, err := queryPrepared(context.Background(), `
+		SELECT t.name
+		FROM tags t
+		JOIN post_tags pt ON pt.tag_id = t.id
+		WHERE pt.post_id = ?
+		ORDER BY t.name
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+// TagPage is one page of the posts carrying a tag.
+type TagPage struct {
+	Page
+	Tag        string
+	Posts      []Post
+	Pagination Pagination
+}
+
+// TagHandler lists the posts carrying a tag, newest first.
+func TagHandler(w http.ResponseWriter, r *http.Request) error {
+	viewerID, role := currentUser(r)
+
+	tag := normalizeTag(mux.Vars(r)["name"])
+	if tag == "" {
+		return newError(http.StatusBadRequest, "Invalid tag")
+	}
+
+	posts, pagination, err := listPosts(viewerID, role, `
+		FROM posts p
+		JOIN users u ON p.author_id = u.id
+		JOIN post_tags pt ON pt.post_id = p.id
+		JOIN tags t ON t.id = pt.tag_id
+		WHERE t.name = @tag
+	`, pageParam(r), sql.Named("tag", tag))
+	if err != nil {
+		return internalError(err, "Error fetching posts")
+	}
+
+	return templates.ExecuteTemplate(w, "tag.html", TagPage{
+		Page:       newPage(w, r, "tag", "Posts tagged "+tag),
+		Tag:        tag,
+		Posts:      posts,
+		Pagination: pagination,
+	})
+}
+
+// TagAutocompleteHandler returns up to ten tags starting with the "q" query
+// parameter as JSON, most used first.
+func TagAutocompleteHandler(w http.ResponseWriter, r *http.Request) error {
+	prefix := normalizeTag(r.URL.Query().Get("q"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT t.name, COUNT(pt.post_id) AS uses
+		FROM tags t
+		LEFT JOIN post_tags pt ON pt.tag_id = t.id
+		WHERE t.name LIKE ?
+		GROUP BY t.id
+		ORDER BY uses DESC, t.name
+		LIMIT 10
+	`, prefix+"%")
+	if err != nil {
+		return internalError(err, "Error fetching tags")
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Name, &t.Count); err != nil {
+			return internalError(err, "Error fetching tags")
+		}
+		tags = append(tags, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+	return nil
+}
+
+// RenameTagHandler renames a tag. If a tag with the new name already exists
+// the two are merged: posts from the old tag move to the existing one and the
+// old tag is removed.
+func RenameTagHandler(w http.ResponseWriter, r *http.Request) error {
+	userID, role := currentUser(r)
+	if !IsModerator(role) {
+		return newError(http.StatusForbidden, "Only moderators can rename tags")
+	}
+
+	from := normalizeTag(mux.Vars(r)["name"])
+	to := normalizeTag(r.FormValue("new_name"))
+	if from == "" || to == "" {
+		return newError(http.StatusBadRequest, "Both the old and new tag names are required")
+	}
+	if from == to {
+		http.Redirect(w, r, "/tag/"+to, http.StatusSeeOther)
+		return nil
+	}
+
+	tx, err := writeDB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return internalError(err, "Error renaming tag")
+	}
+	defer tx.Rollback()
+
+	var fromID int64
+	err = tx.QueryRowContext(r.Context(), "SELECT id FROM tags WHERE name = ?", from).Scan(&fromID)
+	if err != nil {
+		return newError(http.StatusNotFound, "Tag not found")
+	}
+
+	var toID int64
+	err = tx.QueryRowContext(r.Context(), "SELECT id FROM tags WHERE name = ?", to).Scan(&toID)
+	switch {
+	case err == sql.ErrNoRows:
+		err = audited(tx, userID, ActionRenameTag, auditTarget{TargetTag, fromID}, "", func() error {
+			_, err := tx.ExecContext(r.Context(), "UPDATE tags SET name = ? WHERE id = ?", to, fromID)
+			return err
+		})
+	case err == nil:
+		err = audited(tx, userID, ActionRenameTag, auditTarget{TargetTag, fromID}, "Merged into "+to, func() error {
+			return mergeTags(tx, fromID, toID)
+		})
+	}
+	if err != nil {
+		return internalError(err, "Error renaming tag")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return internalError(err, "Error renaming tag")
+	}
+	invalidatePosts()
+
+	http.Redirect(w, r, "/tag/"+to, http.StatusSeeOther)
+	return nil
+}
+
+func mergeTags(tx *sql.Tx, fromID, toID int64) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+		SELECT post_id, ? FROM post_tags WHERE tag_id = ?
+	`, toID, fromID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", fromID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM tags WHERE id = ?", fromID)
+	return err
+}
@@ -1,63 +1,282 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"flag"
 	"fmt"
-	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+	"university-forum/bench"
+	"university-forum/config"
+	"university-forum/filter"
 	"university-forum/handlers"
+	"university-forum/mailer"
+	"university-forum/server"
+	"university-forum/sqlite"
+	"university-forum/storage"
+	"university-forum/telemetry"
+	"university-forum/views"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// assets holds the templates and static files built into the binary. With
+// -dev they are read from disk instead so edits show up without a rebuild.
+//
+//go:embed templates static
+var assets embed.FS
+
 var (
-	db          *sql.DB
-	store       *sessions.CookieStore
-	templateMap map[string]*template.Template
+	database *sqlite.DB
+	store    *sessions.CookieStore
+	renderer *views.Renderer
 )
 
-func loadTemplates() {
-	templateMap = make(map[string]*template.Template)
-	templateNames := []string{"index", "login", "register", "create-post", "view-post"}
-	layoutFile := filepath.Join("templates", "layout.html")
+// loadAssets parses the templates and returns the static file system, from
+// disk in dev mode and from the embedded copies otherwise. It exits if any
+// template fails to parse or a page the handlers render is missing.
+func loadAssets(dev bool) http.FileSystem {
+	var templateFS, staticFS fs.FS
+	if dev {
+		templateFS, staticFS = os.DirFS("templates"), os.DirFS("static")
+	} else {
+		templateFS, _ = fs.Sub(assets, "templates")
+		staticFS, _ = fs.Sub(assets, "static")
+	}
+
+	var err error
+	renderer, err = views.New(templateFS, dev)
+	if err != nil {
+		fatal("parsing templates", err)
+	}
+	if err := renderer.Require(handlers.Pages...); err != nil {
+		fatal("missing templates", err)
+	}
+	return http.FS(staticFS)
+}
+
+// configCommand runs "forum config print [flags]", which shows the settings
+// the server would start with, with secrets redacted, and then any problems
+// with them.
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: forum config print [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	cfg, err := config.Load(fs, args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := config.Print(os.Stdout, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// benchCommand runs "forum bench [flags]", which fills a throwaway database
+// and measures the feed and post pages under concurrent load. Requests go
+// over HTTP through the same routes, middleware and database settings as
+// the server, so the numbers include everything but the network.
+func benchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	clients := fs.Int("clients", 32, "number of concurrent clients")
+	duration := fs.Duration("duration", 5*time.Second, "how long to run each scenario")
+	users := fs.Int("users", 200, "users to create")
+	posts := fs.Int("posts", 2000, "posts to create")
+	comments := fs.Int("comments", 10, "comments to create on each post")
+	cacheEntries := fs.Int("cache", 0, "feed pages and post views to cache; 0 queries the database on every request")
+	fs.Parse(args)
+
+	dir, err := os.MkdirTemp("", "forum-bench-")
+	if err != nil {
+		fatal("creating benchmark directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.Default()
+	cfg.Database = filepath.Join(dir, "forum.db")
+	cfg.Storage.Dir = filepath.Join(dir, "uploads")
+	cfg.Mail.Dir = filepath.Join(dir, "mail")
+	cfg.Cache.Entries = *cacheEntries
+	// Logging every request would mostly measure the terminal.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	setup(cfg)
+	defer database.Close()
+	static := loadAssets(false)
+	handlers.InitHandlers(database.Read, database.Write, store, renderer)
+
+	ctx := context.Background()
+	fmt.Printf("seeding %d users, %d posts and %d comments\n", *users, *posts, *posts**comments)
+	data, err := bench.Seed(ctx, database.Write, bench.Size{
+		Users: *users, Posts: *posts, CommentsPerPost: *comments, Tags: 50,
+	})
+	if err != nil {
+		fatal("seeding benchmark database", err)
+	}
+
+	ts := httptest.NewServer(newRouter(static, nil, ""))
+	defer ts.Close()
+
+	login := func(client int) (*http.Cookie, error) {
+		return sessionCookie(data.UserIDs[client%len(data.UserIDs)])
+	}
+	// Most readers stay on the first few pages of the feed.
+	feedPages := max(1, min(10, len(data.PostIDs)/20))
+	feed := func(rng *rand.Rand) bench.Request {
+		return bench.Request{Path: "/?page=" + strconv.Itoa(1+rng.Intn(feedPages))}
+	}
+	post := func(rng *rand.Rand) bench.Request {
+		return bench.Request{Path: "/post/" + strconv.FormatInt(data.PostIDs[rng.Intn(len(data.PostIDs))], 10)}
+	}
+	// One request in ten comments on the post, so readers and writers
+	// contend and the cache, if on, keeps being invalidated.
+	commenting := func(rng *rand.Rand) bench.Request {
+		r := post(rng)
+		if rng.Intn(10) == 0 {
+			r.Path += "/comment"
+			r.Form = url.Values{
+				"csrf_token": {benchCSRFToken},
+				"content":    {"Benchmark reply " + strconv.FormatInt(rng.Int63(), 36)},
+			}
+		}
+		return r
+	}
 
-	for _, name := range templateNames {
-		contentFile := filepath.Join("templates", name+".html")
-		tmpl, err := template.ParseFiles(layoutFile, contentFile)
+	var results []bench.Result
+	for _, s := range []bench.Scenario{
+		{Name: "feed (guest)", Next: feed},
+		{Name: "feed (logged in)", Next: feed, Login: login},
+		{Name: "post (guest)", Next: post},
+		{Name: "post (logged in)", Next: post, Login: login},
+		{Name: "post + comments", Next: commenting, Login: login},
+	} {
+		fmt.Printf("running %s for %s with %d clients\n", s.Name, *duration, *clients)
+		result, err := bench.Run(ctx, ts.URL, s, *clients, *duration)
 		if err != nil {
-			log.Fatalf("Failed to parse template %s: %v", name, err)
+			fatal("running benchmark", err)
 		}
-		templateMap[name] = tmpl
+		results = append(results, result)
 	}
+	fmt.Println()
+	if err := bench.WriteTable(os.Stdout, results); err != nil {
+		fatal("writing results", err)
+	}
+}
+
+// benchCSRFToken is the CSRF token every benchmark session is given, so
+// clients can post forms without first loading a page to find it.
+const benchCSRFToken = "bench"
+
+// sessionCookie returns a session cookie logged in as userID, as
+// LoginHandler would set it.
+func sessionCookie(userID int64) (*http.Cookie, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(r, "session-name")
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = userID
+	session.Values["csrf_token"] = benchCSRFToken
+	if err := session.Save(r, w); err != nil {
+		return nil, err
+	}
+	return w.Result().Cookies()[0], nil
+}
+
+// fatal logs a startup failure and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func init() {
+	// Queries are traced through this driver when their context carries a
+	// span, which the handlers' contexts do once tracing is enabled.
+	sql.Register("sqlite3-traced", telemetry.WrapDriver(&sqlite3.SQLiteDriver{}, "sqlite"))
+}
+
+// setup opens the database and connects the handlers to the services they
+// use.
+func setup(cfg *config.Config) {
 	var err error
 	// Initialize database
-	db, err = sql.Open("sqlite3", "./forum.db")
+	database, err = sqlite.Open("sqlite3-traced", cfg.Database)
 	if err != nil {
-		log.Fatal(err)
+		fatal("opening database", err)
 	}
 
 	// Create tables
 	createTables()
+	if err := handlers.Migrate(database.Write); err != nil {
+		fatal("migrating database", err)
+	}
+	if n, err := database.ForeignKeyViolations(context.Background()); err != nil {
+		fatal("checking foreign keys", err)
+	} else if n > 0 {
+		slog.Warn("database has rows referring to missing rows; run PRAGMA foreign_key_check to list them", "rows", n)
+	}
+
+	store = sessions.NewCookieStore([]byte(cfg.SessionKey))
+	// Browsers leave the session cookie off form posts from other sites, as a
+	// second line of defence behind the CSRF token.
+	store.Options.SameSite = http.SameSiteLaxMode
 
-	store = sessions.NewCookieStore([]byte("super-secret-key"))
+	if cfg.Storage.Driver == "s3" {
+		handlers.InitStorage(storage.NewS3Store(cfg.Storage.S3Endpoint, cfg.Storage.S3Bucket, cfg.Storage.S3Region,
+			cfg.Storage.S3AccessKey, cfg.Storage.S3SecretKey))
+	} else {
+		handlers.InitStorage(storage.NewLocalStore(cfg.Storage.Dir))
+	}
 
-	// Load templates
-	loadTemplates()
+	var outbox mailer.Mailer
+	if cfg.Mail.Driver == "smtp" {
+		outbox = mailer.NewSMTPMailer(cfg.Mail.SMTPAddr, cfg.Mail.From, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword)
+	} else {
+		outbox = mailer.NewFileMailer(cfg.Mail.Dir, cfg.Mail.From)
+	}
+	handlers.InitMail(outbox, handlers.MailConfig{
+		BaseURL:       cfg.BaseURL,
+		ReplyDomain:   cfg.Mail.ReplyDomain,
+		InboundSecret: cfg.Mail.InboundSecret,
+	})
 
-	// Initialize handlers
-	handlers.InitHandlers(db, store, nil)
+	words, err := filter.LoadWordList(cfg.WordList)
+	if err != nil {
+		fatal("loading word list", err)
+	}
+	handlers.InitCache(cfg.Cache.Entries, cfg.Cache.TTL)
+	handlers.InitFilters(filter.Chain{
+		words,
+		filter.LinkLimit{NewAccountAge: 7 * 24 * time.Hour, MaxLinks: 2},
+		filter.Duplicate{Recent: handlers.RecentContent, Window: 24 * time.Hour},
+		filter.Classifier{Store: handlers.SpamTokens(database.Read), HoldAt: 0.9, RejectAt: 0.99, MinDocuments: 20},
+	})
 }
 
 func createTables() {
 	// Users table
-	_, err := db.Exec(`
+	_, err := database.Write.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			username TEXT UNIQUE NOT NULL,
@@ -67,11 +286,11 @@ func createTables() {
 		)
 	`)
 	if err != nil {
-		log.Fatal(err)
+		fatal("creating tables", err)
 	}
 
 	// Posts table
-	_, err = db.Exec(`
+	_, err = database.Write.Exec(`
 		CREATE TABLE IF NOT EXISTS posts (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			title TEXT NOT NULL,
@@ -82,11 +301,11 @@ func createTables() {
 		)
 	`)
 	if err != nil {
-		log.Fatal(err)
+		fatal("creating tables", err)
 	}
 
 	// Comments table
-	_, err = db.Exec(`
+	_, err = database.Write.Exec(`
 		CREATE TABLE IF NOT EXISTS comments (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			content TEXT NOT NULL,
@@ -98,206 +317,160 @@ func createTables() {
 		)
 	`)
 	if err != nil {
-		log.Fatal(err)
+		fatal("creating tables", err)
 	}
 }
 
-func main() {
+// newRouter returns the forum's routes, wrapped in the middleware every
+// request goes through.
+func newRouter(static http.FileSystem, metricsNets []*net.IPNet, metricsToken string) http.Handler {
 	r := mux.NewRouter()
 
 	// Serve static files
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(static)))
 
 	// Routes
-	r.HandleFunc("/", homeHandler).Methods("GET")
-	r.HandleFunc("/register", registerHandler).Methods("GET", "POST")
-	r.HandleFunc("/login", loginHandler).Methods("GET", "POST")
-	r.HandleFunc("/logout", logoutHandler).Methods("GET")
-	r.HandleFunc("/create-post", createPostHandler).Methods("GET", "POST")
-	r.HandleFunc("/post/{id:[0-9]+}", viewPostHandler).Methods("GET")
-	r.HandleFunc("/post/{id:[0-9]+}/comment", addCommentHandler).Methods("POST")
-
-	port := ":7000"
-	fmt.Printf("Server starting on %s...\n", port)
-	log.Fatal(http.ListenAndServe(port, r))
+	r.Handle("/", handlers.Handler(handlers.HomeHandler)).Methods("GET")
+	r.Handle("/healthz", handlers.Handler(handlers.HealthHandler)).Methods("GET", "HEAD")
+	r.Handle("/readyz", handlers.Handler(handlers.ReadyHandler)).Methods("GET", "HEAD")
+	r.Handle("/metrics", telemetry.MetricsHandler(metricsNets, metricsToken)).Methods("GET")
+	r.Handle("/register", handlers.Handler(handlers.RegisterHandler)).Methods("GET", "POST")
+	r.Handle("/login", handlers.Handler(handlers.LoginHandler)).Methods("GET", "POST")
+	r.Handle("/logout", handlers.Handler(handlers.LogoutHandler)).Methods("GET")
+	r.Handle("/create-post", handlers.Handler(handlers.CreatePostHandler)).Methods("GET", "POST")
+	r.Handle("/post/{id:[0-9]+}", handlers.Handler(handlers.ViewPostHandler)).Methods("GET")
+	r.Handle("/post/{id:[0-9]+}/comment", handlers.Handler(handlers.AddCommentHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/endorse", handlers.Handler(handlers.EndorsePostHandler)).Methods("POST")
+	r.Handle("/comment/{id:[0-9]+}/endorse", handlers.Handler(handlers.EndorseCommentHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/report", handlers.Handler(handlers.ReportPostHandler)).Methods("POST")
+	r.Handle("/comment/{id:[0-9]+}/report", handlers.Handler(handlers.ReportCommentHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/hide", handlers.Handler(handlers.HidePostHandler)).Methods("POST")
+	r.Handle("/comment/{id:[0-9]+}/hide", handlers.Handler(handlers.HideCommentHandler)).Methods("POST")
+	r.Handle("/moderation", handlers.Handler(handlers.ModerationQueueHandler)).Methods("GET", "POST")
+	r.Handle("/admin", handlers.Handler(handlers.AdminDashboardHandler)).Methods("GET")
+	r.Handle("/admin/audit", handlers.Handler(handlers.AuditLogHandler)).Methods("GET")
+	r.Handle("/admin/audit/export", handlers.Handler(handlers.AuditExportHandler)).Methods("GET")
+	r.Handle("/moderation/held", handlers.Handler(handlers.HeldContentHandler)).Methods("GET")
+	r.Handle("/moderation/held/{id:[0-9]+}", handlers.Handler(handlers.DecideHoldHandler)).Methods("POST")
+	r.Handle("/moderation/appeals", handlers.Handler(handlers.AppealsHandler)).Methods("GET")
+	r.Handle("/moderation/appeals/{id:[0-9]+}", handlers.Handler(handlers.DecideAppealHandler)).Methods("POST")
+	r.Handle("/account/status", handlers.Handler(handlers.AccountStatusHandler)).Methods("GET")
+	r.Handle("/account/appeal", handlers.Handler(handlers.AppealHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/pin", handlers.Handler(handlers.PinPostHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/lock", handlers.Handler(handlers.LockPostHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/announce", handlers.Handler(handlers.AnnouncePostHandler)).Methods("POST")
+	r.Handle("/attachments/{id:[0-9]+}", handlers.Handler(handlers.AttachmentHandler)).Methods("GET")
+	r.Handle("/attachments/{id:[0-9]+}/thumb", handlers.Handler(handlers.AttachmentThumbnailHandler)).Methods("GET")
+	r.Handle("/user/edit", handlers.Handler(handlers.EditProfileHandler)).Methods("GET", "POST")
+	r.Handle("/user/{username}", handlers.Handler(handlers.UserProfileHandler)).Methods("GET")
+	r.Handle("/user/{username}/avatar", handlers.Handler(handlers.AvatarHandler)).Methods("GET")
+	r.Handle("/user/{username}/block", handlers.Handler(handlers.BlockUserHandler)).Methods("POST")
+	r.Handle("/user/{username}/role", handlers.Handler(handlers.ChangeRoleHandler)).Methods("POST")
+	r.Handle("/user/{username}/sanctions", handlers.Handler(handlers.SanctionUserHandler)).Methods("POST")
+	r.Handle("/sanctions/{id:[0-9]+}/lift", handlers.Handler(handlers.LiftSanctionHandler)).Methods("POST")
+	r.Handle("/users/autocomplete", handlers.Handler(handlers.MentionAutocompleteHandler)).Methods("GET")
+	r.Handle("/post/{id:[0-9]+}/follow", handlers.Handler(handlers.FollowPostHandler)).Methods("POST")
+	r.Handle("/post/{id:[0-9]+}/events", handlers.Handler(handlers.PostEventsHandler)).Methods("GET")
+	r.Handle("/events/feed", handlers.Handler(handlers.FeedEventsHandler)).Methods("GET")
+	r.Handle("/messages", handlers.Handler(handlers.MessagesHandler)).Methods("GET", "POST")
+	r.Handle("/messages/unread-count", handlers.Handler(handlers.UnreadMessagesHandler)).Methods("GET")
+	r.Handle("/messages/{id:[0-9]+}", handlers.Handler(handlers.ConversationHandler)).Methods("GET", "POST")
+	r.Handle("/messages/{id:[0-9]+}/access", handlers.Handler(handlers.ConversationAccessHandler)).Methods("POST")
+	r.Handle("/notifications", handlers.Handler(handlers.NotificationsHandler)).Methods("GET")
+	r.Handle("/notifications/unread-count", handlers.Handler(handlers.UnreadNotificationsHandler)).Methods("GET")
+	r.Handle("/notifications/read-all", handlers.Handler(handlers.ReadAllNotificationsHandler)).Methods("POST")
+	r.Handle("/notifications/preferences", handlers.Handler(handlers.NotificationPreferencesHandler)).Methods("POST")
+	r.Handle("/notifications/{id:[0-9]+}/read", handlers.Handler(handlers.ReadNotificationHandler)).Methods("POST")
+	r.Handle("/unsubscribe", handlers.Handler(handlers.UnsubscribeHandler)).Methods("GET", "POST")
+	r.Handle("/email/inbound", handlers.CSRFExempt(handlers.Handler(handlers.InboundEmailHandler))).Methods("POST")
+	r.Handle("/categories", handlers.Handler(handlers.CategoriesHandler)).Methods("GET", "POST")
+	r.Handle("/category/{slug}", handlers.Handler(handlers.CategoryHandler)).Methods("GET")
+	r.Handle("/category/{slug}/join", handlers.Handler(handlers.JoinCategoryHandler)).Methods("POST")
+	r.Handle("/search", handlers.Handler(handlers.SearchHandler)).Methods("GET")
+	r.Handle("/tags/autocomplete", handlers.Handler(handlers.TagAutocompleteHandler)).Methods("GET")
+	r.Handle("/tag/{name}", handlers.Handler(handlers.TagHandler)).Methods("GET")
+	r.Handle("/tag/{name}/rename", handlers.Handler(handlers.RenameTagHandler)).Methods("POST")
+
+	r.NotFoundHandler = handlers.Handler(handlers.NotFoundHandler)
+	r.MethodNotAllowedHandler = handlers.Handler(handlers.MethodNotAllowedHandler)
+
+	r.Use(handlers.TraceRoute)
+	r.Use(handlers.CSRFMiddleware)
+	r.Use(handlers.SanctionMiddleware)
+
+	return handlers.Observe(handlers.Recover(r))
 }
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session-name")
-	posts, err := getPosts()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
 		return
 	}
-
-	isAuthenticated, _ := session.Values["authenticated"].(bool)
-
-	tmpl, ok := templateMap["index"]
-	if !ok {
-		http.Error(w, "Template not found", http.StatusInternalServerError)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		benchCommand(os.Args[2:])
 		return
 	}
 
-	err = tmpl.ExecuteTemplate(w, "layout", map[string]interface{}{
-		"IsAuthenticated": isAuthenticated,
-		"Posts":           posts,
-	})
+	dev := flag.Bool("dev", false, "serve templates and static files from disk, reloading templates on every request")
+	cfg := config.FromCommandLine()
 
+	logger, err := telemetry.NewLogger(os.Stderr, cfg.Log.Level, cfg.Log.Format)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-}
-
-func registerHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		// Process registration form
-		_ = r.FormValue("username")
-		_ = r.FormValue("email")
-		_ = r.FormValue("password")
-
-		// For testing purposes, just redirect
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-	// Direct template parsing for register page
-	t, err := template.ParseFiles(
-		"./templates/layout.html",
-		"./templates/register.html",
-	)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Template error: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	err = t.ExecuteTemplate(w, "layout", map[string]interface{}{
-		"IsAuthenticated": false,
-	})
+	// Also routes anything still logged through the log package.
+	slog.SetDefault(logger)
 
+	metricsNets, err := telemetry.ParseAllowList(cfg.Telemetry.MetricsAllow)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fatal("parsing metrics allowlist", err)
 	}
-}
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		// Process login form
-		username := r.FormValue("username")
-		password := r.FormValue("password")
-
-		// Basic validation
-		if username == "" || password == "" {
-			http.Error(w, "Username and password are required", http.StatusBadRequest)
-			return
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.Telemetry.OTLPEndpoint != "" {
+		stopTracing, err = telemetry.StartTracing(context.Background(), cfg.Telemetry.OTLPEndpoint, "university-forum")
+		if err != nil {
+			fatal("starting tracing", err)
 		}
-
-		// For testing purposes, just authenticate any user
-		session, _ := store.Get(r, "session-name")
-		session.Values["authenticated"] = true
-		session.Save(r, w)
-
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
 	}
 
-	// Direct template parsing for login page
-	t, err := template.ParseFiles(
-		"./templates/layout.html",
-		"./templates/login.html",
-	)
+	setup(cfg)
+	static := loadAssets(*dev)
+	handlers.InitHandlers(database.Read, database.Write, store, renderer)
+
+	srv, err := server.New(server.Config{
+		Addr:            cfg.Addr,
+		ReadTimeout:     cfg.Server.ReadTimeout,
+		WriteTimeout:    cfg.Server.WriteTimeout,
+		IdleTimeout:     cfg.Server.IdleTimeout,
+		ShutdownTimeout: cfg.Server.ShutdownTimeout,
+		CertFile:        cfg.Server.TLSCert,
+		KeyFile:         cfg.Server.TLSKey,
+	}, newRouter(static, metricsNets, cfg.Telemetry.MetricsToken))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Template error: %v", err), http.StatusInternalServerError)
-		return
+		fatal("configuring server", err)
 	}
-
-	err = t.ExecuteTemplate(w, "layout", map[string]interface{}{
-		"IsAuthenticated": false,
-	})
-
+	srv.OnShutdown(handlers.CloseStreams)
+
+	// SIGTERM, as sent by systemd and container runtimes, drains in-flight
+	// requests before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	schedulerDone := make(chan struct{})
+	go func() {
+		handlers.RunEmailScheduler(ctx, time.Minute)
+		close(schedulerDone)
+	}()
+
+	slog.Info("server starting", "addr", cfg.Addr, "env", cfg.Env, "tls", cfg.Server.TLSCert != "")
+	err = srv.Run(ctx)
+	<-schedulerDone
+	stopTracing(context.Background())
+	database.Close()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session-name")
-	session.Values["authenticated"] = false
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-func createPostHandler(w http.ResponseWriter, r *http.Request) {
-	// Code for create post...
-	tmpl, ok := templateMap["create-post"]
-	if !ok {
-		http.Error(w, "Template not found", http.StatusInternalServerError)
-		return
+		fatal("server stopped", err)
 	}
-
-	err := tmpl.ExecuteTemplate(w, "layout", map[string]interface{}{
-		"IsAuthenticated": true,
-	})
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func viewPostHandler(w http.ResponseWriter, r *http.Request) {
-	// Code for view post...
-	tmpl, ok := templateMap["view-post"]
-	if !ok {
-		http.Error(w, "Template not found", http.StatusInternalServerError)
-		return
-	}
-
-	err := tmpl.ExecuteTemplate(w, "layout", map[string]interface{}{
-		"IsAuthenticated": true,
-		"Title":           "Sample Post",
-		"Content":         "This is a sample post.",
-		"AuthorName":      "Admin",
-		"Comments":        []string{},
-	})
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func addCommentHandler(w http.ResponseWriter, r *http.Request) {
-	// Code for adding comments...
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-func getPosts() ([]Post, error) {
-	rows, err := db.Query(`
-		SELECT p.id, p.title, p.content, p.created_at, u.username
-		FROM posts p
-		JOIN users u ON p.author_id = u.id
-		ORDER BY p.created_at DESC
-		LIMIT 10
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var posts []Post
-	for rows.Next() {
-		var p Post
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.CreatedAt, &p.AuthorName)
-		if err != nil {
-			return nil, err
-		}
-		posts = append(posts, p)
-	}
-	return posts, nil
-}
-
-type Post struct {
-	ID         int64
-	Title      string
-	Content    string
-	AuthorName string
-	CreatedAt  string
+	slog.Info("server stopped")
 }
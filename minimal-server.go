@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"university-forum/server"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -50,7 +51,9 @@ func runMinimalServer() {
 	r.HandleFunc("/login", serveLoginPage).Methods("GET")
 
 	fmt.Println("Minimal server starting on port 5000...")
-	log.Fatal(http.ListenAndServe(":5000", r))
+	if err := server.ListenAndServe(":5000", r); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
@@ -6,6 +6,8 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"university-forum/config"
+	"university-forum/server"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -15,13 +17,16 @@ import (
 var (
 	db        *sql.DB
 	store     *sessions.CookieStore
+	cfg       *config.Config
 	templates *template.Template
 )
 
 func init() {
+	cfg = config.FromCommandLine()
+
 	var err error
 	// Initialize database
-	db, err = sql.Open("sqlite3", "./forum.db")
+	db, err = sql.Open("sqlite3", cfg.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -29,7 +34,7 @@ func init() {
 	// Create tables
 	createTables()
 
-	store = sessions.NewCookieStore([]byte("super-secret-key"))
+	store = sessions.NewCookieStore([]byte(cfg.SessionKey))
 
 	// Parse templates
 	templates = template.Must(template.ParseGlob("templates/*.html"))
@@ -97,8 +102,10 @@ func main() {
 	r.HandleFunc("/post/{id:[0-9]+}", viewPostHandler).Methods("GET")
 	r.HandleFunc("/post/{id:[0-9]+}/comment", addCommentHandler).Methods("POST")
 
-	fmt.Println("Server starting on port 7000...")
-	log.Fatal(http.ListenAndServe(":7000", r))
+	fmt.Printf("Server starting on %s...\n", cfg.Addr)
+	if err := server.ListenAndServe(cfg.Addr, r); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
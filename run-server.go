@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"time"
+	"university-forum/config"
+	"university-forum/server"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -15,17 +17,19 @@ import (
 )
 
 var (
-	runStore *sessions.CookieStore
-	runDb    *sql.DB
+	runStore  *sessions.CookieStore
+	runDb     *sql.DB
+	runConfig *config.Config
 )
 
 // Post represents a forum post
 type Post struct {
-	ID         int64
-	Title      string
-	Content    string
-	AuthorName string
-	CreatedAt  string
+	ID          int64
+	Title       string
+	Content     string
+	AuthorName  string
+	CreatedAt   string
+	IsAnonymous bool
 }
 
 // User represents a forum user
@@ -46,9 +50,11 @@ type Comment struct {
 }
 
 func init() {
+	runConfig = config.FromCommandLine()
+
 	var err error
 	// Initialize database
-	runDb, err = sql.Open("sqlite3", "./forum.db")
+	runDb, err = sql.Open("sqlite3", runConfig.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,7 +62,7 @@ func init() {
 	// Create tables
 	createRunTables()
 
-	runStore = sessions.NewCookieStore([]byte("unique-key-123"))
+	runStore = sessions.NewCookieStore([]byte(runConfig.SessionKey))
 }
 
 func createRunTables() {
@@ -695,9 +701,10 @@ func runServer() {
 	r.HandleFunc("/user/{username}", handleUserProfile).Methods("GET")
 	r.HandleFunc("/search", handleSearch).Methods("GET")
 
-	port := ":3999"
-	fmt.Printf("Server starting on %s...\n", port)
-	log.Fatal(http.ListenAndServe(port, r))
+	fmt.Printf("Server starting on %s...\n", runConfig.Addr)
+	if err := server.ListenAndServe(runConfig.Addr, r); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
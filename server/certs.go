@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes. Checks happen during handshakes, so an idle server does no work.
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves a certificate from disk and picks up a renewed one,
+// such as one written by certbot, without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modified returns the later of the two files' modification times.
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("server: loading certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have changed. A certificate that fails to load is logged and the
+// previous one kept, since the files may be caught halfway through being
+// replaced.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+
+	modTime, err := c.modified()
+	if err != nil {
+		slog.Warn("checking TLS certificate", "error", err)
+		return c.cert, nil
+	}
+	if !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.load(modTime); err != nil {
+		slog.Warn("reloading TLS certificate", "error", err)
+		return c.cert, nil
+	}
+	slog.Info("reloaded TLS certificate", "cert", c.certFile)
+	return c.cert, nil
+}
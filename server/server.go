@@ -0,0 +1,148 @@
+// Package server runs the forum's HTTP server with timeouts, optional TLS
+// and a graceful shutdown.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Config holds the listener settings. Zero timeouts are replaced with the
+// defaults below; TLS is enabled when both CertFile and KeyFile are set.
+type Config struct {
+	Addr string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish once a
+	// shutdown starts.
+	ShutdownTimeout time.Duration
+
+	CertFile string
+	KeyFile  string
+}
+
+// The read and write timeouts are generous enough for attachment uploads
+// and downloads on slow connections. Live event streams extend their own
+// write deadline as they go.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = time.Minute
+	DefaultWriteTimeout      = time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultShutdownTimeout   = 30 * time.Second
+)
+
+func (c *Config) setDefaults() {
+	def := func(d *time.Duration, v time.Duration) {
+		if *d == 0 {
+			*d = v
+		}
+	}
+	def(&c.ReadHeaderTimeout, DefaultReadHeaderTimeout)
+	def(&c.ReadTimeout, DefaultReadTimeout)
+	def(&c.WriteTimeout, DefaultWriteTimeout)
+	def(&c.IdleTimeout, DefaultIdleTimeout)
+	def(&c.ShutdownTimeout, DefaultShutdownTimeout)
+}
+
+// Server is an http.Server that shuts down cleanly when its context ends.
+type Server struct {
+	srv   *http.Server
+	certs *certReloader
+	grace time.Duration
+}
+
+// New returns a server for h. If the config enables TLS the certificate is
+// loaded now, so a bad certificate stops startup rather than the first
+// handshake.
+func New(cfg Config, h http.Handler) (*Server, error) {
+	cfg.setDefaults()
+	s := &Server{
+		srv: &http.Server{
+			Addr:              cfg.Addr,
+			Handler:           h,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			ReadTimeout:       cfg.ReadTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		},
+		grace: cfg.ShutdownTimeout,
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("server: TLS needs both a certificate and a key file")
+		}
+		certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = certs
+		s.srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+	return s, nil
+}
+
+// OnShutdown registers f to be called when a shutdown starts, before
+// in-flight requests have finished. Long-lived requests such as event
+// streams use it to end themselves so the shutdown isn't held up.
+func (s *Server) OnShutdown(f func()) {
+	s.srv.RegisterOnShutdown(f)
+}
+
+// Run serves until ctx is done, then stops accepting connections and waits
+// up to the shutdown timeout for in-flight requests. It returns nil after a
+// clean shutdown.
+func (s *Server) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() {
+		if s.certs != nil {
+			errc <- s.srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- s.srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "grace", s.grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.grace)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		// Whatever is still running is cut off.
+		s.srv.Close()
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServe serves h on addr with the default timeouts until the
+// process receives SIGINT or SIGTERM.
+func ListenAndServe(addr string, h http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	s, err := New(Config{Addr: addr}, h)
+	if err != nil {
+		return err
+	}
+	return s.Run(ctx)
+}
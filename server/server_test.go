@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// writeCert writes a self-signed certificate for commonName and its key to
+// the given files.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloaderPicksUpRenewal(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := c.GetCertificate(nil)
+	if name := commonName(t, cert); name != "first" {
+		t.Fatalf("serving %q, want first", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, _ = c.GetCertificate(nil)
+	if name := commonName(t, cert); name != "first" {
+		t.Errorf("serving %q before the check interval passed, want first", name)
+	}
+
+	c.checked = time.Time{}
+	cert, _ = c.GetCertificate(nil)
+	if name := commonName(t, cert); name != "second" {
+		t.Errorf("serving %q after renewal, want second", name)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnBadRenewal(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "first")
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A renewal caught halfway: the certificate is written, the key not yet.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	c.checked = time.Time{}
+	cert, err := c.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate() = %v, %v; want the previous certificate", cert, err)
+	}
+	if name := commonName(t, cert); name != "first" {
+		t.Errorf("serving %q, want first", name)
+	}
+}
+
+func TestNewValidatesTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := New(Config{CertFile: certFile}, http.NotFoundHandler()); err == nil {
+		t.Error("certificate without a key was accepted")
+	}
+	if _, err := New(Config{CertFile: certFile, KeyFile: keyFile}, http.NotFoundHandler()); err == nil {
+		t.Error("missing certificate files were accepted")
+	}
+	writeCert(t, certFile, keyFile, "forum")
+	if _, err := New(Config{CertFile: certFile, KeyFile: keyFile}, http.NotFoundHandler()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewSetsDefaultTimeouts(t *testing.T) {
+	s, err := New(Config{WriteTimeout: time.Second}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.srv.WriteTimeout != time.Second {
+		t.Errorf("WriteTimeout = %s, want the configured 1s", s.srv.WriteTimeout)
+	}
+	if s.srv.ReadTimeout != DefaultReadTimeout || s.grace != DefaultShutdownTimeout {
+		t.Errorf("ReadTimeout = %s, grace = %s; want the defaults", s.srv.ReadTimeout, s.grace)
+	}
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestRunFinishesRequestsOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	addr := freeAddr(t)
+	s, err := New(Config{Addr: addr, ShutdownTimeout: 5 * time.Second}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shuttingDown := make(chan struct{})
+	s.OnShutdown(func() { close(shuttingDown) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		resc <- result{string(body), err}
+	}()
+
+	select {
+	case <-started:
+	case err := <-runErr:
+		t.Fatalf("Run returned early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+	cancel()
+	select {
+	case <-shuttingDown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hooks were not called")
+	}
+	close(release)
+
+	if res := <-resc; res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request got %q, %v; want it to finish", res.body, res.err)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("Run() = %v, want nil after a clean shutdown", err)
+	}
+}
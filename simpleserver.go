@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+	"university-forum/server"
 )
 
 var templates map[string]*template.Template
@@ -91,5 +92,7 @@ func main() {
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
 	fmt.Println("Simple server starting on :9999...")
-	log.Fatal(http.ListenAndServe(":9999", nil))
+	if err := server.ListenAndServe(":9999", nil); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,100 @@
+// Package sqlite opens the forum's SQLite database set up for a web server:
+// write-ahead logging so reads don't wait for writes, a busy timeout instead
+// of immediate "database is locked" errors, enforced foreign keys, and
+// separate connection pools for reading and writing.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"time"
+)
+
+// BusyTimeout is how long a connection waits for a lock held by another
+// before giving up. With one writer in the process this only comes into play
+// for other processes, such as a backup, using the file.
+const BusyTimeout = 5 * time.Second
+
+// DB is a database opened as two pools on the same file. Read runs queries
+// on several connections at once and refuses to write. Write has a single
+// connection, so writers queue for it in the process rather than contending
+// for SQLite's lock, and its transactions take the write lock as they begin
+// so they can't fail partway through to a concurrent writer.
+type DB struct {
+	Read  *sql.DB
+	Write *sql.DB
+}
+
+// Open opens the database file at path with the named driver, which must be
+// go-sqlite3 or wrap it. The file is created if it doesn't exist.
+func Open(driverName, path string) (*DB, error) {
+	// The writer is opened first, as it is the connection that switches a
+	// new file to WAL mode.
+	write, err := sql.Open(driverName, dsn(path, url.Values{"_txlock": {"immediate"}}))
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	write.SetMaxOpenConns(1)
+	write.SetMaxIdleConns(1)
+	write.SetConnMaxLifetime(0)
+	if err := write.Ping(); err != nil {
+		write.Close()
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+
+	read, err := sql.Open(driverName, dsn(path, url.Values{"_query_only": {"true"}}))
+	if err != nil {
+		write.Close()
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// Idle connections are kept, since each holds the statements prepared on
+	// it.
+	conns := max(4, runtime.NumCPU())
+	read.SetMaxOpenConns(conns)
+	read.SetMaxIdleConns(conns)
+	read.SetConnMaxLifetime(0)
+
+	return &DB{Read: read, Write: write}, nil
+}
+
+// dsn returns the go-sqlite3 connection string for path with the settings
+// every connection shares plus extra.
+func dsn(path string, extra url.Values) string {
+	params := url.Values{
+		"_journal_mode": {"WAL"},
+		"_busy_timeout": {fmt.Sprint(BusyTimeout.Milliseconds())},
+		"_foreign_keys": {"on"},
+		// Safe with WAL: a crash can lose the last commits but never
+		// corrupts the database.
+		"_synchronous": {"NORMAL"},
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + params.Encode()
+}
+
+// ForeignKeyViolations returns how many rows refer to a row that doesn't
+// exist. Foreign keys are only checked as rows are written, so a database
+// filled before they were enforced may have some.
+func (d *DB) ForeignKeyViolations(ctx context.Context) (int, error) {
+	rows, err := d.Read.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Err()
+}
+
+// Close closes both pools.
+func (d *DB) Close() error {
+	return errors.Join(d.Read.Close(), d.Write.Close())
+}
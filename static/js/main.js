@@ -77,6 +77,106 @@ document.addEventListener('DOMContentLoaded', function() {
     if (window.location.pathname === '/search') {
         highlightSearchResults();
     }
+
+    // Unread notification count for the navbar bell
+    const notificationCount = document.getElementById('notification-count');
+    if (notificationCount) {
+        fetch('/notifications/unread-count')
+            .then(response => response.ok ? response.json() : null)
+            .then(data => {
+                if (data && data.unread > 0) {
+                    notificationCount.textContent = data.unread > 99 ? '99+' : data.unread;
+                    notificationCount.classList.remove('d-none');
+                }
+            })
+            .catch(() => {});
+    }
+
+    // Unread direct message count for the navbar
+    const messageCount = document.getElementById('message-count');
+    if (messageCount) {
+        fetch('/messages/unread-count')
+            .then(response => response.ok ? response.json() : null)
+            .then(data => {
+                if (data && data.unread > 0) {
+                    messageCount.textContent = data.unread > 99 ? '99+' : data.unread;
+                    messageCount.classList.remove('d-none');
+                }
+            })
+            .catch(() => {});
+    }
+
+    // Live comments on a thread
+    const commentList = document.getElementById('comments');
+    if (commentList && window.EventSource) {
+        const commentCount = document.getElementById('comment-count');
+        const comments = new EventSource('/post/' + commentList.dataset.postId + '/events');
+        comments.addEventListener('comment', function(e) {
+            const comment = JSON.parse(e.data);
+            if (document.getElementById('comment-' + comment.id)) {
+                return;
+            }
+
+            const card = document.createElement('div');
+            card.className = 'card mb-3 live-comment';
+            card.id = 'comment-' + comment.id;
+            const body = document.createElement('div');
+            body.className = 'card-body';
+
+            const header = document.createElement('div');
+            header.className = 'd-flex justify-content-between align-items-start mb-2';
+            const author = document.createElement('h6');
+            author.className = 'card-subtitle';
+            if (comment.authorId) {
+                const link = document.createElement('a');
+                link.href = '/user/' + encodeURIComponent(comment.authorName);
+                link.textContent = comment.authorName;
+                author.appendChild(link);
+                if (comment.isAnonymous) {
+                    const badge = document.createElement('span');
+                    badge.className = 'badge bg-secondary ms-1';
+                    badge.textContent = 'Anonymous to classmates';
+                    author.appendChild(badge);
+                }
+            } else {
+                author.textContent = comment.authorName;
+            }
+            const date = document.createElement('small');
+            date.className = 'text-muted';
+            date.textContent = comment.createdAt;
+            header.append(author, date);
+
+            const content = document.createElement('p');
+            content.className = 'card-text';
+            // Escaped by the server, with @mentions linked
+            content.innerHTML = comment.contentHtml;
+            body.append(header, content);
+            card.appendChild(body);
+
+            const empty = commentList.querySelector('.no-comments');
+            if (empty) {
+                empty.remove();
+            }
+            commentList.prepend(card);
+            if (commentCount) {
+                commentCount.textContent = parseInt(commentCount.textContent, 10) + 1;
+            }
+        });
+    }
+
+    // "N new posts" banner on feeds
+    const newPosts = document.getElementById('new-posts');
+    if (newPosts && window.EventSource) {
+        let count = 0;
+        const feed = new EventSource(newPosts.dataset.feed);
+        feed.addEventListener('post', function() {
+            count++;
+            newPosts.querySelector('a').textContent = count === 1
+                ? '1 new post. Click to refresh.'
+                : count + ' new posts. Click to refresh.';
+            newPosts.classList.remove('d-none');
+        });
+    }
 });
 
 // Auto-resize textareas
@@ -88,4 +188,118 @@ document.addEventListener('DOMContentLoaded', function() {
             this.style.height = (this.scrollHeight) + 'px';
         });
     });
-}); 
\ No newline at end of file
+}); 
+// Tag autocomplete
+document.addEventListener('DOMContentLoaded', function() {
+    const tagInputs = document.querySelectorAll('.tag-autocomplete');
+    tagInputs.forEach(input => {
+        const datalist = document.getElementById(input.getAttribute('list'));
+        if (!datalist) {
+            return;
+        }
+
+        input.addEventListener('input', function() {
+            // Only complete the tag currently being typed
+            const parts = this.value.split(',');
+            const current = parts.pop().trim();
+            const prefix = parts.length > 0 ? parts.join(',') + ', ' : '';
+
+            if (current.length === 0) {
+                datalist.innerHTML = '';
+                return;
+            }
+
+            fetch('/tags/autocomplete?q=' + encodeURIComponent(current))
+                .then(response => response.json())
+                .then(tags => {
+                    datalist.innerHTML = '';
+                    tags.forEach(tag => {
+                        const option = document.createElement('option');
+                        option.value = prefix + tag.name;
+                        option.label = `${tag.name} (${tag.count})`;
+                        datalist.appendChild(option);
+                    });
+                })
+                .catch(() => {
+                    datalist.innerHTML = '';
+                });
+        });
+    });
+});
+
+// @mention autocomplete
+document.addEventListener('DOMContentLoaded', function() {
+    const mentionInputs = document.querySelectorAll('.mention-autocomplete');
+    mentionInputs.forEach(textarea => {
+        const wrapper = document.createElement('div');
+        wrapper.className = 'position-relative';
+        textarea.parentNode.insertBefore(wrapper, textarea);
+        wrapper.appendChild(textarea);
+
+        const menu = document.createElement('div');
+        menu.className = 'dropdown-menu mention-suggestions';
+        wrapper.appendChild(menu);
+
+        // The @word ending at the cursor, if any
+        const currentMention = () => {
+            const before = textarea.value.slice(0, textarea.selectionStart);
+            const match = before.match(/(^|[^\w@])@([\w.-]*)$/);
+            return match ? { query: match[2], start: before.length - match[2].length } : null;
+        };
+
+        const hide = () => menu.classList.remove('show');
+
+        textarea.addEventListener('input', function() {
+            const mention = currentMention();
+            if (!mention) {
+                hide();
+                return;
+            }
+
+            const params = new URLSearchParams({ q: mention.query });
+            if (textarea.dataset.mentionPost) {
+                params.set('post', textarea.dataset.mentionPost);
+            } else if (textarea.dataset.mentionCategory) {
+                const category = document.getElementById(textarea.dataset.mentionCategory);
+                if (category && category.value) {
+                    params.set('category', category.value);
+                }
+            }
+
+            fetch('/users/autocomplete?' + params)
+                .then(response => response.ok ? response.json() : [])
+                .then(users => {
+                    menu.innerHTML = '';
+                    users.forEach(user => {
+                        const item = document.createElement('button');
+                        item.type = 'button';
+                        item.className = 'dropdown-item';
+                        item.textContent = '@' + user.username;
+                        if (user.displayName) {
+                            const name = document.createElement('small');
+                            name.className = 'text-muted ms-2';
+                            name.textContent = user.displayName;
+                            item.appendChild(name);
+                        }
+                        item.addEventListener('mousedown', function(e) {
+                            e.preventDefault();
+                            const end = textarea.selectionStart;
+                            textarea.value = textarea.value.slice(0, mention.start) + user.username + ' ' + textarea.value.slice(end);
+                            const cursor = mention.start + user.username.length + 1;
+                            textarea.setSelectionRange(cursor, cursor);
+                            hide();
+                        });
+                        menu.appendChild(item);
+                    });
+                    menu.classList.toggle('show', users.length > 0);
+                })
+                .catch(hide);
+        });
+        textarea.addEventListener('blur', hide);
+        textarea.addEventListener('keydown', function(e) {
+            if (e.key === 'Escape') {
+                hide();
+            }
+        });
+    });
+});
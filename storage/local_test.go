@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	testBlobStore(t, NewLocalStore(t.TempDir()))
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLocalStore(filepath.Join(dir, "blobs"))
+	for _, key := range []string{"", "/", "../outside", "a/../../outside"} {
+		if err := s.Put(context.Background(), key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside")); err == nil {
+		t.Error("a blob was written outside the store's directory")
+	}
+}
+
+func TestLocalStoreLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLocalStore(dir)
+	if err := s.Put(context.Background(), "a/b", strings.NewReader("x"), 1, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "b" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory holds %v, want just the blob", names)
+	}
+}
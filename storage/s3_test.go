@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBucket    = "forum-uploads"
+	testRegion    = "eu-west-1"
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 stands in for an S3 bucket. It verifies each request's Signature
+// Version 4 the way S3 does, from the request as received, and keeps objects
+// in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	refused []error // requests refused for a bad signature
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySignature(r, testSecretKey); err != nil {
+		f.mu.Lock()
+		f.refused = append(f.refused, fmt.Errorf("%s %s: %v", r.Method, r.URL.Path, err))
+		f.mu.Unlock()
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = fakeObject{body, r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Write(obj.body)
+	case http.MethodDelete:
+		if _, ok := f.objects[key]; !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verifySignature recomputes the AWS Signature Version 4 of a request from
+// the headers it lists as signed and compares it with the one it carries.
+func verifySignature(r *http.Request, secretKey string) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return fmt.Errorf("missing AWS4-HMAC-SHA256 Authorization header")
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(auth, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testAccessKey {
+		return fmt.Errorf("unexpected credential %q", fields["Credential"])
+	}
+	scope := credential[1]
+	if want := r.Header.Get("X-Amz-Date")[:8] + "/" + testRegion + "/s3/aws4_request"; scope != want {
+		return fmt.Errorf("scope = %q, want %q", scope, want)
+	}
+	amzDate, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("X-Amz-Date: %v", err)
+	}
+	if d := time.Since(amzDate); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("request time %s is too far from now", amzDate)
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("signed headers %v are not sorted", signed)
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		if value == "" {
+			return fmt.Errorf("signed header %s is missing", name)
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+fields["SignedHeaders"]+";", ";"+required+";") {
+			return fmt.Errorf("%s is not signed", required)
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if want := hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(fields["Signature"]), []byte(want)) {
+		return fmt.Errorf("signature %s, want %s", fields["Signature"], want)
+	}
+	return nil
+}
+
+// newFakeS3 starts a fake bucket. Unless a test expects it, a refused
+// signature fails the test.
+func newFakeS3(t *testing.T, expectRefusals bool) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(func() {
+		srv.Close()
+		if !expectRefusals {
+			for _, err := range fake.refused {
+				t.Error(err)
+			}
+		}
+	})
+	return fake, srv
+}
+
+func TestS3Store(t *testing.T) {
+	_, srv := newFakeS3(t, false)
+	testBlobStore(t, NewS3Store(srv.URL+"/", testBucket, testRegion, testAccessKey, testSecretKey))
+}
+
+func TestS3StoreSendsContentType(t *testing.T) {
+	fake, srv := newFakeS3(t, false)
+	s := NewS3Store(srv.URL, testBucket, testRegion, testAccessKey, testSecretKey)
+	err := s.Put(context.Background(), "avatars/1.png", strings.NewReader("png"), 3, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["avatars/1.png"].contentType; got != "image/png" {
+		t.Errorf("stored Content-Type = %q, want image/png", got)
+	}
+}
+
+func TestS3StoreWrongSecretIsRefused(t *testing.T) {
+	fake, srv := newFakeS3(t, true)
+	s := NewS3Store(srv.URL, testBucket, testRegion, testAccessKey, "not-the-secret")
+	err := s.Put(context.Background(), "a", strings.NewReader("x"), 1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with the wrong secret: err = %v, want a 403 error", err)
+	}
+	if len(fake.refused) != 1 || len(fake.objects) != 0 {
+		t.Errorf("%d requests refused and %d objects stored; want the upload refused", len(fake.refused), len(fake.objects))
+	}
+}
+
+func TestS3StoreSignsEscapedKeys(t *testing.T) {
+	fake, srv := newFakeS3(t, false)
+	s := NewS3Store(srv.URL, testBucket, testRegion, testAccessKey, testSecretKey)
+	key := "attachments/notes for week 1.pdf"
+	if err := s.Put(context.Background(), key, strings.NewReader("pdf"), 3, "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects[key]; !ok {
+		t.Errorf("object not stored under %q", key)
+	}
+	if got := readBlob(t, s, key); got != "pdf" {
+		t.Errorf("Get = %q, want pdf", got)
+	}
+}
@@ -0,0 +1,19 @@
+// Package storage stores uploaded files as opaque blobs addressed by key.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get when no blob exists for a key.
+var ErrNotFound = errors.New("storage: blob not found")
+
+// BlobStore is implemented by the backends uploads can be written to. Keys
+// are slash-separated paths chosen by the caller.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
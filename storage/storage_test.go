@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testBlobStore checks the behaviour every BlobStore must have.
+func testBlobStore(t *testing.T, s BlobStore) {
+	ctx := context.Background()
+	const key = "attachments/ab/report.txt"
+
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of missing blob: err = %v, want ErrNotFound", err)
+	}
+
+	body := "quarterly report"
+	if err := s.Put(ctx, key, strings.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := readBlob(t, s, key); got != body {
+		t.Errorf("Get = %q, want %q", got, body)
+	}
+
+	replaced := "revised report"
+	if err := s.Put(ctx, key, strings.NewReader(replaced), int64(len(replaced)), "text/plain"); err != nil {
+		t.Fatalf("Put over existing blob: %v", err)
+	}
+	if got := readBlob(t, s, key); got != replaced {
+		t.Errorf("Get after overwrite = %q, want %q", got, replaced)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: err = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of missing blob: %v", err)
+	}
+}
+
+func readBlob(t *testing.T, s BlobStore, key string) string {
+	t.Helper()
+	rc, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	return string(b)
+}
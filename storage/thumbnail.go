@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// MaxImagePixels bounds the decoded size of images we are willing to
+// thumbnail, so a small compressed file can't exhaust memory.
+const MaxImagePixels = 40_000_000
+
+// ErrImageTooLarge is returned by Thumbnail for images over MaxImagePixels.
+var ErrImageTooLarge = errors.New("storage: image too large to thumbnail")
+
+// Thumbnail decodes a PNG, JPEG or GIF image and returns a copy scaled to fit
+// within maxSize×maxSize, encoded as PNG if the source was PNG or GIF and as
+// JPEG otherwise. Images already small enough are re-encoded unscaled.
+func Thumbnail(r io.Reader, maxSize int) ([]byte, string, error) {
+	src, format, err := decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	dst := Resize(src, maxSize)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// Avatar decodes an image, crops it to a centred square and scales it to fit
+// within size×size, returning it encoded as PNG.
+func Avatar(r io.Reader, size int) ([]byte, error) {
+	src, _, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), src, image.Point{X: x0, Y: y0}, draw.Src)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, Resize(square, size))
+	return buf.Bytes(), err
+}
+
+// decode reads a PNG, JPEG or GIF image, refusing images whose dimensions
+// exceed MaxImagePixels before decoding the pixel data.
+func decode(r io.Reader) (image.Image, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, "", ErrImageTooLarge
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+// Resize scales src down to fit within maxSize×maxSize, averaging the source
+// pixels that fall into each destination pixel. Images that already fit are
+// returned unchanged.
+func Resize(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+
+	dw, dh := maxSize, maxSize
+	if w > h {
+		dh = h * maxSize / w
+	} else {
+		dw = w * maxSize / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := b.Min.Y + (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := b.Min.X + (x+1)*w/dw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,165 @@
+package telemetry
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// activeWindow is how recently a user must have made a request to count as
+// an active session.
+const activeWindow = 15 * time.Minute
+
+// Registry holds the forum's metrics, along with the Go runtime and process
+// metrics, for the /metrics endpoint.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forum_http_requests_total",
+		Help: "HTTP requests served, by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "forum_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "forum_db_query_duration_seconds",
+		Help:    "Time taken by database statements, by operation (query or exec) and outcome.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "outcome"})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forum_logins_total",
+		Help: "Login attempts, by result (success, failure or locked).",
+	}, []string{"result"})
+
+	PostsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "forum_posts_created_total",
+		Help: "Posts created, including those held for review.",
+	})
+
+	CommentsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "forum_comments_created_total",
+		Help: "Comments created, including those held for review and replies by email.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration, DBDuration, Logins, PostsCreated, CommentsCreated,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "forum_active_sessions",
+			Help: fmt.Sprintf("Logged-in users who have made a request in the last %v.", activeWindow),
+		}, func() float64 { return float64(activeUsers.count(time.Now())) }),
+	)
+}
+
+// Sessions live in cookies, so the server has no list of them to count.
+// Instead it remembers when each logged-in user was last seen.
+var activeUsers = &lastSeen{seen: map[int64]time.Time{}}
+
+type lastSeen struct {
+	mu   sync.Mutex
+	seen map[int64]time.Time
+}
+
+// SeenUser records a request from a logged-in user.
+func SeenUser(userID int64) {
+	activeUsers.mu.Lock()
+	activeUsers.seen[userID] = time.Now()
+	activeUsers.mu.Unlock()
+}
+
+// count returns the number of users seen within activeWindow of now,
+// forgetting the rest.
+func (l *lastSeen) count(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, t := range l.seen {
+		if now.Sub(t) > activeWindow {
+			delete(l.seen, id)
+		}
+	}
+	return len(l.seen)
+}
+
+// MetricsHandler serves the registry in the Prometheus text format to
+// clients whose address is in allow or that present token as a bearer
+// token. The client address is taken from the connection, not from proxy
+// headers, so it can't be spoofed; behind a reverse proxy it is the proxy's,
+// so allowing the proxy allows everyone. An empty token disables token
+// access, and with neither set nobody may read the metrics.
+func MetricsHandler(allow []*net.IPNet, token string) http.Handler {
+	metrics := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r, allow, token) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+func allowed(r *http.Request, allow []*net.IPNet, token string) bool {
+	if token != "" {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAllowList parses a comma-separated list of CIDR blocks or single
+// addresses, such as "127.0.0.1,10.0.0.0/8".
+func ParseAllowList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("telemetry: invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("telemetry: invalid network %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,73 @@
+package telemetry
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsHandlerAccess(t *testing.T) {
+	local, err := ParseAllowList("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		allow      []*net.IPNet
+		token      string
+		remoteAddr string
+		auth       string
+		want       int
+	}{
+		{"nothing configured", nil, "", "127.0.0.1:5000", "", http.StatusForbidden},
+		{"nothing configured, empty bearer", nil, "", "127.0.0.1:5000", "Bearer ", http.StatusForbidden},
+		{"token", nil, "s3cret", "203.0.113.9:5000", "Bearer s3cret", http.StatusOK},
+		{"wrong token", nil, "s3cret", "203.0.113.9:5000", "Bearer guess", http.StatusForbidden},
+		{"token without bearer", nil, "s3cret", "203.0.113.9:5000", "s3cret", http.StatusForbidden},
+		{"allowed address", local, "", "10.1.2.3:5000", "", http.StatusOK},
+		{"allowed single address", local, "", "127.0.0.1:5000", "", http.StatusOK},
+		{"other address", local, "", "203.0.113.9:5000", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			// Proxy headers must not grant access.
+			r.Header.Set("X-Forwarded-For", "127.0.0.1")
+			w := httptest.NewRecorder()
+			MetricsHandler(tt.allow, tt.token).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	nets, err := ParseAllowList("127.0.0.1, ::1,10.0.0.0/8,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1/32", "::1/128", "10.0.0.0/8"}
+	if len(nets) != len(want) {
+		t.Fatalf("got %v, want %v", nets, want)
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, n, want[i])
+		}
+	}
+
+	if nets, err := ParseAllowList(""); err != nil || len(nets) != 0 {
+		t.Errorf("empty list = %v, %v; want no networks", nets, err)
+	}
+	for _, bad := range []string{"localhost", "10.0.0.0/33", "300.1.1.1"} {
+		if _, err := ParseAllowList(bad); err == nil {
+			t.Errorf("ParseAllowList(%q) succeeded, want an error", bad)
+		}
+	}
+}
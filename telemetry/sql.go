@@ -0,0 +1,170 @@
+package telemetry
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxStatementLength caps the SQL recorded on a span.
+const maxStatementLength = 2000
+
+// WrapDriver returns a driver that times every query and statement run
+// through it for DBDuration, and records a span for each as a child of the
+// span in the query's context. Queries run without a traced context, such as
+// those made with db.Query rather than db.QueryContext, are timed but not
+// traced.
+//
+// The driver's connections must support contexts, as every database/sql
+// driver written since Go 1.8 does.
+func WrapDriver(d driver.Driver, system string) driver.Driver {
+	return &tracedDriver{Driver: d, system: system}
+}
+
+type tracedDriver struct {
+	driver.Driver
+	system string
+}
+
+func (d *tracedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: c, system: d.system}, nil
+}
+
+// startSpan starts a span for a statement if ctx is being traced.
+func startSpan(ctx context.Context, system, op, query string) (context.Context, trace.Span, bool) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil, false
+	}
+	if len(query) > maxStatementLength {
+		query = query[:maxStatementLength]
+	}
+	ctx, span := Tracer().Start(ctx, "db."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(system),
+			semconv.DBStatement(strings.Join(strings.Fields(query), " ")),
+		),
+	)
+	return ctx, span, true
+}
+
+// observe records how long a statement took.
+func observe(op string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	DBDuration.WithLabelValues(op, outcome).Observe(time.Since(start).Seconds())
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != driver.ErrSkip {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type tracedConn struct {
+	driver.Conn
+	system string
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	ctx, span, traced := startSpan(ctx, c.system, "query", query)
+	rows, err := q.QueryContext(ctx, query, args)
+	observe("query", start, err)
+	if traced {
+		endSpan(span, err)
+	}
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	ctx, span, traced := startSpan(ctx, c.system, "exec", query)
+	result, err := e.ExecContext(ctx, query, args)
+	observe("exec", start, err)
+	if traced {
+		if err == nil {
+			if n, rerr := result.RowsAffected(); rerr == nil {
+				span.SetAttributes(attribute.Int64("db.rows_affected", n))
+			}
+		}
+		endSpan(span, err)
+	}
+	return result, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: s, system: c.system, query: query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Unwrap returns the driver's own connection, for code that needs its
+// driver-specific methods through sql.Conn.Raw.
+func (c *tracedConn) Unwrap() driver.Conn { return c.Conn }
+
+type tracedStmt struct {
+	driver.Stmt
+	system string
+	query  string
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	ctx, span, traced := startSpan(ctx, s.system, "query", s.query)
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	observe("query", start, err)
+	if traced {
+		endSpan(span, err)
+	}
+	return rows, err
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	ctx, span, traced := startSpan(ctx, s.system, "exec", s.query)
+	result, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	observe("exec", start, err)
+	if traced {
+		endSpan(span, err)
+	}
+	return result, err
+}
@@ -0,0 +1,44 @@
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the instrumentation name spans are recorded under.
+const Name = "university-forum"
+
+// Tracer returns the tracer the forum's spans are started from. Until
+// StartTracing is called it is a no-op.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// StartTracing exports spans over OTLP/HTTP to the collector at endpoint,
+// such as "localhost:4318", and returns a function that flushes any spans
+// still buffered and stops the exporter. The connection is unencrypted, as
+// the collector is expected to run alongside the forum.
+func StartTracing(ctx context.Context, endpoint, service string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"university-forum/server"
 )
 
 func main() {
@@ -16,5 +17,7 @@ func main() {
 	})
 
 	fmt.Println("Server starting on port 8000...")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	if err := server.ListenAndServe(":8000", nil); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"university-forum/server"
 )
 
 func main() {
@@ -12,5 +13,7 @@ func main() {
 	})
 
 	fmt.Println("Test server starting on :8888...")
-	log.Fatal(http.ListenAndServe(":8888", nil))
+	if err := server.ListenAndServe(":8888", nil); err != nil {
+		log.Fatal(err)
+	}
 }
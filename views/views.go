@@ -0,0 +1,130 @@
+// Package views renders the forum's HTML pages.
+//
+// Every page in the template directory is parsed together with layout.html
+// and the shared partials in partials/, so each page can define its own
+// "content" block. Executing a page by its file name, such as "login.html",
+// renders it inside the layout.
+package views
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+const layoutFile = "layout.html"
+
+// Renderer holds the parsed page templates.
+type Renderer struct {
+	fsys fs.FS
+	dev  bool
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// New parses every page in fsys, returning an error if any page fails to
+// parse or does not define a "content" block. In dev mode pages are parsed
+// again from fsys on every render, so edits show up without a restart.
+func New(fsys fs.FS, dev bool) (*Renderer, error) {
+	r := &Renderer{fsys: fsys, dev: dev}
+	pages, err := parse(fsys)
+	if err != nil {
+		return nil, err
+	}
+	r.pages = pages
+	return r, nil
+}
+
+func parse(fsys fs.FS) (map[string]*template.Template, error) {
+	partials, err := fs.Glob(fsys, "partials/*.html")
+	if err != nil {
+		return nil, err
+	}
+	base, err := template.ParseFS(fsys, append([]string{layoutFile}, partials...)...)
+	if err != nil {
+		return nil, err
+	}
+	if base.Lookup("layout") == nil {
+		return nil, fmt.Errorf("views: %s does not define \"layout\"", layoutFile)
+	}
+
+	names, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		if name == layoutFile {
+			continue
+		}
+		t, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if t, err = t.ParseFS(fsys, name); err != nil {
+			return nil, err
+		}
+		if t.Lookup("content") == nil {
+			return nil, fmt.Errorf("views: %s does not define \"content\"", name)
+		}
+		// The page's own template renders the layout, which pulls in the
+		// page's "content".
+		if _, err := t.New(name).Parse(`{{template "layout" .}}`); err != nil {
+			return nil, err
+		}
+		pages[name] = t
+	}
+	return pages, nil
+}
+
+// Require returns an error naming any of the given pages that do not exist,
+// so a server can refuse to start rather than fail on the first request.
+func (r *Renderer) Require(names ...string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var missing []string
+	for _, name := range names {
+		if _, ok := r.pages[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("views: missing templates %v", missing)
+	}
+	return nil
+}
+
+// ExecuteTemplate renders the named page to w. The page is rendered to a
+// buffer first so that a failure part way through does not leave a half
+// written page in front of an error message.
+func (r *Renderer) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	if r.dev {
+		pages, err := parse(r.fsys)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.pages = pages
+		r.mu.Unlock()
+	}
+
+	r.mu.RLock()
+	t, ok := r.pages[name]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("views: no template %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}